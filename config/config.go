@@ -28,7 +28,10 @@ func ConfigFilename() string {
 	return configFilename
 }
 
-// parseCommandLine deciphers command line arguments.
+// ParseCommandLine deciphers command line arguments and loads the
+// configuration file.
+// ParseCommandLine should be called once, from main, before any other
+// package is initialized from the configuration.
 //
 // --config filename
 //     Use alternate configuration file.
@@ -38,7 +41,7 @@ func ConfigFilename() string {
 //     Sets OSC batch file to run at startup.
 //     Defaults to no file.
 //
-func parseCommandLine() {
+func ParseCommandLine() {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
 		configDir = ".config"
@@ -49,9 +52,9 @@ func parseCommandLine() {
 	// batch filename
 	defaultFile = ""
 	flag.StringVar(&BatchFilename, "batch", defaultFile, "Sets initial OSC batch file.")
-	BatchFilename = pigpath.SubSpecialDirectories(BatchFilename)
-	
 	flag.Parse()
+	BatchFilename = pigpath.SubSpecialDirectories(BatchFilename)
+	readConfigurationFile(configFilename)
 }
 
 
@@ -170,7 +173,5 @@ func readConfigurationFile(filename string) {
 
 func init() {
 	defineColors()
-	parseCommandLine()
 	ResetGlobalParameters()
-	readConfigurationFile(configFilename)
 }
@@ -38,9 +38,9 @@
 **    [tree]
 **          max-depth = int             GlobalParameters.MaxTreeDepth
 **
-**     Sets the maximum depth of the MIDI process tree.  No path through
-**     the tree, from root to final output, is allowed to pass through more
-**     then max-depth operators.
+**     No longer used.  Connections are checked directly for cycles and the
+**     depth of the MIDI process tree is not limited.  The value is accepted
+**     for compatibility with existing configuration files.
 **
 **    [midi-input]
 **          buffer-size = int           GlobalParameters.MIDIInputBufferSize
@@ -51,6 +51,8 @@ func printBanner() {
 
 
 func main() {
+	config.ParseCommandLine()
+	piglog.Init()
 	piglog.Log("-------- Pigiron main()")
 	piglog.Log(VERSION.String())
 	printBanner()
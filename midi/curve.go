@@ -0,0 +1,191 @@
+package midi
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+/*
+** Curve is a parametric data byte response, typically used for velocity.
+**
+** Shapes and parameters, x is the normalized input value 0.0 < x <= 1.0
+**
+**    linear [min max]             min + (max - min) * x          (1 127)
+**    exponential [exponent]       127 * x^exponent               (2)
+**    logarithmic [amount]         127 * log(1 + amount*x)/log(1 + amount)  (10)
+**    s-curve [amount]             127 * x^a / (x^a + (1-x)^a)    (2)
+**    fixed [value]                value                          (100)
+**    compress [threshold ratio]   values above threshold are reduced
+**                                 by ratio                       (64 2)
+**
+** An input of 0 always produces 0 and all other inputs produce values
+** between 1 and 127.  Thus a NOTE_ON is never converted to a NOTE_OFF.
+**
+*/
+
+type curveShape struct {
+	defaults []float64
+	validate func(params []float64) error
+	fn func(v float64, params []float64) float64
+}
+
+func curvePositive(name string) func([]float64) error {
+	return func(params []float64) error {
+		var err error
+		if params[0] <= 0 {
+			errmsg := "Curve %s must be greater than 0, got %v"
+			err = fmt.Errorf(errmsg, name, params[0])
+		}
+		return err
+	}
+}
+
+func curveRange(names ...string) func([]float64) error {
+	return func(params []float64) error {
+		var err error
+		for i, name := range names {
+			if params[i] < 0 || params[i] > 127 {
+				errmsg := "Curve %s must be between 0 and 127, got %v"
+				err = fmt.Errorf(errmsg, name, params[i])
+				return err
+			}
+		}
+		return err
+	}
+}
+
+var curveShapes = map[string]curveShape{
+	"linear": {
+		[]float64{1, 127},
+		curveRange("min", "max"),
+		func(v float64, p []float64) float64 {
+			return p[0] + (p[1] - p[0]) * (v - 1) / 126
+		}},
+	"exponential": {
+		[]float64{2},
+		curvePositive("exponent"),
+		func(v float64, p []float64) float64 {
+			return 127 * math.Pow(v / 127, p[0])
+		}},
+	"logarithmic": {
+		[]float64{10},
+		curvePositive("amount"),
+		func(v float64, p []float64) float64 {
+			return 127 * math.Log1p(p[0] * v / 127) / math.Log1p(p[0])
+		}},
+	"s-curve": {
+		[]float64{2},
+		curvePositive("amount"),
+		func(v float64, p []float64) float64 {
+			a := math.Pow(v / 127, p[0])
+			b := math.Pow(1 - v / 127, p[0])
+			return 127 * a / (a + b)
+		}},
+	"fixed": {
+		[]float64{100},
+		curveRange("value"),
+		func(v float64, p []float64) float64 {
+			return p[0]
+		}},
+	"compress": {
+		[]float64{64, 2},
+		func(p []float64) error {
+			err := curveRange("threshold")(p)
+			if err == nil && p[1] < 1 {
+				errmsg := "Curve ratio must be at least 1, got %v"
+				err = fmt.Errorf(errmsg, p[1])
+			}
+			return err
+		},
+		func(v float64, p []float64) float64 {
+			if v <= p[0] {
+				return v
+			}
+			return p[0] + (v - p[0]) / p[1]
+		}},
+}
+
+// CurveShapes() returns names of all curve shapes.
+//
+func CurveShapes() []string {
+	return []string{"linear", "exponential", "logarithmic", "s-curve", "fixed", "compress"}
+}
+
+type Curve struct {
+	shape string
+	params []float64
+}
+
+// NewCurve() returns a Curve of the named shape.
+// Missing parameters are set to their default values.
+// Returns non-nil error if the shape is unknown or parameters are invalid.
+//
+func NewCurve(shape string, params ...float64) (*Curve, error) {
+	var err error
+	shape = strings.ToLower(shape)
+	cs, flag := curveShapes[shape]
+	if !flag {
+		errmsg := "Unknown curve shape '%s', expected one of %s"
+		err = fmt.Errorf(errmsg, shape, strings.Join(CurveShapes(), ", "))
+		return nil, err
+	}
+	if len(params) > len(cs.defaults) {
+		errmsg := "Curve %s expects at most %d parameters, got %d"
+		err = fmt.Errorf(errmsg, shape, len(cs.defaults), len(params))
+		return nil, err
+	}
+	acc := append([]float64{}, cs.defaults...)
+	copy(acc, params)
+	if err = cs.validate(acc); err != nil {
+		return nil, err
+	}
+	return &Curve{shape, acc}, err
+}
+
+// IdentityCurve() returns linear curve f(x) -> x
+//
+func IdentityCurve() *Curve {
+	c, _ := NewCurve("linear")
+	return c
+}
+
+func (c *Curve) Shape() string {
+	return c.shape
+}
+
+// Params() returns copy of the curve parameters.
+//
+func (c *Curve) Params() []float64 {
+	return append([]float64{}, c.params...)
+}
+
+// Value() returns the curve value for data byte v.
+//
+func (c *Curve) Value(v byte) byte {
+	if v == 0 {
+		return 0
+	}
+	if v > 127 {
+		v = 127
+	}
+	n := math.Round(curveShapes[c.shape].fn(float64(v), c.params))
+	return byte(math.Max(1, math.Min(127, n)))
+}
+
+// Fill() writes curve values to all DataTable positions.
+//
+func (c *Curve) Fill(dt *DataTable) {
+	f, ceiling := dt.TransformRange()
+	for i := f; i < ceiling; i++ {
+		dt.table[i] = c.Value(i)
+	}
+}
+
+func (c *Curve) String() string {
+	acc := c.shape
+	for _, p := range c.params {
+		acc += fmt.Sprintf(" %v", p)
+	}
+	return acc
+}
@@ -0,0 +1,95 @@
+package midi
+
+import (
+	"testing"
+)
+
+func TestCurveShapes(t *testing.T) {
+	for _, shape := range CurveShapes() {
+		c, err := NewCurve(shape)
+		if err != nil {
+			t.Fatalf("NewCurve(%s) returned error: %s", shape, err)
+		}
+		if c.Value(0) != 0 {
+			t.Fatalf("%s: expected 0 -> 0, got %d", c, c.Value(0))
+		}
+		prev := byte(0)
+		for v := byte(1); v < 128; v++ {
+			n := c.Value(v)
+			if n < 1 || n > 127 {
+				t.Fatalf("%s: value %d -> %d out of range", c, v, n)
+			}
+			if n < prev {
+				t.Fatalf("%s: not monotonic at %d", c, v)
+			}
+			prev = n
+		}
+	}
+}
+
+func TestCurveValues(t *testing.T) {
+	var tests = []struct {
+		shape string
+		params []float64
+		in byte
+		out byte
+	}{
+		{"linear", nil, 64, 64},
+		{"linear", []float64{20, 100}, 1, 20},
+		{"linear", []float64{20, 100}, 127, 100},
+		{"linear", []float64{100, 20}, 127, 20},
+		{"exponential", nil, 127, 127},
+		{"exponential", nil, 64, 32},
+		{"logarithmic", nil, 127, 127},
+		{"s-curve", nil, 64, 64},
+		{"s-curve", []float64{3}, 32, 5},
+		{"fixed", []float64{90}, 10, 90},
+		{"fixed", []float64{0}, 10, 1},
+		{"compress", nil, 40, 40},
+		{"compress", []float64{64, 4}, 124, 79},
+	}
+	for _, test := range tests {
+		c, err := NewCurve(test.shape, test.params...)
+		if err != nil {
+			t.Fatalf("NewCurve(%s %v) returned error: %s", test.shape, test.params, err)
+		}
+		if n := c.Value(test.in); n != test.out {
+			t.Fatalf("%s: expected %d -> %d, got %d", c, test.in, test.out, n)
+		}
+	}
+	if log, _ := NewCurve("logarithmic"); log.Value(32) <= 32 {
+		t.Fatalf("logarithmic curve should boost low values, got %d", log.Value(32))
+	}
+}
+
+func TestCurveErrors(t *testing.T) {
+	var tests = []struct {
+		shape string
+		params []float64
+	}{
+		{"bogus", nil},
+		{"linear", []float64{1, 128}},
+		{"linear", []float64{1, 2, 3}},
+		{"exponential", []float64{0}},
+		{"compress", []float64{64, 0.5}},
+	}
+	for _, test := range tests {
+		if _, err := NewCurve(test.shape, test.params...); err == nil {
+			t.Fatalf("Expected error for curve %s %v", test.shape, test.params)
+		}
+	}
+}
+
+func TestCurveFill(t *testing.T) {
+	dt := NewDataTable()
+	c, _ := NewCurve("fixed", 64)
+	c.Fill(dt)
+	for i := byte(1); i < 128; i++ {
+		if v, _ := dt.Value(i); v != 64 {
+			t.Fatalf("Expected table value 64 at %d, got %d", i, v)
+		}
+	}
+	if v, _ := dt.Value(0); v != 0 {
+		t.Fatalf("Expected table value 0 at 0, got %d", v)
+	}
+}
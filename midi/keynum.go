@@ -7,6 +7,8 @@ package midi
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 var keynames [128]string
@@ -35,3 +37,30 @@ func KeyName(n byte) string {
 		return "<ERR>"
 	}
 }
+
+// ParsePitchClass() converts a note name (C, C#, Db ... B) or a number
+// 0 <= n < 12 to a pitch class, with C = 0.
+//
+func ParsePitchClass(s string) (int, error) {
+	var err error
+	name := strings.ToUpper(strings.TrimSpace(s))
+	if n, nerr := strconv.Atoi(name); nerr == nil {
+		if 0 <= n && n < 12 {
+			return n, err
+		}
+	} else if len(name) > 0 {
+		if pc := strings.Index("C D EF G A B", name[:1]); pc >= 0 && name[0] != ' ' {
+			switch name[1:] {
+			case "":
+				return pc, err
+			case "#":
+				return (pc + 1) % 12, err
+			case "B":
+				return (pc + 11) % 12, err
+			}
+		}
+	}
+	errmsg := "Expected pitch class name or number 0..11, got '%s'"
+	err = fmt.Errorf(errmsg, s)
+	return 0, err
+}
@@ -0,0 +1,19 @@
+package midi
+
+import (
+	"testing"
+)
+
+func TestParsePitchClass(t *testing.T) {
+	expect := map[string]int{"C": 0, "c#": 1, "Db": 1, "E": 4, "F": 5, "Bb": 10, "B": 11, "Cb": 11, "7": 7}
+	for name, pc := range expect {
+		if n, err := ParsePitchClass(name); err != nil || n != pc {
+			t.Fatalf("ParsePitchClass(%q) expected %d, got %d %v", name, pc, n, err)
+		}
+	}
+	for _, name := range []string{"", "H", "C##", "12", "-1", " "} {
+		if _, err := ParsePitchClass(name); err == nil {
+			t.Fatalf("ParsePitchClass(%q) expected error", name)
+		}
+	}
+}
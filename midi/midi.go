@@ -86,6 +86,7 @@ const (
 	START StatusByte = 0xFA
 	CONTINUE StatusByte = 0xFB
 	STOP StatusByte = 0xFC
+	SONG_POSITION StatusByte = 0xF2
 	ACTIVE_SNESING StatusByte = 0xFE
 	SYSEX StatusByte = 0xF0
 	END_SYSEX StatusByte = 0xF7
@@ -106,6 +107,7 @@ var statusMnemonics = map[StatusByte]string {
 		START            : "STRT ",
 		CONTINUE         : "CONT ",
 		STOP             : "STOP ",
+		SONG_POSITION    : "SPP  ",
 		ACTIVE_SNESING   : "ASNS ",
 		SYSEX            : "SYEX ",
 		END_SYSEX        : "EOX  "}
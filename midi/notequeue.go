@@ -50,8 +50,8 @@ type NoteQueue struct {
 // nq.Reset() sets all note-counts to 0.
 //
 func (nq *NoteQueue) Reset() {
-	for _, c := range nq.channels {
-		c.reset()
+	for i := range nq.channels {
+		nq.channels[i].reset()
 	}
 }
 
@@ -50,3 +50,14 @@ func TestNoteQueue(t *testing.T) {
 		t.Fatalf(msg, nq.OpenCount(0, 0))
 	}
 }
+
+func TestNoteQueueReset(t *testing.T) {
+	nq := MakeNoteQueue()
+	nq.Update(onEvent(3, 60))
+	nq.Update(onEvent(3, 60))
+	nq.Reset()
+	if nq.OpenCount(3, 60) != 0 || len(nq.OffEvents()) != 0 {
+		msg := "Expected no open notes after Reset, got count %d"
+		t.Fatalf(msg, nq.OpenCount(3, 60))
+	}
+}
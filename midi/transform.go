@@ -175,6 +175,38 @@ func (bank *TransformBank) SetValue(index byte, value byte) error {
 	return bank.currentTransform().SetValue(index, value)
 }
 
+func (bank *TransformBank) Dump() string {
+	return bank.currentTransform().Dump()
+}
+
+func (bank *TransformBank) Plot() string {
+	return bank.currentTransform().Plot()
+}
+
+// Program() returns the Transform for program-number n.
+// Returns non-nil error if n is out of range.
+//
+func (bank *TransformBank) Program(n byte) (Transform, error) {
+	var err error
+	if int(n) >= len(bank.programs) {
+		msg := "TransformBank program out of bounds: %d"
+		err = fmt.Errorf(msg, n)
+		return nil, err
+	}
+	return bank.programs[n], err
+}
+
+// SelectProgram() sets the current program-number.
+// Returns non-nil error if n is out of range.
+//
+func (bank *TransformBank) SelectProgram(n byte) error {
+	_, err := bank.Program(n)
+	if err == nil {
+		bank.current = n
+	}
+	return err
+}
+
 
 func (bank *TransformBank) ChannelMode() ChannelMode {
 	return SingleChannel
@@ -190,6 +222,7 @@ func (bank *TransformBank) EnableChannel(c MIDIChannel, _ bool) error {
 	if ci < 0 || ci > 15 {
 		msg := "Illegal MIDI channel: %d"
 		err = fmt.Errorf(msg, byte(c))
+		return err
 	}
 	bank.channelIndex = ci
 	return err
@@ -243,7 +276,7 @@ func (bank *TransformBank) CurrentProgram() byte {
 func (bank *TransformBank) ChangeProgram(msg gomidi.Message) {
 	st := StatusByte(msg.Data[0])
 	ci := MIDIChannelNibble(st & 0x0F)
-	if st == PROGRAM && ci == bank.channelIndex {
+	if st & 0xF0 == PROGRAM && ci == bank.channelIndex {
 		n := byte(msg.Data[1])
 		if 0 <= n && n < byte(len(bank.programs)) {
 			bank.current = n
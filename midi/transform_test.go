@@ -0,0 +1,40 @@
+package midi
+
+import (
+	"testing"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+func TestTransformBankProgramChange(t *testing.T) {
+	bank := NewTransformBank(4)
+	if err := bank.SelectChannel(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := bank.SelectChannel(17); err == nil {
+		t.Fatal("Expected error for channel 17")
+	}
+	if !bank.ChannelIndexSelected(9) {
+		t.Fatal("Invalid channel changed bank channel")
+	}
+	xform, _ := bank.Program(2)
+	xform.SetValue(60, 72)
+
+	bank.ChangeProgram(gomidi.NewMessage([]byte{0xC0, 2}))
+	if bank.CurrentProgram() != 0 {
+		t.Fatalf("Program change on wrong channel selected program %d", bank.CurrentProgram())
+	}
+	bank.ChangeProgram(gomidi.NewMessage([]byte{0xC9, 2}))
+	if v, _ := bank.Value(60); bank.CurrentProgram() != 2 || v != 72 {
+		t.Fatalf("Expected program 2 value 72, got program %d value %d", bank.CurrentProgram(), v)
+	}
+	bank.ChangeProgram(gomidi.NewMessage([]byte{0xC9, 4}))
+	if bank.CurrentProgram() != 2 {
+		t.Fatalf("Out of range program change selected program %d", bank.CurrentProgram())
+	}
+	if err := bank.SelectProgram(4); err == nil {
+		t.Fatal("Expected error for program 4")
+	}
+	if _, err := bank.Program(4); err == nil {
+		t.Fatal("Expected error for program 4")
+	}
+}
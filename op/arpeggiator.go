@@ -0,0 +1,749 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+const (
+	ARP_DEFAULT_RATE = "1/16"
+	ARP_DEFAULT_GATE = 0.5
+	ARP_DEFAULT_TEMPO = 120.0
+	ARP_MAX_OCTAVES = 4
+	ARP_SYNC_INTERNAL = "internal"
+	ARP_SYNC_CLOCK = "clock"
+)
+
+// ArpPatterns lists the Arpeggiator pattern names.
+//
+var ArpPatterns = []string{"up", "down", "up-down", "random", "as-played", "chord"}
+
+type arpNote struct {
+	ci byte
+	key byte
+	velocity byte
+}
+
+// Arpeggiator is an Operator which plays the currently held notes as a
+// repeating pattern.  Incoming note messages are consumed, all other
+// messages are passed unchanged.
+//
+// Steps are timed either by an internal tempo, using the shared scheduler,
+// or by counting incoming MIDI clocks.  In clock sync START restarts the
+// pattern and STOP releases the sounding notes.
+//
+// With latch enabled released notes continue to play until a new note is
+// pressed while no keys are down.
+//
+type Arpeggiator struct {
+	baseOperator
+	lock sync.Mutex
+	pattern string
+	rateName string
+	rate int          // MIDI clocks per step
+	gate float64      // fraction of step
+	octaves int
+	latch bool
+	tempo float64
+	clockSync bool
+	held []arpNote            // pattern notes in the order played
+	keysDown midi.NoteQueue   // physically held keys
+	downCount int
+	sounding midi.NoteQueue   // notes on at output
+	current []arpNote         // notes of the current step
+	stepIndex int
+	stepCount uint64
+	running bool              // internal sync only
+	generation uint64         // invalidates scheduled events
+	nextStep time.Time
+	clockCount int
+	stepClock int
+}
+
+func newArpeggiator(name string) *Arpeggiator {
+	op := new(Arpeggiator)
+	initOperator(&op.baseOperator, "Arpeggiator", name, midi.NoChannel)
+	op.keysDown = *midi.MakeNoteQueue()
+	op.sounding = *midi.MakeNoteQueue()
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() releases all notes and restores default settings.
+//
+func (op *Arpeggiator) Reset() {
+	op.lock.Lock()
+	op.stop()
+	op.clearHeld()
+	op.pattern = ArpPatterns[0]
+	op.rateName = ARP_DEFAULT_RATE
+	op.rate, _ = parseNoteValue(ARP_DEFAULT_RATE)
+	op.gate = ARP_DEFAULT_GATE
+	op.octaves = 1
+	op.latch = false
+	op.tempo = ARP_DEFAULT_TEMPO
+	op.clockSync = false
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+func (op *Arpeggiator) Panic() {
+	op.lock.Lock()
+	op.stop()
+	op.clearHeld()
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Panic()
+}
+
+func (op *Arpeggiator) Close() {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.stop()
+}
+
+// op.clearHeld() forgets all input notes.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) clearHeld() {
+	op.held = op.held[:0]
+	op.keysDown.Reset()
+	op.downCount = 0
+}
+
+// op.sequence() returns the pattern steps for the held notes.
+// Each step is a list of notes, single notes except for the chord pattern.
+// For the random pattern the steps are in ascending order.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) sequence() [][]arpNote {
+	notes := append([]arpNote(nil), op.held...)
+	if op.pattern != "as-played" {
+		sort.SliceStable(notes, func(i, j int) bool {
+			return notes[i].key < notes[j].key
+		})
+	}
+	octave := func(o int) []arpNote {
+		acc := make([]arpNote, 0, len(notes))
+		for _, n := range notes {
+			if key := int(n.key) + 12 * o; key < 128 {
+				acc = append(acc, arpNote{n.ci, byte(key), n.velocity})
+			}
+		}
+		return acc
+	}
+	acc := make([][]arpNote, 0, len(notes) * op.octaves)
+	if op.pattern == "chord" {
+		for o := 0; o < op.octaves; o++ {
+			if chord := octave(o); len(chord) > 0 {
+				acc = append(acc, chord)
+			}
+		}
+		return acc
+	}
+	for o := 0; o < op.octaves; o++ {
+		for _, n := range octave(o) {
+			acc = append(acc, []arpNote{n})
+		}
+	}
+	switch op.pattern {
+	case "down":
+		for i, j := 0, len(acc) - 1; i < j; i, j = i + 1, j - 1 {
+			acc[i], acc[j] = acc[j], acc[i]
+		}
+	case "up-down":
+		for i := len(acc) - 2; i > 0; i-- {
+			acc = append(acc, acc[i])
+		}
+	}
+	return acc
+}
+
+// op.release() sends note-off for the current step.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) release() {
+	for _, n := range op.current {
+		off := gomidi.NewMessage([]byte{0x80 | n.ci, n.key, 0})
+		op.sounding.Update(off)
+		op.distribute(off)
+	}
+	op.current = nil
+}
+
+// op.step() releases the previous step and plays the next.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) step() {
+	op.release()
+	steps := op.sequence()
+	if len(steps) == 0 {
+		return
+	}
+	index := op.stepIndex % len(steps)
+	if op.pattern == "random" {
+		index = rand.Intn(len(steps))
+	}
+	op.stepIndex = index + 1
+	op.stepCount++
+	op.current = steps[index]
+	for _, n := range op.current {
+		on := gomidi.NewMessage([]byte{0x90 | n.ci, n.key, n.velocity})
+		op.sounding.Update(on)
+		op.distribute(on)
+	}
+}
+
+// op.start() begins internally timed playback.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) start() {
+	if op.running || op.clockSync {
+		return
+	}
+	op.running = true
+	op.nextStep = time.Now()
+	op.scheduleStep(op.generation)
+}
+
+// op.stop() halts playback, cancels scheduled events and releases the
+// current step.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) stop() {
+	op.running = false
+	op.generation++
+	sharedScheduler.cancel(op)
+	op.release()
+	for _, off := range op.sounding.OffEvents() {
+		op.distribute(off)
+	}
+	op.sounding.Reset()
+	op.stepIndex = 0
+}
+
+// op.scheduleStep() schedules the next internally timed step and its
+// note-off.  Step times are calculated from the previous step time, not
+// the time the event actually ran, so timing errors do not accumulate.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) scheduleStep(generation uint64) {
+	when := op.nextStep
+	sharedScheduler.schedule(when, op, func() {
+		op.lock.Lock()
+		defer op.lock.Unlock()
+		if generation != op.generation {
+			return
+		}
+		op.step()
+		duration := clockDuration(op.rate, op.tempo)
+		if op.gate < 1 {
+			count := op.stepCount
+			offTime := when.Add(time.Duration(float64(duration) * op.gate))
+			sharedScheduler.schedule(offTime, op, func() {
+				op.lock.Lock()
+				defer op.lock.Unlock()
+				if generation == op.generation && count == op.stepCount {
+					op.release()
+				}
+			})
+		}
+		op.nextStep = when.Add(duration)
+		op.scheduleStep(generation)
+	})
+}
+
+// op.receiveClock() advances clock synced playback by one MIDI clock.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) receiveClock() {
+	c := op.clockCount
+	op.clockCount++
+	gateClocks := int(math.Max(1, math.Round(op.gate * float64(op.rate))))
+	if len(op.current) > 0 && op.gate < 1 && c - op.stepClock >= gateClocks {
+		op.release()
+	}
+	if c % op.rate == 0 && len(op.held) > 0 {
+		op.step()
+		op.stepClock = c
+	}
+}
+
+// op.receiveTransport() responds to START and STOP while clock synced.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) receiveTransport(st midi.StatusByte) {
+	switch st {
+	case midi.START:
+		op.release()
+		op.clockCount = 0
+		op.stepIndex = 0
+	case midi.STOP:
+		op.release()
+	default:
+	}
+}
+
+// op.noteOn() adds a note to the pattern.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) noteOn(msg gomidi.Message) {
+	note := arpNote{msg.Data[0] & 0x0F, msg.Data[1], msg.Data[2]}
+	if op.latch && op.downCount == 0 {
+		op.held = op.held[:0]
+	}
+	op.keysDown.Update(msg)
+	op.downCount++
+	for i, n := range op.held {
+		if n.ci == note.ci && n.key == note.key {
+			op.held[i].velocity = note.velocity
+			op.start()
+			return
+		}
+	}
+	op.held = append(op.held, note)
+	op.start()
+}
+
+// op.noteOff() removes a note from the pattern, unless latched.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) noteOff(msg gomidi.Message) {
+	ci, key := msg.Data[0] & 0x0F, msg.Data[1]
+	if op.keysDown.OpenCount(ci, key) == 0 {
+		return
+	}
+	op.keysDown.Update(msg)
+	op.downCount--
+	if op.latch || op.keysDown.OpenCount(ci, key) > 0 {
+		return
+	}
+	op.removeHeld(ci, key)
+}
+
+// op.removeHeld() removes a note from the pattern and stops playback if no
+// notes remain.
+// The lock must be held by the caller.
+//
+func (op *Arpeggiator) removeHeld(ci byte, key byte) {
+	for i, n := range op.held {
+		if n.ci == ci && n.key == key {
+			op.held = append(op.held[:i], op.held[i+1:]...)
+			break
+		}
+	}
+	if len(op.held) == 0 {
+		op.stop()
+	}
+}
+
+// op.Send() plays note messages through the arpeggio pattern.
+// In clock sync, CLOCK, START and STOP drive the pattern and are then
+// re-transmitted like all other messages, so child operators following
+// the same clock remain in step with their transport.
+//
+func (op *Arpeggiator) Send(msg gomidi.Message) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	st := midi.StatusByte(msg.Data[0])
+	switch {
+	case midi.IsNoteOn(msg):
+		op.noteOn(msg)
+		return
+	case midi.IsNoteOff(msg):
+		op.noteOff(msg)
+		return
+	case st == midi.CLOCK && op.clockSync:
+		op.receiveClock()
+	case (st == midi.START || st == midi.STOP) && op.clockSync:
+		op.receiveTransport(st)
+	}
+	// Clock and transport pass through, see above.
+	op.distribute(msg)
+}
+
+// op.SetPattern() selects the arpeggio pattern, see ArpPatterns.
+//
+func (op *Arpeggiator) SetPattern(pattern string) error {
+	var err error
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	for _, p := range ArpPatterns {
+		if p == pattern {
+			op.lock.Lock()
+			op.pattern = pattern
+			op.lock.Unlock()
+			return err
+		}
+	}
+	errmsg := "Unknown arpeggio pattern '%s', expected one of: %s"
+	err = fmt.Errorf(errmsg, pattern, strings.Join(ArpPatterns, ", "))
+	return err
+}
+
+func (op *Arpeggiator) Pattern() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.pattern
+}
+
+// op.SetRate() sets the step length as a note value, such as 1/16 or 1/8t.
+//
+func (op *Arpeggiator) SetRate(value string) error {
+	clocks, err := parseNoteValue(value)
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.rate = clocks
+	op.rateName = strings.ToLower(strings.TrimSpace(value))
+	return err
+}
+
+func (op *Arpeggiator) Rate() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.rateName
+}
+
+// op.SetGate() sets note length as a fraction of the step, 0 < gate <= 1.
+//
+func (op *Arpeggiator) SetGate(gate float64) error {
+	var err error
+	if gate <= 0 || 1 < gate {
+		errmsg := "Expected gate 0 < gate <= 1, got %f"
+		err = fmt.Errorf(errmsg, gate)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.gate = gate
+	return err
+}
+
+func (op *Arpeggiator) Gate() float64 {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.gate
+}
+
+// op.SetOctaves() sets number of octaves the pattern spans, 1..ARP_MAX_OCTAVES.
+//
+func (op *Arpeggiator) SetOctaves(n int) error {
+	var err error
+	if n < 1 || ARP_MAX_OCTAVES < n {
+		errmsg := "Expected octave range between 1 and %d, got %d"
+		err = fmt.Errorf(errmsg, ARP_MAX_OCTAVES, n)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.octaves = n
+	return err
+}
+
+func (op *Arpeggiator) Octaves() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.octaves
+}
+
+// op.EnableLatch() sets latch mode.
+// Disabling latch removes notes which are no longer held.
+//
+func (op *Arpeggiator) EnableLatch(flag bool) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.latch = flag
+	if flag {
+		return
+	}
+	for _, n := range append([]arpNote(nil), op.held...) {
+		if op.keysDown.OpenCount(n.ci, n.key) == 0 {
+			op.removeHeld(n.ci, n.key)
+		}
+	}
+}
+
+func (op *Arpeggiator) LatchEnabled() bool {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.latch
+}
+
+// op.SetTempo() sets the internal tempo in BPM.
+//
+func (op *Arpeggiator) SetTempo(tempo float64) error {
+	err := validateTempo(tempo)
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.tempo = tempo
+	return err
+}
+
+func (op *Arpeggiator) Tempo() float64 {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.tempo
+}
+
+// op.SetSync() selects step timing, ARP_SYNC_INTERNAL or ARP_SYNC_CLOCK.
+//
+func (op *Arpeggiator) SetSync(mode string) error {
+	var err error
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode != ARP_SYNC_INTERNAL && mode != ARP_SYNC_CLOCK {
+		errmsg := "Expected sync '%s' or '%s', got '%s'"
+		err = fmt.Errorf(errmsg, ARP_SYNC_INTERNAL, ARP_SYNC_CLOCK, mode)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.stop()
+	op.clockSync = mode == ARP_SYNC_CLOCK
+	op.clockCount = 0
+	if len(op.held) > 0 {
+		op.start()
+	}
+	return err
+}
+
+func (op *Arpeggiator) Sync() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if op.clockSync {
+		return ARP_SYNC_CLOCK
+	}
+	return ARP_SYNC_INTERNAL
+}
+
+func (op *Arpeggiator) Info() string {
+	s := op.commonInfo()
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	mode := ARP_SYNC_INTERNAL
+	if op.clockSync {
+		mode = ARP_SYNC_CLOCK
+	}
+	s += fmt.Sprintf("\tpattern: %s  octaves: %d  latch: %v\n", op.pattern, op.octaves, op.latch)
+	s += fmt.Sprintf("\trate: %s  gate: %.2f\n", op.rateName, op.gate)
+	s += fmt.Sprintf("\tsync: %s  tempo: %.1f\n", mode, op.tempo)
+	s += "\tnotes: "
+	if len(op.held) == 0 {
+		s += "<none>\n"
+	} else {
+		for _, n := range op.held {
+			s += fmt.Sprintf("%d/%d ", n.ci + 1, n.key)
+		}
+		s += "\n"
+	}
+	return s
+}
+
+
+func (op *Arpeggiator) initLocalHandlers() {
+
+	// op name, set-pattern, pattern
+	//
+	remoteSetPattern := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetPattern(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-pattern
+	//
+	remoteQueryPattern := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.Pattern()}, err
+	}
+
+	// op name, q-patterns
+	//
+	remoteQueryPatterns := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return ArpPatterns, err
+	}
+
+	// op name, set-rate, note-value
+	//
+	remoteSetRate := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetRate(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-rate
+	//
+	remoteQueryRate := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.Rate()}, err
+	}
+
+	// op name, set-gate, fraction
+	//
+	remoteSetGate := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetGate(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-gate
+	//
+	remoteQueryGate := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%.3f", op.Gate())}, err
+	}
+
+	// op name, set-octaves, n
+	//
+	remoteSetOctaves := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetOctaves(int(args[2].I))
+		return empty, err
+	}
+
+	// op name, q-octaves
+	//
+	remoteQueryOctaves := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.Octaves())}, err
+	}
+
+	// op name, enable-latch, bool
+	//
+	remoteEnableLatch := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osb", msg)
+		if err != nil {
+			return empty, err
+		}
+		op.EnableLatch(args[2].B)
+		return empty, err
+	}
+
+	// op name, q-latch-enabled
+	//
+	remoteQueryLatch := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%v", op.LatchEnabled())}, err
+	}
+
+	// op name, set-tempo, bpm
+	//
+	remoteSetTempo := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetTempo(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-tempo
+	//
+	remoteQueryTempo := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%.3f", op.Tempo())}, err
+	}
+
+	// op name, set-sync, internal|clock
+	//
+	remoteSetSync := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetSync(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-sync
+	//
+	remoteQuerySync := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.Sync()}, err
+	}
+
+	op.addCommandHandler("set-pattern", remoteSetPattern)
+	op.addCommandHandler("q-pattern", remoteQueryPattern)
+	op.addCommandHandler("q-patterns", remoteQueryPatterns)
+	op.addCommandHandler("set-rate", remoteSetRate)
+	op.addCommandHandler("q-rate", remoteQueryRate)
+	op.addCommandHandler("set-gate", remoteSetGate)
+	op.addCommandHandler("q-gate", remoteQueryGate)
+	op.addCommandHandler("set-octaves", remoteSetOctaves)
+	op.addCommandHandler("q-octaves", remoteQueryOctaves)
+	op.addCommandHandler("enable-latch", remoteEnableLatch)
+	op.addCommandHandler("q-latch-enabled", remoteQueryLatch)
+	op.addCommandHandler("set-tempo", remoteSetTempo)
+	op.addCommandHandler("q-tempo", remoteQueryTempo)
+	op.addCommandHandler("set-sync", remoteSetSync)
+	op.addCommandHandler("q-sync", remoteQuerySync)
+}
+
+
+type arpeggiatorSession struct {
+	Pattern string    `json:"pattern"`
+	Rate string       `json:"rate"`
+	Gate float64      `json:"gate"`
+	Octaves int       `json:"octaves"`
+	Latch bool        `json:"latch"`
+	Tempo float64     `json:"tempo"`
+	Sync string       `json:"sync"`
+}
+
+func (op *Arpeggiator) sessionState() interface{} {
+	return &arpeggiatorSession{op.Pattern(), op.Rate(), op.Gate(), op.Octaves(),
+		op.LatchEnabled(), op.Tempo(), op.Sync()}
+}
+
+func (op *Arpeggiator) restoreSessionState(data json.RawMessage) error {
+	var state arpeggiatorSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	if err = op.SetPattern(state.Pattern); err != nil {
+		return err
+	}
+	if err = op.SetRate(state.Rate); err != nil {
+		return err
+	}
+	if err = op.SetGate(state.Gate); err != nil {
+		return err
+	}
+	if err = op.SetOctaves(state.Octaves); err != nil {
+		return err
+	}
+	if err = op.SetTempo(state.Tempo); err != nil {
+		return err
+	}
+	op.EnableLatch(state.Latch)
+	return op.SetSync(state.Sync)
+}
@@ -0,0 +1,204 @@
+package op
+
+import (
+	"sync"
+	"testing"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+func TestParseNoteValue(t *testing.T) {
+	expect := map[string]int{"1/4": 24, "1/8": 12, "1/16": 6, "1/8t": 8, "1/16.": 9, "3/4": 72, "1/1": 96}
+	for value, clocks := range expect {
+		if n, err := parseNoteValue(value); err != nil || n != clocks {
+			t.Fatalf("parseNoteValue(%q) expected %d, got %d %v", value, clocks, n, err)
+		}
+	}
+	for _, value := range []string{"", "1/", "x/4", "1/0", "1/64"} {
+		if _, err := parseNoteValue(value); err == nil {
+			t.Fatalf("parseNoteValue(%q) expected error", value)
+		}
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newScheduler()
+	var lock sync.Mutex
+	var order []int
+	done := make(chan bool)
+	now := time.Now()
+	record := func(n int) func() {
+		return func() {
+			lock.Lock()
+			defer lock.Unlock()
+			order = append(order, n)
+			if len(order) == 4 {
+				close(done)
+			}
+		}
+	}
+	owner, other := new(int), new(int)
+	s.schedule(now.Add(20 * time.Millisecond), owner, record(3))
+	s.schedule(now.Add(5 * time.Millisecond), owner, record(1))
+	s.schedule(now.Add(5 * time.Millisecond), owner, record(2))
+	s.schedule(now.Add(10 * time.Millisecond), other, record(-1))
+	s.schedule(now.Add(25 * time.Millisecond), owner, record(4))
+	s.cancel(other)
+	if s.pending(other) != 0 || s.pending(owner) != 4 {
+		t.Fatalf("Expected 4 pending events, got %d", s.pending(owner))
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Scheduled events did not run")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for i, n := range order {
+		if n != i + 1 {
+			t.Fatalf("Events out of order: %v", order)
+		}
+	}
+}
+
+// noteMessages() returns received messages other than MIDI clock.
+//
+func noteMessages(op *collectingOperator) [][]byte {
+	acc := make([][]byte, 0)
+	for _, data := range op.take() {
+		if data[0] != 0xF8 {
+			acc = append(acc, data)
+		}
+	}
+	return acc
+}
+
+func expectNotes(t *testing.T, op *collectingOperator, expect ...[]byte) {
+	t.Helper()
+	got := noteMessages(op)
+	if len(got) != len(expect) {
+		t.Fatalf("%s: expected %v, got %v", op.Name(), expect, got)
+	}
+	for i := range got {
+		if string(got[i]) != string(expect[i]) {
+			t.Fatalf("%s: expected %v, got %v", op.Name(), expect, got)
+		}
+	}
+}
+
+func TestArpeggiatorClockSync(t *testing.T) {
+	arp := newArpeggiator("arp")
+	defer arp.Close()
+	out := newCollectingOperator("out")
+	arp.Connect(out)
+	arp.SetSync(ARP_SYNC_CLOCK)
+	arp.SetRate("1/8")
+	arp.SetOctaves(2)
+	arp.SetPattern("up-down")
+	clocks := func(n int) {
+		for i := 0; i < n; i++ {
+			arp.Send(gomidi.NewMessage([]byte{0xF8}))
+		}
+	}
+	arp.Send(gomidi.NewMessage([]byte{0x90, 64, 100}))
+	arp.Send(gomidi.NewMessage([]byte{0x90, 60, 90}))
+	expectMessages(t, out)
+
+	// Steps every 12 clocks, gate 6 clocks.  Clocks are passed.
+	clocks(1)
+	expectMessages(t, out, []byte{0x90, 60, 90}, []byte{0xF8})
+	clocks(6)
+	expectNotes(t, out, []byte{0x80, 60, 0})
+	clocks(6)
+	expectNotes(t, out, []byte{0x90, 64, 100})
+
+	// up-down over 2 octaves: 60 64 72 76 72 64 60 ...
+	arp.Send(gomidi.NewMessage([]byte{0xFA}))
+	expectNotes(t, out, []byte{0x80, 64, 0}, []byte{0xFA})
+	var keys []byte
+	for i := 0; i < 7; i++ {
+		clocks(12)
+		for _, data := range noteMessages(out) {
+			if data[0] == 0x90 {
+				keys = append(keys, data[1])
+			}
+		}
+	}
+	if string(keys) != string([]byte{60, 64, 72, 76, 72, 64, 60}) {
+		t.Fatalf("Unexpected up-down sequence %v", keys)
+	}
+
+	// STOP releases the sounding note, START restarts the pattern.
+	// Both are passed.
+	clocks(1)
+	expectNotes(t, out, []byte{0x90, 64, 100})
+	arp.Send(gomidi.NewMessage([]byte{0xFC}))
+	expectNotes(t, out, []byte{0x80, 64, 0}, []byte{0xFC})
+	arp.Send(gomidi.NewMessage([]byte{0xFA}))
+	expectNotes(t, out, []byte{0xFA})
+
+	// Releasing all keys turns off the sounding note.
+	clocks(1)
+	arp.Send(gomidi.NewMessage([]byte{0x80, 60, 0}))
+	arp.Send(gomidi.NewMessage([]byte{0x90, 64, 0}))
+	expectNotes(t, out, []byte{0x90, 60, 90}, []byte{0x80, 60, 0})
+	clocks(24)
+	expectNotes(t, out)
+}
+
+func TestArpeggiatorLatch(t *testing.T) {
+	arp := newArpeggiator("arp")
+	defer arp.Close()
+	out := newCollectingOperator("out")
+	arp.Connect(out)
+	arp.SetSync(ARP_SYNC_CLOCK)
+	arp.SetPattern("chord")
+	arp.EnableLatch(true)
+	arp.Send(gomidi.NewMessage([]byte{0x92, 60, 100}))
+	arp.Send(gomidi.NewMessage([]byte{0x92, 67, 100}))
+	arp.Send(gomidi.NewMessage([]byte{0x82, 60, 0}))
+	arp.Send(gomidi.NewMessage([]byte{0x82, 67, 0}))
+	arp.Send(gomidi.NewMessage([]byte{0xF8}))
+	expectNotes(t, out, []byte{0x92, 60, 100}, []byte{0x92, 67, 100})
+
+	// New note replaces latched notes.
+	arp.Send(gomidi.NewMessage([]byte{0x92, 62, 80}))
+	arp.Send(gomidi.NewMessage([]byte{0x82, 62, 0}))
+	for i := 0; i < 6; i++ {
+		arp.Send(gomidi.NewMessage([]byte{0xF8}))
+	}
+	expectNotes(t, out, []byte{0x82, 60, 0}, []byte{0x82, 67, 0}, []byte{0x92, 62, 80})
+	arp.EnableLatch(false)
+	expectNotes(t, out, []byte{0x82, 62, 0})
+}
+
+func TestArpeggiatorInternal(t *testing.T) {
+	arp := newArpeggiator("arp")
+	defer arp.Close()
+	out := newCollectingOperator("out")
+	arp.Connect(out)
+	arp.SetTempo(300)
+	arp.SetRate("1/32")
+	arp.Send(gomidi.NewMessage([]byte{0x90, 60, 100}))
+	arp.Send(gomidi.NewMessage([]byte{0x90, 62, 100}))
+	time.Sleep(100 * time.Millisecond)
+	arp.Send(gomidi.NewMessage([]byte{0x80, 60, 0}))
+	arp.Send(gomidi.NewMessage([]byte{0x80, 62, 0}))
+	time.Sleep(20 * time.Millisecond)
+	got := out.take()
+	if len(got) < 4 {
+		t.Fatalf("Expected several arpeggio notes, got %v", got)
+	}
+	open := 0
+	for _, data := range got {
+		switch data[0] {
+		case 0x90:
+			open++
+		case 0x80:
+			open--
+		}
+	}
+	if open != 0 || sharedScheduler.pending(arp) != 0 {
+		t.Fatalf("Arpeggio left %d notes and %d events pending", open, sharedScheduler.pending(arp))
+	}
+}
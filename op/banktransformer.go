@@ -0,0 +1,419 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+const BANK_TRANSFORMER_PROGRAMS = 16
+
+// BankTransformer is a Transformer with several transformation tables.
+// The tables are held in a midi.TransformBank, a PROGRAM message on the
+// bank's channel selects the current table.  Program numbers outside the
+// bank are ignored.
+//
+// The bank channel is selected with the usual channel commands.
+//
+type BankTransformer struct {
+	baseOperator
+	lock sync.Mutex
+	bank *midi.TransformBank
+	status midi.StatusByte
+	dataNumber midi.DataNumber
+	passProgramChange bool
+}
+
+func newBankTransformer(name string) *BankTransformer {
+	op := new(BankTransformer)
+	initOperator(&op.baseOperator, "BankTransformer", name, midi.SingleChannel)
+	op.bank = midi.NewTransformBank(BANK_TRANSFORMER_PROGRAMS)
+	op.channelSelector = op.bank
+	initStatusHandlers(&op.baseOperator, op)
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() restores all programs to identity and selects program 0.
+//
+func (op *BankTransformer) Reset() {
+	op.lock.Lock()
+	for p := byte(0); p < BANK_TRANSFORMER_PROGRAMS; p++ {
+		xform, _ := op.bank.Program(p)
+		xform.Reset()
+	}
+	op.bank.SelectProgram(0)
+	op.status = midi.KEYED_STATUS
+	op.dataNumber = midi.DATA_1
+	op.passProgramChange = true
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+func (op *BankTransformer) Info() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	s := op.commonInfo()
+	s += fmt.Sprintf("\tStatus    : 0x%02X  %s\n", byte(op.status), op.status)
+	s += fmt.Sprintf("\tData byte : %s\n", op.dataNumber)
+	s += fmt.Sprintf("\tProgram   : %d of %d\n", op.bank.CurrentProgram(), BANK_TRANSFORMER_PROGRAMS)
+	s += fmt.Sprintf("\tPass program change: %v\n", op.passProgramChange)
+	s += fmt.Sprintf("%s\n", op.bank.Dump())
+	return s
+}
+
+func (op *BankTransformer) Send(msg gomidi.Message) {
+	st := midi.StatusByte(msg.Data[0])
+	if st & 0xF0 == midi.PROGRAM {
+		op.lock.Lock()
+		selected := op.ChannelIndexSelected(midi.MIDIChannelNibble(st & 0x0F))
+		op.bank.ChangeProgram(msg)
+		pass := op.passProgramChange
+		op.lock.Unlock()
+		if selected && !pass {
+			return
+		}
+	}
+	data := append([]byte(nil), msg.Data...)
+	op.lock.Lock()
+	transformData(data, op.status, op.dataNumber, op.bank)
+	op.lock.Unlock()
+	op.distribute(gomidi.NewMessage(data))
+}
+
+// op.SetStatus() selects the status of messages to transform.
+// Returns non-nil error if st is not a valid selection, see
+// validateTransformStatus(), or if the selected data byte does not exist
+// for st.
+//
+func (op *BankTransformer) SetStatus(st midi.StatusByte) error {
+	err := validateTransformStatus(int64(st))
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if err = validateStatusDataByte(st, op.dataNumber); err != nil {
+		return err
+	}
+	op.status = st
+	return err
+}
+
+func (op *BankTransformer) Status() midi.StatusByte {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.status
+}
+
+// op.SelectDataByte() selects the data byte to transform.
+// Returns non-nil error if n is not DATA_1 or DATA_2, or if data byte n
+// does not exist for the selected status.
+//
+func (op *BankTransformer) SelectDataByte(n midi.DataNumber) error {
+	err := validateDataNumber(n)
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if err = validateStatusDataByte(op.status, n); err != nil {
+		return err
+	}
+	op.dataNumber = n
+	return err
+}
+
+func (op *BankTransformer) DataByte() midi.DataNumber {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.dataNumber
+}
+
+// op.EnableProgramChange() sets whether PROGRAM messages on the bank
+// channel are re-transmitted.
+//
+func (op *BankTransformer) EnableProgramChange(flag bool) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.passProgramChange = flag
+}
+
+func (op *BankTransformer) ProgramChangeEnabled() bool {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.passProgramChange
+}
+
+// op.CurrentProgram() returns the selected program number.
+//
+func (op *BankTransformer) CurrentProgram() byte {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.bank.CurrentProgram()
+}
+
+// op.SelectProgram() sets the current program.
+// Returns non-nil error if program is out of range.
+//
+func (op *BankTransformer) SelectProgram(program byte) error {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.bank.SelectProgram(program)
+}
+
+// op.ProgramValue() returns table value of any program.
+//
+func (op *BankTransformer) ProgramValue(program byte, index byte) (byte, error) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	xform, err := op.bank.Program(program)
+	if err != nil {
+		return 0, err
+	}
+	return xform.Value(index)
+}
+
+// op.SetProgramValue() sets table value of any program.
+// Returns non-nil error if program, index or value are out of range.
+//
+func (op *BankTransformer) SetProgramValue(program byte, index byte, value byte) error {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	xform, err := op.bank.Program(program)
+	if err != nil {
+		return err
+	}
+	return xform.SetValue(index, value)
+}
+
+// op.ResetProgram() sets program table to identity.
+//
+func (op *BankTransformer) ResetProgram(program byte) error {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	xform, err := op.bank.Program(program)
+	if err == nil {
+		xform.Reset()
+	}
+	return err
+}
+
+
+func (op *BankTransformer) initLocalHandlers() {
+
+	// op name, q-program-range
+	// Returns [floor, ceiling] of valid program numbers.
+	//
+	remoteQueryProgramRange := func(msg *goosc.Message)([]string, error) {
+		var err error
+		f, c := op.bank.ProgramRange()
+		return []string{fmt.Sprintf("%d", f), fmt.Sprintf("%d", c)}, err
+	}
+
+	// op name, q-program
+	//
+	remoteQueryProgram := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.CurrentProgram())}, err
+	}
+
+	// op name, select-program, program
+	//
+	remoteSelectProgram := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		program, err := programNumber(args[2].I)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SelectProgram(program)
+		return empty, err
+	}
+
+	// op name, q-table-value, program, index
+	//
+	remoteQueryValue := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osii", msg)
+		if err != nil {
+			return empty, err
+		}
+		program, err := programNumber(args[2].I)
+		if err != nil {
+			return empty, err
+		}
+		value, err := op.ProgramValue(program, byte(args[3].I))
+		return []string{fmt.Sprintf("0x%02X", value)}, err
+	}
+
+	// op name, set-table-value, program, index, value [, values ...]
+	//
+	remoteSetValue := func(msg *goosc.Message)([]string, error) {
+		template := "osiii"
+		for i := 5; i < len(msg.Arguments); i++ {
+			template += "i"
+		}
+		args, err := ExpectMsg(template, msg)
+		if err != nil {
+			return empty, err
+		}
+		program, err := programNumber(args[2].I)
+		if err != nil {
+			return empty, err
+		}
+		index := args[3].I
+		for _, arg := range args[4:] {
+			if index > 0x7F || arg.I < 0 || arg.I > 0x7F {
+				errmsg := "Table index and value must be between 0 and 127, got %d %d"
+				err = fmt.Errorf(errmsg, index, arg.I)
+				break
+			}
+			err = op.SetProgramValue(program, byte(index), byte(arg.I))
+			if err != nil {
+				break
+			}
+			index++
+		}
+		return empty, err
+	}
+
+	// op name, reset-program, program
+	//
+	remoteResetProgram := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		program, err := programNumber(args[2].I)
+		if err != nil {
+			return empty, err
+		}
+		err = op.ResetProgram(program)
+		return empty, err
+	}
+
+	// op name, print-table [, program]
+	//
+	remotePrintTable := func(msg *goosc.Message)([]string, error) {
+		var err error
+		program := op.CurrentProgram()
+		if len(msg.Arguments) > 2 {
+			args, err := ExpectMsg("osi", msg)
+			if err != nil {
+				return empty, err
+			}
+			if program, err = programNumber(args[2].I); err != nil {
+				return empty, err
+			}
+		}
+		op.lock.Lock()
+		xform, err := op.bank.Program(program)
+		if err == nil {
+			fmt.Printf("Program %d\n%s\n%s", program, xform.Dump(), xform.Plot())
+		}
+		op.lock.Unlock()
+		return empty, err
+	}
+
+	// op name, pass-program-change, bool
+	// If false PROGRAM messages on the bank channel are not re-transmitted.
+	//
+	remotePassProgramChange := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osb", msg)
+		if err != nil {
+			return empty, err
+		}
+		op.EnableProgramChange(args[2].B)
+		return empty, err
+	}
+
+	op.addCommandHandler("q-program-range", remoteQueryProgramRange)
+	op.addCommandHandler("q-program", remoteQueryProgram)
+	op.addCommandHandler("select-program", remoteSelectProgram)
+	op.addCommandHandler("q-table-value", remoteQueryValue)
+	op.addCommandHandler("set-table-value", remoteSetValue)
+	op.addCommandHandler("reset-program", remoteResetProgram)
+	op.addCommandHandler("print-table", remotePrintTable)
+	op.addCommandHandler("pass-program-change", remotePassProgramChange)
+}
+
+// programNumber() validates a program number argument.
+//
+func programNumber(n int64) (byte, error) {
+	var err error
+	if n < 0 || BANK_TRANSFORMER_PROGRAMS <= n {
+		errmsg := "Expected program number between 0 and %d, got %d"
+		err = fmt.Errorf(errmsg, BANK_TRANSFORMER_PROGRAMS - 1, n)
+		return 0, err
+	}
+	return byte(n), err
+}
+
+
+type bankTransformerSession struct {
+	Status int              `json:"status"`
+	DataByte int            `json:"data-byte"`
+	Program int             `json:"program"`
+	PassProgramChange bool  `json:"pass-program-change"`
+	Programs [][]int        `json:"programs"`
+}
+
+func (op *BankTransformer) sessionState() interface{} {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	state := &bankTransformerSession{
+		Status: int(op.status),
+		DataByte: int(op.dataNumber),
+		Program: int(op.bank.CurrentProgram()),
+		PassProgramChange: op.passProgramChange,
+		Programs: make([][]int, BANK_TRANSFORMER_PROGRAMS)}
+	for p := byte(0); p < BANK_TRANSFORMER_PROGRAMS; p++ {
+		xform, _ := op.bank.Program(p)
+		f, c := xform.TransformRange()
+		table := make([]int, 0, int(c - f))
+		for i := f; i < c; i++ {
+			v, _ := xform.Value(i)
+			table = append(table, int(v))
+		}
+		state.Programs[p] = table
+	}
+	return state
+}
+
+func (op *BankTransformer) restoreSessionState(data json.RawMessage) error {
+	var state bankTransformerSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	st, n := midi.StatusByte(state.Status), midi.DataNumber(state.DataByte)
+	if err = validateTransformStatus(int64(state.Status)); err != nil {
+		return err
+	}
+	if err = validateDataNumber(n); err != nil {
+		return err
+	}
+	if err = validateStatusDataByte(st, n); err != nil {
+		return err
+	}
+	for p, table := range state.Programs {
+		for i, v := range table {
+			err = op.SetProgramValue(byte(p), byte(i), byte(v))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	op.lock.Lock()
+	op.status, op.dataNumber = st, n
+	op.lock.Unlock()
+	op.EnableProgramChange(state.PassProgramChange)
+	return op.SelectProgram(byte(state.Program))
+}
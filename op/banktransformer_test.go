@@ -0,0 +1,88 @@
+package op
+
+import (
+	"encoding/json"
+	"testing"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	"github.com/plewto/pigiron/midi"
+)
+
+func TestBankTransformerChannels(t *testing.T) {
+	op := newBankTransformer("xform")
+	out := newCollectingOperator("out")
+	op.Connect(out)
+	send := func(data ...byte) {
+		op.Send(gomidi.NewMessage(data))
+	}
+	op.SetProgramValue(0, 64, 100)
+	if err := op.SetStatus(midi.CONTROLLER); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.SelectDataByte(midi.DATA_2); err != nil {
+		t.Fatal(err)
+	}
+	send(0xB0, 7, 64)
+	send(0xB3, 7, 64)
+	send(0xBF, 7, 64)
+	send(0x93, 64, 64)
+	expectMessages(t, out,
+		[]byte{0xB0, 7, 100},
+		[]byte{0xB3, 7, 100},
+		[]byte{0xBF, 7, 100},
+		[]byte{0x93, 64, 64})
+
+	op.SetStatus(midi.KEYED_STATUS)
+	op.SelectDataByte(midi.DATA_1)
+	send(0x85, 64, 0)
+	send(0x9A, 64, 64)
+	send(0xB3, 64, 64)
+	expectMessages(t, out,
+		[]byte{0x85, 100, 0},
+		[]byte{0x9A, 100, 64},
+		[]byte{0xB3, 64, 64})
+}
+
+func TestBankTransformerTwoByteStatus(t *testing.T) {
+	op := newBankTransformer("xform")
+	out := newCollectingOperator("out")
+	op.Connect(out)
+	send := func(data ...byte) {
+		op.Send(gomidi.NewMessage(data))
+	}
+	op.SetProgramValue(0, 64, 100)
+	op.SelectDataByte(midi.DATA_2)
+	for _, st := range []midi.StatusByte{midi.PROGRAM, midi.CHANNEL_PRESSURE} {
+		if err := op.SetStatus(st); err == nil {
+			t.Fatalf("Expected error selecting status %s with DATA_2", st)
+		}
+	}
+	if op.Status() != midi.KEYED_STATUS {
+		t.Fatalf("Rejected status changed selection to %s", op.Status())
+	}
+
+	op.SelectDataByte(midi.DATA_1)
+	if err := op.SetStatus(midi.CHANNEL_PRESSURE); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.SelectDataByte(midi.DATA_2); err == nil {
+		t.Fatal("Expected error selecting DATA_2 for CHANNEL_PRESSURE")
+	}
+	send(0xD0, 64)
+	send(0xD6, 64)
+	send(0xC6, 64)
+	expectMessages(t, out, []byte{0xD0, 100}, []byte{0xD6, 100}, []byte{0xC6, 64})
+
+	// A 2-byte message never has DATA_2 transformed, even if selected.
+	data := []byte{0xD0, 64}
+	transformData(data, midi.CHANNEL_PRESSURE, midi.DATA_2, op.bank)
+	if data[1] != 64 {
+		t.Fatalf("Expected DATA_1 unchanged, got %d", data[1])
+	}
+
+	state := op.sessionState().(*bankTransformerSession)
+	state.DataByte = int(midi.DATA_2)
+	data, _ = json.Marshal(state)
+	if err := newBankTransformer("restored").restoreSessionState(data); err == nil {
+		t.Fatal("Expected error restoring CHANNEL_PRESSURE with DATA_2")
+	}
+}
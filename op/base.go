@@ -7,14 +7,28 @@ package op
 */
 
 import (
+	"encoding/json"
 	"fmt"
 	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
 	gomidi "gitlab.com/gomidi/midi/v2"
 	goosc "github.com/hypebeast/go-osc/osc"
 	"github.com/plewto/pigiron/midi"
-	"github.com/plewto/pigiron/config"
 )
 
+/*
+** Connections between operators are held in copy-on-write routing tables.
+** Each change replaces an operator's parent or child map with a new map,
+** existing maps are never modified.  Message delivery reads the current
+** map without locking, so connections may be changed from OSC handlers
+** while MIDI inputs and players are sending.
+**
+** graphLock serializes all changes to the routing tables.
+*/
+var graphLock sync.Mutex
+
 /*
 ** baseOperator struct implements the Operator interface.
 ** All Operator classes should extend baseOperator.
@@ -23,9 +37,11 @@ type baseOperator struct {
 	opType string
 	name string
 	channelSelector midi.ChannelSelector
-	parentMap map[string]Operator
-	childrenMap map[string]Operator
-	midiOutputEnabled bool
+	parentTable atomic.Value   // map[string]Operator
+	childTable atomic.Value    // map[string]Operator
+	midiOutputEnabled int32
+	inbox atomic.Value         // *messageQueue, nil if not queued
+	queueLock sync.Mutex
 	dispatchTable map[string]func(*goosc.Message)([]string, error)
 }
 
@@ -44,9 +60,10 @@ func initOperator(op *baseOperator, opType string, name string, mode midi.Channe
 	default:
 		op.channelSelector = midi.NewNullChannelSelector()
 	}
-	op.parentMap = make(map[string]Operator)
-	op.childrenMap = make(map[string]Operator)
-	op.midiOutputEnabled = true
+	op.parentTable.Store(make(map[string]Operator))
+	op.childTable.Store(make(map[string]Operator))
+	op.SetMIDIOutputEnabled(true)
+	op.inbox.Store((*messageQueue)(nil))
 	op.dispatchTable = make(map[string]func(*goosc.Message)([]string, error))
 	op.addCommandHandler("ping", op.remotePing)
 	op.addCommandHandler("q-commands", op.remoteQueryCommands)
@@ -82,7 +99,7 @@ func (op *baseOperator) commonInfo() string {
 		s += "<none>\n"
 	} else {
 		s += "\n"
-		for name, _ := range op.parentMap {
+		for _, name := range sortedNames(op.parents()) {
 			s += fmt.Sprintf("\t\t%s\n", name)
 		}
 	}
@@ -91,10 +108,16 @@ func (op *baseOperator) commonInfo() string {
 		s += "<none>\n"
 	} else {
 		s += "\n"
-		for name, _ := range op.childrenMap {
+		for _, name := range sortedNames(op.children()) {
 			s += fmt.Sprintf("\t\t%s\n", name)
 		}
 	}
+	s += "\tqueue: "
+	if q := op.queue(); q == nil {
+		s += "<none>\n"
+	} else {
+		s += fmt.Sprintf("%s\n", q)
+	}
 	return s
 }
 
@@ -132,23 +155,37 @@ func (op *baseOperator) Reset() {
 func (op *baseOperator) Close() {}
 
 
+// op.sessionState() returns operator specific state for saving in a session.
+// The result is serialized as JSON, nil indicates there is no additional
+// state.  Name, channel selection, MIDI enable and connections are saved
+// separately for all operators.  Extending operators with additional state
+// should override sessionState and restoreSessionState.
+//
+func (op *baseOperator) sessionState() interface{} {
+	return nil
+}
+
+// op.restoreSessionState() restores state previously returned by sessionState.
+//
+func (op *baseOperator) restoreSessionState(data json.RawMessage) error {
+	return nil
+}
+
+
 // op.IsRoot() returns true iff operator has no inputs.
 //
 func (op *baseOperator) IsRoot() bool {
-	return len(op.parentMap) == 0
+	return len(op.parents()) == 0
 }
 
 // op.IsLeaf() returns true iff operator has no outputs.
 //
 func (op *baseOperator) IsLeaf() bool {
-	return len(op.childrenMap) == 0
+	return len(op.children()) == 0
 }
 
 
 func printTree(op Operator, depth int) {
-	if int64(depth) > config.GlobalParameters.MaxTreeDepth {
-		return
-	}
 	if depth == 0 {
 		fmt.Printf("%s\n", op.Name())
 	} else {
@@ -172,15 +209,49 @@ func (op *baseOperator) PrintTree() {
 
 
 // op.parents() returns list of the operator's parents.
+// The result is shared and must not be modified.
 //
 func (op *baseOperator) parents() map[string]Operator {
-	return op.parentMap
+	return op.parentTable.Load().(map[string]Operator)
 }
 
 // op.children() returns list of the operator's children.
+// The result is shared and must not be modified.
 //
 func (op *baseOperator) children() map[string]Operator {
-	return op.childrenMap
+	return op.childTable.Load().(map[string]Operator)
+}
+
+// updateTable replaces the contents of table with a modified copy.
+// If value is nil the key is removed.
+// graphLock must be held.
+//
+func updateTable(table *atomic.Value, key string, value Operator) {
+	current := table.Load().(map[string]Operator)
+	acc := make(map[string]Operator, len(current) + 1)
+	for k, v := range current {
+		acc[k] = v
+	}
+	if value == nil {
+		delete(acc, key)
+	} else {
+		acc[key] = value
+	}
+	table.Store(acc)
+}
+
+// op.setParent() adds (or with nil removes) a parent entry.
+// graphLock must be held.
+//
+func (op *baseOperator) setParent(name string, parent Operator) {
+	updateTable(&op.parentTable, name, parent)
+}
+
+// op.setChild() adds (or with nil removes) a child entry.
+// graphLock must be held.
+//
+func (op *baseOperator) setChild(name string, child Operator) {
+	updateTable(&op.childTable, name, child)
 }
 
 // op.Parents() returns copy of the operator's parents list.
@@ -210,11 +281,23 @@ func (op *baseOperator) Children() map[string]Operator {
 // Returns the child operator.
 //
 func (op *baseOperator) Disconnect(child Operator) Operator {
-	delete(op.children(), child.Name())
-	delete(child.parents(), op.Name())
+	graphLock.Lock()
+	defer graphLock.Unlock()
+	op.disconnect(child)
 	return child
 }
 
+// op.disconnect() removes child, graphLock must be held.
+//
+func (op *baseOperator) disconnect(child Operator) {
+	if op.IsParentOf(child) {
+		op.setChild(child.Name(), nil)
+	}
+	if child.IsChildOf(op) {
+		child.setParent(op.Name(), nil)
+	}
+}
+
 // op.IsParentOf() returns true iff the operator is a parent of child.
 //
 func (op *baseOperator) IsParentOf(child Operator) bool {
@@ -230,38 +313,57 @@ func (op *baseOperator) IsChildOf(parent Operator) bool {
 }
 
 
-// TODO: Validate
-// op.circularTreeTest() returns true if the operator tree exceeds the maximum tree depth.
-// The maximum tree depth is established during configuration.
-// Trees exceeding this value are assumed to be circular.
+// Routes() returns all routes from operator from to operator to.
+// Each route lists operator names, starting with from and ending with to.
+// If first is true the search stops after the first route is found.
 //
-func (op *baseOperator) circularTreeTest(depth int) bool {
-	if depth > int(config.GlobalParameters.MaxTreeDepth) {
-		return true
-	} else {
-		for _, c := range op.children() {
-			return c.circularTreeTest(depth + 1)
+func Routes(from Operator, to Operator, first bool) [][]string {
+	acc := make([][]string, 0)
+	deadEnds := make(map[string]bool)
+	route := []string{from.Name()}
+	var visit func(op Operator) bool
+	visit = func(op Operator) bool {
+		if op.Name() == to.Name() {
+			acc = append(acc, append([]string{}, route...))
+			return first
+		}
+		if first && deadEnds[op.Name()] {
+			return false
+		}
+		children := op.children()
+		for _, name := range sortedNames(children) {
+			route = append(route, name)
+			found := visit(children[name])
+			route = route[:len(route)-1]
+			if found {
+				return true
+			}
 		}
+		deadEnds[op.Name()] = true
+		return false
 	}
-	return false
+	visit(from)
+	return acc
 }
 
 // op.Connect() connects child as a child of operator.
 // Duplicate connections are silently ignored.
 //
-// Returns non-nil error if the connection causes a circular tree.
+// Returns non-nil error if the connection would create a cycle, the error
+// includes the cycle path.
 //
 func (op *baseOperator) Connect(child Operator) error {
-	op.Disconnect(child)
-	op.children()[child.Name()] = child
-	child.parents()[op.Name()] = op
 	var err error
-	if op.circularTreeTest(0) {
-		fstr := "Maximum tree depth exceeded at %s -> %s, MaxTreeDepth = %d"
-		msg := fmt.Sprintf(fstr, op.Name(), child.Name(), config.GlobalParameters.MaxTreeDepth)
-		err = errors.New(msg)
-		op.Disconnect(child)
+	graphLock.Lock()
+	defer graphLock.Unlock()
+	if routes := Routes(child, op, true); len(routes) > 0 {
+		cycle := append([]string{op.Name()}, routes[0]...)
+		errmsg := "Can not connect %s -> %s, circular connection: %s"
+		err = fmt.Errorf(errmsg, op.Name(), child.Name(), strings.Join(cycle, " -> "))
+		return err
 	}
+	op.setChild(child.Name(), child)
+	child.setParent(op.Name(), op)
 	return err
 }
 
@@ -343,13 +445,71 @@ func (op *baseOperator) SelectAllChannels() {
 // op.MIDIOutputEnabled() returns true if received MIDI messages are re-transmitted.
 //
 func (op *baseOperator) MIDIOutputEnabled() bool {
-	return op.midiOutputEnabled
+	return atomic.LoadInt32(&op.midiOutputEnabled) != 0
 }
 
 // op.SetMIDIOutputEnabled() enable/disable MIDI output.
 //
 func (op *baseOperator) SetMIDIOutputEnabled(flag bool) {
-	op.midiOutputEnabled = flag
+	var value int32
+	if flag {
+		value = 1
+	}
+	atomic.StoreInt32(&op.midiOutputEnabled, value)
+}
+
+// op.queue() returns the operator's message queue, or nil if messages are
+// sent directly.
+//
+func (op *baseOperator) queue() *messageQueue {
+	return op.inbox.Load().(*messageQueue)
+}
+
+// op.SetQueue() places a message queue in front of the operator.
+// Messages from parents are then delivered by a separate goroutine and
+// a slow operator no longer delays its parent or siblings.
+//
+// depth is the queue capacity, 0 removes the queue.
+// policy selects the action when the queue is full.
+//
+// Replacing or removing a queue waits until messages already queued are
+// delivered, so message order is kept.
+//
+// Returns non-nil error if depth is out of range.
+//
+func (op *baseOperator) SetQueue(depth int, policy QueuePolicy) error {
+	var err error
+	if depth < 0 || MAX_QUEUE_DEPTH < depth {
+		errmsg := "Queue depth must be between 0 and %d, got %d"
+		err = fmt.Errorf(errmsg, MAX_QUEUE_DEPTH, depth)
+		return err
+	}
+	op.queueLock.Lock()
+	defer op.queueLock.Unlock()
+	q := (*messageQueue)(nil)
+	if depth > 0 {
+		q = newMessageQueue(depth, policy)
+	}
+	old := op.queue()
+	if old != nil {
+		old.stop()
+	}
+	op.inbox.Store(q)
+	if old != nil {
+		old.retire()
+	}
+	return err
+}
+
+// op.QueueState() returns queue depth, policy, pending message count and
+// number of dropped messages.   depth is 0 if the operator has no queue.
+//
+func (op *baseOperator) QueueState() (depth int, policy QueuePolicy, pending int, dropped uint64) {
+	if q := op.queue(); q != nil {
+		depth, pending, dropped = q.state()
+		policy = q.policy
+	}
+	return
 }
 
 // op.Accept() returns true if the operator is to re-transmit the MIDI event.
@@ -365,7 +525,7 @@ func (op *baseOperator) Accept(msg gomidi.Message) bool {
 func (op *baseOperator) distribute(msg gomidi.Message) {
 	if op.MIDIOutputEnabled() {
 		for _, child := range op.children() {
-			child.Send(msg)
+			deliver(child, msg)
 		}
 	}
 }
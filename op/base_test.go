@@ -0,0 +1,227 @@
+package op
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	"github.com/plewto/pigiron/midi"
+)
+
+// countingOperator counts received messages.
+//
+type countingOperator struct {
+	baseOperator
+	count int64
+}
+
+func newCountingOperator(name string) *countingOperator {
+	op := new(countingOperator)
+	initOperator(&op.baseOperator, "Counter", name, midi.NoChannel)
+	return op
+}
+
+func (op *countingOperator) Send(msg gomidi.Message) {
+	atomic.AddInt64(&op.count, 1)
+	op.distribute(msg)
+}
+
+func noteOn(key byte) gomidi.Message {
+	return gomidi.NewMessage([]byte{0x90, key, 64})
+}
+
+// checkGraph fails if parent and child tables disagree or the graph
+// contains a cycle.
+//
+func checkGraph(t *testing.T, ops []Operator) {
+	for _, op := range ops {
+		for _, child := range op.Children() {
+			if !child.IsChildOf(op) {
+				t.Fatalf("%s -> %s missing from parent table", op.Name(), child.Name())
+			}
+			if routes := Routes(child, op, true); len(routes) > 0 {
+				t.Fatalf("cycle %v", append([]string{op.Name()}, routes[0]...))
+			}
+		}
+		for _, parent := range op.Parents() {
+			if !parent.IsParentOf(op) {
+				t.Fatalf("%s -> %s missing from child table", parent.Name(), op.Name())
+			}
+		}
+	}
+}
+
+func TestCircularConnection(t *testing.T) {
+	a := newDummyOperator("a")
+	b := newDummyOperator("b")
+	c := newDummyOperator("c")
+	if err := a.Connect(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Connect(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(a); err == nil {
+		t.Fatal("Expected error for c -> a")
+	}
+	if err := a.Connect(a); err == nil {
+		t.Fatal("Expected error for a -> a")
+	}
+	if err := a.Connect(c); err != nil {
+		t.Fatal(err)
+	}
+	routes := Routes(a, c, false)
+	if len(routes) != 2 {
+		t.Fatalf("Expected 2 routes a -> c, got %v", routes)
+	}
+	checkGraph(t, []Operator{a, b, c})
+}
+
+// TestConnectWhileSending changes connections at random while messages
+// flow through the graph.  Run with -race.
+//
+func TestConnectWhileSending(t *testing.T) {
+	const nodeCount = 8
+	source := newDummyOperator("source")
+	sink := newCountingOperator("sink")
+	nodes := []Operator{source}
+	for i := 0; i < nodeCount; i++ {
+		nodes = append(nodes, newDummyOperator(fmt.Sprintf("node-%d", i)))
+	}
+	nodes = append(nodes, sink)
+	source.Connect(sink)
+
+	var done int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(key byte) {
+			defer wg.Done()
+			for atomic.LoadInt32(&done) == 0 {
+				source.Send(noteOn(key))
+			}
+		}(byte(60 + i))
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for atomic.LoadInt32(&done) == 0 {
+				parent := nodes[rnd.Intn(len(nodes))]
+				child := nodes[rnd.Intn(len(nodes))]
+				switch rnd.Intn(5) {
+				case 0:
+					parent.Disconnect(child)
+				case 1:
+					parent.SetMIDIOutputEnabled(rnd.Intn(2) == 0)
+				case 2:
+					parent.DisconnectParents()
+				default:
+					parent.Connect(child)
+				}
+			}
+		}(int64(i))
+	}
+	time.Sleep(200 * time.Millisecond)
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+	checkGraph(t, nodes)
+
+	for _, op := range nodes {
+		op.DisconnectAll()
+		op.SetMIDIOutputEnabled(true)
+	}
+	source.Connect(sink)
+	before := atomic.LoadInt64(&sink.count)
+	source.Send(noteOn(60))
+	if n := atomic.LoadInt64(&sink.count) - before; n != 1 {
+		t.Fatalf("Expected sink to receive 1 message, got %d", n)
+	}
+}
+
+// TestRegistryConcurrent creates, looks up and deletes operators from
+// several goroutines.  Run with -race.
+//
+func TestRegistryConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				name := fmt.Sprintf("registry-%d-%d", id, j)
+				op, err := NewOperator("Dummy", name)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if other, _ := NewOperator("Dummy", name); other != op {
+					t.Errorf("NewOperator did not reuse %s", name)
+				}
+				if _, err = GetOperator(name); err != nil {
+					t.Error(err)
+				}
+				Operators()
+				RootOperators()
+				if j % 2 == 0 {
+					if err = DeleteOperator(name); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 100; j++ {
+			name := fmt.Sprintf("registry-%d-%d", i, j)
+			if OperatorExists(name) == (j % 2 == 0) {
+				t.Fatalf("Unexpected registry state for %s", name)
+			}
+		}
+	}
+	ClearRegistry()
+	if n := len(Operators()); n != 0 {
+		t.Fatalf("Expected empty registry, got %d operators", n)
+	}
+}
+
+// TestRegistrySameName creates one operator name from several goroutines.
+// All callers must receive the single registered operator.
+//
+func TestRegistrySameName(t *testing.T) {
+	defer ClearRegistry()
+	for j := 0; j < 50; j++ {
+		name := fmt.Sprintf("same-%d", j)
+		var wg sync.WaitGroup
+		ops := make([]Operator, 8)
+		for i := range ops {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				op, err := NewOperator("Dummy", name)
+				if err != nil {
+					t.Error(err)
+				}
+				ops[i] = op
+			}(i)
+		}
+		wg.Wait()
+		registered, err := GetOperator(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, op := range ops {
+			if op != registered {
+				t.Fatalf("Caller %d received an unregistered %s", i, name)
+			}
+		}
+		if _, err = NewOperator("Monitor", name); err == nil {
+			t.Fatalf("Expected error creating Monitor named %s", name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package op
 
 import (
+	"encoding/json"
 	"fmt"
 	gomidi "gitlab.com/gomidi/midi/v2"
 	goosc "github.com/hypebeast/go-osc/osc"
@@ -73,4 +74,22 @@ func (op *ChannelFilter) remoteEnableSystemEvents(msg *goosc.Message)([]string,
 	op.enableSystemEvents = args[2].B
 	return empty, err
 }
-	
+
+
+type filterSession struct {
+	SystemEvents bool `json:"system-events"`
+}
+
+func (op *ChannelFilter) sessionState() interface{} {
+	return &filterSession{op.enableSystemEvents}
+}
+
+func (op *ChannelFilter) restoreSessionState(data json.RawMessage) error {
+	state := op.sessionState().(*filterSession)
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+	op.enableSystemEvents = state.SystemEvents
+	return err
+}
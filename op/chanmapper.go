@@ -0,0 +1,214 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+// CHANNEL_DROP in a ChannelMapper map blocks the source channel.
+//
+const CHANNEL_DROP = 0
+
+// ChannelMapper is an Operator which moves channel messages from one MIDI
+// channel to another.  Each of the 16 source channels maps to a
+// destination channel or is dropped.   Non-channel messages are passed
+// unchanged.
+//
+type ChannelMapper struct {
+	baseOperator
+	lock sync.Mutex
+	channelMap [16]midi.MIDIChannel  // CHANNEL_DROP or destination channel.
+}
+
+func newChannelMapper(name string) *ChannelMapper {
+	op := new(ChannelMapper)
+	initOperator(&op.baseOperator, "ChannelMapper", name, midi.NoChannel)
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() restores the identity map.
+//
+func (op *ChannelMapper) Reset() {
+	op.lock.Lock()
+	for ci := range op.channelMap {
+		op.channelMap[ci] = midi.MIDIChannel(ci + 1)
+	}
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+// op.MapChannel() maps source channel from to channel to.
+// Use CHANNEL_DROP for to to block the source channel.
+//
+func (op *ChannelMapper) MapChannel(from midi.MIDIChannel, to midi.MIDIChannel) error {
+	err := midi.ValidateMIDIChannel(from)
+	if err != nil {
+		return err
+	}
+	if to != CHANNEL_DROP {
+		if err = midi.ValidateMIDIChannel(to); err != nil {
+			return err
+		}
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.channelMap[from-1] = to
+	return err
+}
+
+// op.MappedChannel() returns destination for source channel, or
+// CHANNEL_DROP.
+//
+func (op *ChannelMapper) MappedChannel(from midi.MIDIChannel) (midi.MIDIChannel, error) {
+	err := midi.ValidateMIDIChannel(from)
+	if err != nil {
+		return CHANNEL_DROP, err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.channelMap[from-1], err
+}
+
+func (op *ChannelMapper) Send(msg gomidi.Message) {
+	st := msg.Data[0]
+	if !midi.IsChannelStatus(midi.StatusByte(st)) {
+		op.distribute(msg)
+		return
+	}
+	op.lock.Lock()
+	to := op.channelMap[st & 0x0F]
+	op.lock.Unlock()
+	if to == CHANNEL_DROP {
+		return
+	}
+	data := append([]byte(nil), msg.Data...)
+	data[0] = (st & 0xF0) | byte(to - 1)
+	op.distribute(gomidi.NewMessage(data))
+}
+
+func channelMapString(c midi.MIDIChannel) string {
+	if c == CHANNEL_DROP {
+		return "drop"
+	}
+	return fmt.Sprintf("%d", c)
+}
+
+func (op *ChannelMapper) Info() string {
+	s := op.commonInfo()
+	s += "\tchannel map:\n"
+	for c := midi.MIDIChannel(1); c <= 16; c++ {
+		to, _ := op.MappedChannel(c)
+		s += fmt.Sprintf("\t\t%2d -> %s\n", c, channelMapString(to))
+	}
+	return s
+}
+
+
+func (op *ChannelMapper) initLocalHandlers() {
+
+	// op name, map-channel, from, to|drop [, count]
+	// Maps count (default 1) consecutive channels starting at from.
+	//
+	remoteMapChannel := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osis", msg)
+		if err != nil {
+			return empty, err
+		}
+		from := args[2].I
+		to := int64(CHANNEL_DROP)
+		if dest := args[3].S; strings.ToLower(dest) != "drop" {
+			if to, err = strconv.ParseInt(dest, 10, 64); err != nil {
+				errmsg := "Expected MIDI channel or 'drop', got '%s'"
+				err = fmt.Errorf(errmsg, dest)
+				return empty, err
+			}
+		}
+		count := int64(1)
+		if len(msg.Arguments) > 4 {
+			args, err = ExpectMsg("osisi", msg)
+			if err != nil {
+				return empty, err
+			}
+			count = args[4].I
+		}
+		last := to + count - 1
+		if from < 1 || 16 < from + count - 1 || count < 1 || (to != CHANNEL_DROP && (to < 1 || 16 < last)) {
+			errmsg := "Invalid channel mapping %d -> %s, count %d"
+			err = fmt.Errorf(errmsg, from, args[3].S, count)
+			return empty, err
+		}
+		for i := int64(0); i < count; i++ {
+			dest := midi.MIDIChannel(CHANNEL_DROP)
+			if to != CHANNEL_DROP {
+				dest = midi.MIDIChannel(to + i)
+			}
+			if err = op.MapChannel(midi.MIDIChannel(from + i), dest); err != nil {
+				return empty, err
+			}
+		}
+		return empty, err
+	}
+
+	// op name, q-channel-map [, from]
+	// Returns destination of from, or list of all 16 destinations.
+	//
+	remoteQueryChannelMap := func(msg *goosc.Message)([]string, error) {
+		if len(msg.Arguments) > 2 {
+			args, err := ExpectMsg("osi", msg)
+			if err != nil {
+				return empty, err
+			}
+			from := args[2].I
+			if from < 1 || 16 < from {
+				errmsg := "Expected MIDI channel, got %d"
+				err = fmt.Errorf(errmsg, from)
+				return empty, err
+			}
+			to, err := op.MappedChannel(midi.MIDIChannel(from))
+			return []string{channelMapString(to)}, err
+		}
+		var err error
+		acc := make([]string, 16)
+		for c := midi.MIDIChannel(1); c <= 16; c++ {
+			to, _ := op.MappedChannel(c)
+			acc[c-1] = channelMapString(to)
+		}
+		return acc, err
+	}
+
+	op.addCommandHandler("map-channel", remoteMapChannel)
+	op.addCommandHandler("q-channel-map", remoteQueryChannelMap)
+}
+
+
+func (op *ChannelMapper) sessionState() interface{} {
+	acc := make([]int, 16)
+	for c := midi.MIDIChannel(1); c <= 16; c++ {
+		to, _ := op.MappedChannel(c)
+		acc[c-1] = int(to)
+	}
+	return acc
+}
+
+func (op *ChannelMapper) restoreSessionState(data json.RawMessage) error {
+	var state []int
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	for i, to := range state {
+		if err = op.MapChannel(midi.MIDIChannel(i + 1), midi.MIDIChannel(to)); err != nil {
+			return err
+		}
+	}
+	return err
+}
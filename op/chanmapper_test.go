@@ -0,0 +1,99 @@
+package op
+
+import (
+	"encoding/json"
+	"testing"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+func TestChannelMapper(t *testing.T) {
+	op, err := NewOperator("ChannelMapper", "mapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteOperator("mapper")
+	mapper := op.(*ChannelMapper)
+	out := newCollectingOperator("out")
+	mapper.Connect(out)
+	send := func(data ...byte) {
+		mapper.Send(gomidi.NewMessage(data))
+	}
+
+	// Identity map
+	for ci := byte(0); ci < 16; ci++ {
+		send(0x90 | ci, 60, 100)
+		expectMessages(t, out, []byte{0x90 | ci, 60, 100})
+	}
+
+	// Remap and drop
+	mapper.MapChannel(1, 3)
+	mapper.MapChannel(2, CHANNEL_DROP)
+	send(0x90, 60, 100)
+	send(0xB0, 7, 64)
+	send(0x91, 60, 100)
+	send(0xE1, 0, 64)
+	expectMessages(t, out, []byte{0x92, 60, 100}, []byte{0xB2, 7, 64})
+	if err := mapper.MapChannel(17, 1); err == nil {
+		t.Fatal("Expected error for invalid source channel")
+	}
+	if err := mapper.MapChannel(1, 17); err == nil {
+		t.Fatal("Expected error for invalid destination channel")
+	}
+
+	// Non-channel messages pass unchanged
+	send(0xF8)
+	send(0xF0, 0x7E, 0xF7)
+	expectMessages(t, out, []byte{0xF8}, []byte{0xF0, 0x7E, 0xF7})
+
+	// Count ranges
+	remote := func(args ...interface{}) error {
+		msg := goosc.NewMessage("/pig/op", append([]interface{}{"mapper", "map-channel"}, args...)...)
+		_, err := mapper.DispatchCommand("map-channel", msg)
+		return err
+	}
+	if err := remote("5", "9", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote("13", "drop", "4"); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]interface{}{
+		{"14", "1", "4"},
+		{"1", "14", "4"},
+		{"1", "2", "0"},
+		{"0", "2"},
+		{"1", "bogus"},
+	}{
+		if err := remote(args...); err == nil {
+			t.Fatalf("Expected error for map-channel %v", args)
+		}
+	}
+	expect := []midi.MIDIChannel{3, CHANNEL_DROP, 3, 4, 9, 10, 11, 12, 9, 10, 11, 12,
+		CHANNEL_DROP, CHANNEL_DROP, CHANNEL_DROP, CHANNEL_DROP}
+	for i, want := range expect {
+		if to, _ := mapper.MappedChannel(midi.MIDIChannel(i + 1)); to != want {
+			t.Fatalf("Expected channel %d -> %d, got %d", i + 1, want, to)
+		}
+	}
+
+	// Session round trip
+	data, _ := json.Marshal(mapper.sessionState())
+	restored := newChannelMapper("restored")
+	if err := restored.restoreSessionState(data); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range expect {
+		if to, _ := restored.MappedChannel(midi.MIDIChannel(i + 1)); to != want {
+			t.Fatalf("Restored channel %d -> %d, expected %d", i + 1, to, want)
+		}
+	}
+	if err := restored.restoreSessionState(json.RawMessage("[1, 17]")); err == nil {
+		t.Fatal("Expected error for invalid restored channel")
+	}
+
+	mapper.Reset()
+	send(0x9F, 60, 100)
+	expectMessages(t, out, []byte{0x9F, 60, 100})
+}
@@ -0,0 +1,556 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+const (
+	CHORD_MAX_INVERSION = 3
+	CHORD_MAX_SPREAD = 2
+	CHORD_MAX_INTERVAL = 48
+)
+
+// chordTypes defines the built-in ChordGenerator chords as semitone
+// intervals from the played key.
+//
+var chordTypes = map[string][]int{
+	"major":  {0, 4, 7},
+	"minor":  {0, 3, 7},
+	"dim":    {0, 3, 6},
+	"aug":    {0, 4, 8},
+	"sus2":   {0, 2, 7},
+	"sus4":   {0, 5, 7},
+	"power":  {0, 7, 12},
+	"6":      {0, 4, 7, 9},
+	"min6":   {0, 3, 7, 9},
+	"7":      {0, 4, 7, 10},
+	"maj7":   {0, 4, 7, 11},
+	"min7":   {0, 3, 7, 10},
+	"dim7":   {0, 3, 6, 9},
+	"7sus4":  {0, 5, 7, 10},
+	"add9":   {0, 4, 7, 14},
+}
+
+// ChordGenerator is an Operator which turns each NOTE_ON into a chord.
+//
+// The chord is selected by name from a dictionary of interval lists,
+// initially the built-in chord types.  Additional chords may be defined.
+// The voicing may be inverted, and spread by raising every second chord
+// tone by one or more octaves.
+//
+// NOTE_OFF and POLY_PRESSURE follow the chord produced by their NOTE_ON,
+// even if the chord has since changed.  Where chords overlap a shared note
+// is turned off when the last chord containing it is released.
+//
+// PROGRAM messages may be assigned to chords, assigned programs select the
+// chord and are not re-transmitted.  All other messages are passed
+// unchanged.
+//
+type ChordGenerator struct {
+	baseOperator
+	lock sync.Mutex
+	chords map[string][]int
+	chord string
+	inversion int
+	spread int
+	programs map[byte]string
+	notes *noteMap
+}
+
+func newChordGenerator(name string) *ChordGenerator {
+	op := new(ChordGenerator)
+	initOperator(&op.baseOperator, "ChordGenerator", name, midi.NoChannel)
+	op.notes = newNoteMap()
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() releases all chords and restores the built-in chord types,
+// selecting a major chord in root position.
+//
+func (op *ChordGenerator) Reset() {
+	op.lock.Lock()
+	op.releaseAll()
+	op.chords = make(map[string][]int)
+	for name, intervals := range chordTypes {
+		op.chords[name] = intervals
+	}
+	op.chord = "major"
+	op.inversion = 0
+	op.spread = 0
+	op.programs = make(map[byte]string)
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+func (op *ChordGenerator) Panic() {
+	op.lock.Lock()
+	op.releaseAll()
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Panic()
+}
+
+// op.releaseAll() sends note-off for all generated notes.
+// The lock must be held by the caller.
+//
+func (op *ChordGenerator) releaseAll() {
+	for _, off := range op.notes.reset() {
+		op.distribute(off)
+	}
+}
+
+// ChordTypes() returns sorted list of built-in chord names.
+//
+func ChordTypes() []string {
+	acc := make([]string, 0, len(chordTypes))
+	for name := range chordTypes {
+		acc = append(acc, name)
+	}
+	sort.Strings(acc)
+	return acc
+}
+
+// op.DefineChord() adds, or replaces, a named chord.
+// Intervals are semitones from the played key.
+//
+func (op *ChordGenerator) DefineChord(name string, intervals []int) error {
+	var err error
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "none" || len(intervals) == 0 {
+		errmsg := "Expected chord name and at least one interval, got '%s' %v"
+		err = fmt.Errorf(errmsg, name, intervals)
+		return err
+	}
+	for _, iv := range intervals {
+		if iv < -CHORD_MAX_INTERVAL || CHORD_MAX_INTERVAL < iv {
+			errmsg := "Chord intervals must be between -%d and %d, got %d"
+			err = fmt.Errorf(errmsg, CHORD_MAX_INTERVAL, CHORD_MAX_INTERVAL, iv)
+			return err
+		}
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.chords[name] = append([]int(nil), intervals...)
+	return err
+}
+
+// op.Chords() returns sorted list of defined chord names.
+//
+func (op *ChordGenerator) Chords() []string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	acc := make([]string, 0, len(op.chords))
+	for name := range op.chords {
+		acc = append(acc, name)
+	}
+	sort.Strings(acc)
+	return acc
+}
+
+// op.Intervals() returns the intervals of the named chord.
+//
+func (op *ChordGenerator) Intervals(name string) ([]int, error) {
+	var err error
+	name = strings.ToLower(strings.TrimSpace(name))
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	intervals, exists := op.chords[name]
+	if !exists {
+		errmsg := "ChordGenerator %s does not have a chord named '%s'"
+		err = fmt.Errorf(errmsg, op.Name(), name)
+		return nil, err
+	}
+	return append([]int(nil), intervals...), err
+}
+
+// op.SelectChord() selects the named chord for new notes.
+//
+func (op *ChordGenerator) SelectChord(name string) error {
+	_, err := op.Intervals(name)
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.chord = strings.ToLower(strings.TrimSpace(name))
+	return err
+}
+
+func (op *ChordGenerator) Chord() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.chord
+}
+
+// op.SetInversion() sets chord inversion, 0 for root position.
+// The inversion is applied modulo the number of chord tones.
+//
+func (op *ChordGenerator) SetInversion(n int) error {
+	var err error
+	if n < 0 || CHORD_MAX_INVERSION < n {
+		errmsg := "Expected inversion between 0 and %d, got %d"
+		err = fmt.Errorf(errmsg, CHORD_MAX_INVERSION, n)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.inversion = n
+	return err
+}
+
+func (op *ChordGenerator) Inversion() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.inversion
+}
+
+// op.SetSpread() sets the number of octaves every second chord tone is
+// raised, 0 for close voicing.
+//
+func (op *ChordGenerator) SetSpread(n int) error {
+	var err error
+	if n < 0 || CHORD_MAX_SPREAD < n {
+		errmsg := "Expected spread between 0 and %d, got %d"
+		err = fmt.Errorf(errmsg, CHORD_MAX_SPREAD, n)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.spread = n
+	return err
+}
+
+func (op *ChordGenerator) Spread() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.spread
+}
+
+// op.AssignProgram() assigns a PROGRAM number to a chord.
+// Use "none" to remove the assignment.
+//
+func (op *ChordGenerator) AssignProgram(program byte, name string) error {
+	var err error
+	if program > 127 {
+		errmsg := "Expected program number between 0 and 127, got %d"
+		err = fmt.Errorf(errmsg, program)
+		return err
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "none" {
+		op.lock.Lock()
+		delete(op.programs, program)
+		op.lock.Unlock()
+		return err
+	}
+	if _, err = op.Intervals(name); err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.programs[program] = name
+	return err
+}
+
+// op.ProgramAssignments() returns 'program chord' for each assigned program.
+//
+func (op *ChordGenerator) ProgramAssignments() []string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	acc := make([]string, 0, len(op.programs))
+	for p := 0; p < 128; p++ {
+		if name, exists := op.programs[byte(p)]; exists {
+			acc = append(acc, fmt.Sprintf("%d %s", p, name))
+		}
+	}
+	return acc
+}
+
+// op.voicing() returns the chord keys for key using the current chord,
+// inversion and spread.  Keys outside the MIDI range are dropped.
+// The lock must be held by the caller.
+//
+func (op *ChordGenerator) voicing(key byte) []byte {
+	intervals := append([]int(nil), op.chords[op.chord]...)
+	sort.Ints(intervals)
+	for i := 0; i < op.inversion % len(intervals); i++ {
+		intervals[i] += 12
+	}
+	sort.Ints(intervals)
+	for i := 1; i < len(intervals); i += 2 {
+		intervals[i] += 12 * op.spread
+	}
+	acc := make([]byte, 0, len(intervals))
+	seen := make(map[int]bool)
+	for _, iv := range intervals {
+		k := int(key) + iv
+		if 0 <= k && k < 128 && !seen[k] {
+			seen[k] = true
+			acc = append(acc, byte(k))
+		}
+	}
+	return acc
+}
+
+func (op *ChordGenerator) Send(msg gomidi.Message) {
+	d := msg.Data
+	st := midi.StatusByte(d[0] & 0xF0)
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	switch {
+	case st == midi.PROGRAM && len(d) > 1:
+		if name, exists := op.programs[d[1]]; exists {
+			op.chord = name
+			return
+		}
+	case midi.IsNoteOn(msg):
+		for _, on := range op.notes.noteOn(msg, op.voicing(d[1])) {
+			op.distribute(on)
+		}
+		return
+	case midi.IsNoteOff(msg):
+		if offs, held := op.notes.noteOff(msg); held {
+			for _, off := range offs {
+				op.distribute(off)
+			}
+			return
+		}
+	case st == midi.POLY_PRESSURE && len(d) > 2:
+		if messages, held := op.notes.pressure(msg); held {
+			for _, m := range messages {
+				op.distribute(m)
+			}
+			return
+		}
+	}
+	op.distribute(msg)
+}
+
+func (op *ChordGenerator) Info() string {
+	s := op.commonInfo()
+	op.lock.Lock()
+	s += fmt.Sprintf("\tchord: %s %v\n", op.chord, op.chords[op.chord])
+	s += fmt.Sprintf("\tinversion: %d  spread: %d\n", op.inversion, op.spread)
+	op.lock.Unlock()
+	if programs := op.ProgramAssignments(); len(programs) > 0 {
+		s += fmt.Sprintf("\tprograms: %s\n", strings.Join(programs, ", "))
+	}
+	return s
+}
+
+
+func (op *ChordGenerator) initLocalHandlers() {
+
+	// op name, set-chord, name
+	//
+	remoteSetChord := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SelectChord(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-chord
+	//
+	remoteQueryChord := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.Chord()}, err
+	}
+
+	// op name, q-chords
+	//
+	remoteQueryChords := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return op.Chords(), err
+	}
+
+	// op name, define-chord, name, interval [, interval ...]
+	//
+	remoteDefineChord := func(msg *goosc.Message)([]string, error) {
+		template := "ossi"
+		for i := 4; i < len(msg.Arguments); i++ {
+			template += "i"
+		}
+		args, err := ExpectMsg(template, msg)
+		if err != nil {
+			return empty, err
+		}
+		intervals := make([]int, 0, len(args) - 3)
+		for _, arg := range args[3:] {
+			intervals = append(intervals, int(arg.I))
+		}
+		err = op.DefineChord(args[2].S, intervals)
+		return empty, err
+	}
+
+	// op name, q-intervals [, name]
+	// Returns intervals of named, or current, chord.
+	//
+	remoteQueryIntervals := func(msg *goosc.Message)([]string, error) {
+		name := op.Chord()
+		if len(msg.Arguments) > 2 {
+			args, err := ExpectMsg("oss", msg)
+			if err != nil {
+				return empty, err
+			}
+			name = args[2].S
+		}
+		intervals, err := op.Intervals(name)
+		if err != nil {
+			return empty, err
+		}
+		acc := make([]string, len(intervals))
+		for i, iv := range intervals {
+			acc[i] = fmt.Sprintf("%d", iv)
+		}
+		return acc, err
+	}
+
+	// op name, set-inversion, n
+	//
+	remoteSetInversion := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetInversion(int(args[2].I))
+		return empty, err
+	}
+
+	// op name, q-inversion
+	//
+	remoteQueryInversion := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.Inversion())}, err
+	}
+
+	// op name, set-spread, n
+	//
+	remoteSetSpread := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetSpread(int(args[2].I))
+		return empty, err
+	}
+
+	// op name, q-spread
+	//
+	remoteQuerySpread := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.Spread())}, err
+	}
+
+	// op name, set-program-chord, program, name|none
+	//
+	remoteSetProgramChord := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osis", msg)
+		if err != nil {
+			return empty, err
+		}
+		program := args[2].I
+		if program < 0 || 127 < program {
+			errmsg := "Expected program number between 0 and 127, got %d"
+			err = fmt.Errorf(errmsg, program)
+			return empty, err
+		}
+		err = op.AssignProgram(byte(program), args[3].S)
+		return empty, err
+	}
+
+	// op name, q-program-chords
+	// Returns list of 'program chord' assignments.
+	//
+	remoteQueryProgramChords := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return op.ProgramAssignments(), err
+	}
+
+	op.addCommandHandler("set-chord", remoteSetChord)
+	op.addCommandHandler("q-chord", remoteQueryChord)
+	op.addCommandHandler("q-chords", remoteQueryChords)
+	op.addCommandHandler("define-chord", remoteDefineChord)
+	op.addCommandHandler("q-intervals", remoteQueryIntervals)
+	op.addCommandHandler("set-inversion", remoteSetInversion)
+	op.addCommandHandler("q-inversion", remoteQueryInversion)
+	op.addCommandHandler("set-spread", remoteSetSpread)
+	op.addCommandHandler("q-spread", remoteQuerySpread)
+	op.addCommandHandler("set-program-chord", remoteSetProgramChord)
+	op.addCommandHandler("q-program-chords", remoteQueryProgramChords)
+}
+
+
+type chordGeneratorSession struct {
+	Chord string                `json:"chord"`
+	Inversion int               `json:"inversion"`
+	Spread int                  `json:"spread"`
+	Defined map[string][]int    `json:"defined-chords"`
+	Programs map[string]string  `json:"programs"`
+}
+
+// Only chords which differ from the built-in types are saved.
+//
+func (op *ChordGenerator) sessionState() interface{} {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	state := &chordGeneratorSession{
+		Chord: op.chord,
+		Inversion: op.inversion,
+		Spread: op.spread,
+		Defined: make(map[string][]int),
+		Programs: make(map[string]string)}
+	for name, intervals := range op.chords {
+		if fmt.Sprint(intervals) != fmt.Sprint(chordTypes[name]) {
+			state.Defined[name] = intervals
+		}
+	}
+	for p, name := range op.programs {
+		state.Programs[fmt.Sprintf("%d", p)] = name
+	}
+	return state
+}
+
+func (op *ChordGenerator) restoreSessionState(data json.RawMessage) error {
+	var state chordGeneratorSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	for name, intervals := range state.Defined {
+		if err = op.DefineChord(name, intervals); err != nil {
+			return err
+		}
+	}
+	for p, name := range state.Programs {
+		program, err := strconv.Atoi(p)
+		if err != nil || program < 0 || 127 < program {
+			errmsg := "Invalid ChordGenerator program number '%s'"
+			err = fmt.Errorf(errmsg, p)
+			return err
+		}
+		if err = op.AssignProgram(byte(program), name); err != nil {
+			return err
+		}
+	}
+	if err = op.SetInversion(state.Inversion); err != nil {
+		return err
+	}
+	if err = op.SetSpread(state.Spread); err != nil {
+		return err
+	}
+	return op.SelectChord(state.Chord)
+}
@@ -0,0 +1,67 @@
+package op
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestChordGenerator(t *testing.T) {
+	chords := newChordGenerator("chords")
+	out := newCollectingOperator("out")
+	chords.Connect(out)
+	sendBytes(chords, 0x90, 60, 100)
+	expectMessages(t, out, []byte{0x90, 60, 100}, []byte{0x90, 64, 100}, []byte{0x90, 67, 100})
+
+	// Note off follows the original chord after the chord changes.
+	chords.SelectChord("minor")
+	chords.SetInversion(1)
+	sendBytes(chords, 0x80, 60, 0)
+	expectMessages(t, out, []byte{0x80, 60, 0}, []byte{0x80, 64, 0}, []byte{0x80, 67, 0})
+
+	// First inversion minor: Eb G C
+	sendBytes(chords, 0x91, 60, 90)
+	expectMessages(t, out, []byte{0x91, 63, 90}, []byte{0x91, 67, 90}, []byte{0x91, 72, 90})
+	sendBytes(chords, 0x91, 60, 0)
+	expectMessages(t, out, []byte{0x81, 63, 0}, []byte{0x81, 67, 0}, []byte{0x81, 72, 0})
+
+	// Spread raises every second chord tone.
+	chords.SetInversion(0)
+	chords.SetSpread(1)
+	sendBytes(chords, 0x90, 48, 100)
+	expectMessages(t, out, []byte{0x90, 48, 100}, []byte{0x90, 63, 100}, []byte{0x90, 55, 100})
+	chords.SetSpread(0)
+
+	// Shared notes are turned off by the last chord.
+	chords.SelectChord("power")
+	sendBytes(chords, 0x90, 55, 100)
+	out.take()
+	sendBytes(chords, 0x80, 48, 0)
+	expectMessages(t, out, []byte{0x80, 48, 0}, []byte{0x80, 63, 0})
+	sendBytes(chords, 0x80, 55, 0)
+	expectMessages(t, out, []byte{0x80, 55, 0}, []byte{0x80, 62, 0}, []byte{0x80, 67, 0})
+
+	// Custom chord selected by program change.
+	if err := chords.DefineChord("cluster", []int{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chords.AssignProgram(5, "bogus"); err == nil {
+		t.Fatal("Expected error for unknown chord")
+	}
+	chords.AssignProgram(5, "cluster")
+	sendBytes(chords, 0xC0, 5)
+	sendBytes(chords, 0xC0, 6)
+	sendBytes(chords, 0x90, 60, 100)
+	expectMessages(t, out, []byte{0xC0, 6}, []byte{0x90, 60, 100}, []byte{0x90, 61, 100}, []byte{0x90, 62, 100})
+	chords.Panic()
+	expectMessages(t, out, []byte{0x80, 60, 0}, []byte{0x80, 61, 0}, []byte{0x80, 62, 0})
+
+	// Session round trip
+	data, _ := json.Marshal(chords.sessionState())
+	restored := newChordGenerator("restored")
+	if err := restored.restoreSessionState(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Chord() != "cluster" || len(restored.ProgramAssignments()) != 1 {
+		t.Fatalf("Session not restored: %s", restored.Info())
+	}
+}
@@ -0,0 +1,204 @@
+package op
+
+/*
+** clockin.go defines MIDI clock slave input for MIDIPlayer.
+**
+** If MIDI transport is enabled, START, STOP, CONTINUE and Song Position
+** Pointer messages received by the player control playback.
+**
+** If clock follow is enabled, playback tempo is derived from incoming MIDI
+** clock.  The interval between clocks is smoothed to reduce jitter.
+**
+*/
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+	"github.com/plewto/pigiron/pigerr"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+const (
+	CLOCK_FOLLOW_SMOOTHING = 0.1  // weight of each new clock interval.
+	CLOCK_FOLLOW_TIMEOUT = 250 * time.Millisecond  // longer gaps restart tempo detection.
+	CLOCK_FOLLOW_THRESHOLD = 0.001  // minimum relative tempo change applied.
+)
+
+// op.Send() handles MIDI transport and clock messages, if enabled.
+// Handled messages are consumed, all other messages are re-transmitted.
+//
+func (op *MIDIPlayer) Send(msg gomidi.Message) {
+	if len(msg.Data) == 0 {
+		return
+	}
+	now := time.Now()
+	st := midi.StatusByte(msg.Data[0])
+	switch {
+	case st == midi.CLOCK:
+		if op.ClockFollowEnabled() {
+			op.receiveClock(now)
+			return
+		}
+	case midi.IsSystemRealtimeStatus(st) || st == midi.SONG_POSITION:
+		if op.enableMIDITransport {
+			op.receiveTransport(msg, now)
+			return
+		}
+	default:
+	}
+	if op.Accept(msg) {
+		op.distribute(msg)
+	}
+}
+
+// op.receiveTransport() responds to START, STOP, CONTINUE and Song Position
+// Pointer messages received at time now.
+//
+func (op *MIDIPlayer) receiveTransport(msg gomidi.Message, now time.Time) {
+	d := msg.Data
+	switch midi.StatusByte(d[0]) {
+	case midi.START:
+		op.resetClockFollow()
+		if err := op.slaveStart(now, true); err != nil {
+			pigerr.Warning("MIDIPlayer START failed", err.Error())
+		}
+	case midi.CONTINUE:
+		if err := op.slaveStart(now, false); err != nil {
+			pigerr.Warning("MIDIPlayer CONTINUE failed", err.Error())
+		}
+	case midi.STOP:
+		if op.IsPlaying() {
+			op.Stop()
+		}
+	case midi.SONG_POSITION:
+		if len(d) < 3 {
+			return
+		}
+		spp := uint64(d[1] & 0x7F) | uint64(d[2] & 0x7F) << 7
+		op.transportLock.Lock()
+		defer op.transportLock.Unlock()
+		if op.MediaFilename() == "" || op.state == PLAYING {
+			return
+		}
+		op.seekTick(spp * uint64(op.midifile.Division()) / 4)
+	default:
+	}
+}
+
+// op.slaveStart() starts playback for a received START or CONTINUE.
+// Unlike Play and Continue the file is not reloaded and there is no start
+// delay, the current position is anchored at time at, the arrival of the
+// transport message, so playback stays aligned with the master.
+// If rewind is true playback starts from the beginning.
+//
+func (op *MIDIPlayer) slaveStart(at time.Time, rewind bool) error {
+	var err error
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	if op.MediaFilename() == "" {
+		err = errors.New("No MIDI file loaded")
+		return err
+	}
+	if rewind {
+		op.haltPlayLoop()
+		op.killActiveNotes()
+		op.locate(0)
+	} else {
+		if op.state == PLAYING {
+			return err
+		}
+		op.noteQueue.Reset()
+	}
+	op.startAt(at)
+	return err
+}
+
+// op.receiveClock() updates the smoothed clock tempo.
+//
+func (op *MIDIPlayer) receiveClock(now time.Time) {
+	op.tempoLock.Lock()
+	previous := op.lastClock
+	op.lastClock = now
+	if previous.IsZero() {
+		op.tempoLock.Unlock()
+		return
+	}
+	interval := now.Sub(previous)
+	if interval <= 0 || interval > CLOCK_FOLLOW_TIMEOUT {
+		op.clockInterval = 0
+		op.tempoLock.Unlock()
+		return
+	}
+	seconds := interval.Seconds()
+	if op.clockInterval == 0 {
+		op.clockInterval = seconds
+	} else {
+		op.clockInterval += CLOCK_FOLLOW_SMOOTHING * (seconds - op.clockInterval)
+	}
+	tempo := 60.0 / (op.clockInterval * CLOCKS_PER_QUARTER)
+	changed := op.clockTempo == 0 || math.Abs(tempo - op.clockTempo) / op.clockTempo > CLOCK_FOLLOW_THRESHOLD
+	if changed {
+		op.clockTempo = tempo
+	}
+	op.tempoLock.Unlock()
+	if changed {
+		op.notifyTempoChange()
+	}
+}
+
+// op.resetClockFollow() discards clock interval history.
+// The most recent clock tempo is retained until new clocks arrive.
+//
+func (op *MIDIPlayer) resetClockFollow() {
+	op.tempoLock.Lock()
+	defer op.tempoLock.Unlock()
+	op.lastClock = time.Time{}
+	op.clockInterval = 0
+}
+
+// op.EnableClockFollow() sets whether playback tempo follows incoming MIDI clock.
+// While following, tempo scale and tempo override are ignored.
+//
+func (op *MIDIPlayer) EnableClockFollow(flag bool) {
+	op.tempoLock.Lock()
+	op.clockFollow = flag
+	op.clockTempo = 0
+	op.lastClock = time.Time{}
+	op.clockInterval = 0
+	op.tempoLock.Unlock()
+	op.notifyTempoChange()
+}
+
+func (op *MIDIPlayer) ClockFollowEnabled() bool {
+	op.tempoLock.Lock()
+	defer op.tempoLock.Unlock()
+	return op.clockFollow
+}
+
+func (op *MIDIPlayer) initClockInHandlers() {
+
+	// op name, enable-clock-follow, bool
+	//
+	remoteEnableClockFollow := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osb", msg)
+		if err != nil {
+			return empty, err
+		}
+		op.EnableClockFollow(args[2].B)
+		return empty, err
+	}
+
+	// op name, q-clock-follow-enabled
+	//
+	remoteQueryClockFollow := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%v", op.ClockFollowEnabled())}, err
+	}
+
+	op.addCommandHandler("enable-clock-follow", remoteEnableClockFollow)
+	op.addCommandHandler("q-clock-follow-enabled", remoteQueryClockFollow)
+}
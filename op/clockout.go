@@ -0,0 +1,130 @@
+package op
+
+/*
+** clockout.go defines MIDI clock master output for MIDIPlayer.
+**
+** When enabled the player sends timing clock (24 per quarter note)
+** derived from the file's tempo map, START, STOP and CONTINUE on transport
+** changes, and Song Position Pointer whenever the position changes.
+**
+*/
+
+import (
+	"fmt"
+	"math"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+const (
+	CLOCKS_PER_QUARTER = 24
+	CLOCKS_PER_SIXTEENTH = 6
+	MAX_SONG_POSITION = 0x3FFF
+)
+
+// op.clockTicks() returns number of file ticks per MIDI clock.
+//
+func (op *MIDIPlayer) clockTicks() float64 {
+	return float64(op.midifile.Division()) / CLOCKS_PER_QUARTER
+}
+
+func (op *MIDIPlayer) sendRealtime(st midi.StatusByte) {
+	op.distribute(gomidi.NewMessage([]byte{byte(st)}))
+}
+
+// op.songPosition() returns the Song Position Pointer, in 16th notes,
+// of the first 16th note at or after tick.
+//
+func (op *MIDIPlayer) songPosition(tick uint64) uint64 {
+	sixteenth := float64(op.midifile.Division()) / 4
+	spp := uint64(math.Ceil(float64(tick) / sixteenth))
+	if spp > MAX_SONG_POSITION {
+		spp = MAX_SONG_POSITION
+	}
+	return spp
+}
+
+func (op *MIDIPlayer) sendSongPosition(spp uint64) {
+	msg := gomidi.NewMessage([]byte{byte(midi.SONG_POSITION), byte(spp & 0x7F), byte((spp >> 7) & 0x7F)})
+	op.distribute(msg)
+}
+
+// op.clockStart() sends START, or Song Position Pointer and CONTINUE,
+// for the current position.  Clock output begins at the first 16th note
+// at or after the current position.
+//
+func (op *MIDIPlayer) clockStart() {
+	if !op.clockRunning {
+		return
+	}
+	if op.currentTick == 0 {
+		op.clockIndex = 0
+		op.sendRealtime(midi.START)
+		return
+	}
+	spp := op.songPosition(op.currentTick)
+	op.clockIndex = spp * CLOCKS_PER_SIXTEENTH
+	op.sendSongPosition(spp)
+	op.sendRealtime(midi.CONTINUE)
+}
+
+// op.sendClocks() sends all MIDI clocks scheduled before tick.
+// Returns false if playback was halted while waiting.
+//
+func (op *MIDIPlayer) sendClocks(tick uint64, halt chan bool) bool {
+	if !op.clockRunning {
+		return true
+	}
+	step := op.clockTicks()
+	for {
+		clockTick := float64(op.clockIndex) * step
+		if clockTick >= float64(tick) {
+			return true
+		}
+		if _, ok := op.sleepToTick(clockTick, halt); !ok {
+			return false
+		}
+		op.sendRealtime(midi.CLOCK)
+		op.clockIndex++
+	}
+}
+
+// op.EnableClockOut() sets whether MIDI clock and transport messages are sent.
+// Changes take effect the next time playback starts.
+//
+func (op *MIDIPlayer) EnableClockOut(flag bool) {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	op.clockOut = flag
+}
+
+func (op *MIDIPlayer) ClockOutEnabled() bool {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	return op.clockOut
+}
+
+func (op *MIDIPlayer) initClockOutHandlers() {
+
+	// op name, enable-clock-out, bool
+	//
+	remoteEnableClockOut := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osb", msg)
+		if err != nil {
+			return empty, err
+		}
+		op.EnableClockOut(args[2].B)
+		return empty, err
+	}
+
+	// op name, q-clock-out-enabled
+	//
+	remoteQueryClockOut := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%v", op.ClockOutEnabled())}, err
+	}
+
+	op.addCommandHandler("enable-clock-out", remoteEnableClockOut)
+	op.addCommandHandler("q-clock-out-enabled", remoteQueryClockOut)
+}
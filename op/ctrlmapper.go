@@ -0,0 +1,414 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+// ctrlEndpoint is a controller-like value source or destination, one of:
+//    ccN       - controller number N
+//    bend      - pitch bend, 14-bit value 0..16383
+//    pressure  - channel pressure
+//    program   - program change
+//
+type ctrlEndpoint struct {
+	status midi.StatusByte
+	number byte   // controller number, CONTROLLER only
+}
+
+// parseCtrlEndpoint() converts endpoint name to ctrlEndpoint.
+//
+func parseCtrlEndpoint(s string) (ctrlEndpoint, error) {
+	var err error
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "bend":
+		return ctrlEndpoint{midi.BEND, 0}, err
+	case "pressure":
+		return ctrlEndpoint{midi.CHANNEL_PRESSURE, 0}, err
+	case "program":
+		return ctrlEndpoint{midi.PROGRAM, 0}, err
+	}
+	if strings.HasPrefix(s, "cc") {
+		n, cerr := strconv.Atoi(s[2:])
+		if cerr == nil && 0 <= n && n < 128 {
+			return ctrlEndpoint{midi.CONTROLLER, byte(n)}, err
+		}
+	}
+	errmsg := "Expected ccN (0 <= N < 128), bend, pressure or program, got '%s'"
+	err = fmt.Errorf(errmsg, s)
+	return ctrlEndpoint{}, err
+}
+
+func (e ctrlEndpoint) String() string {
+	switch e.status {
+	case midi.BEND:
+		return "bend"
+	case midi.CHANNEL_PRESSURE:
+		return "pressure"
+	case midi.PROGRAM:
+		return "program"
+	default:
+		return fmt.Sprintf("cc%d", e.number)
+	}
+}
+
+// e.maxValue() returns the endpoint's maximum value.
+//
+func (e ctrlEndpoint) maxValue() int {
+	if e.status == midi.BEND {
+		return 0x3FFF
+	}
+	return 0x7F
+}
+
+// e.value() returns the value of a message matching the endpoint.
+//
+func (e ctrlEndpoint) value(data []byte) (int, bool) {
+	if midi.StatusByte(data[0] & 0xF0) != e.status {
+		return 0, false
+	}
+	switch e.status {
+	case midi.CONTROLLER:
+		if len(data) < 3 || data[1] != e.number {
+			return 0, false
+		}
+		return int(data[2]), true
+	case midi.BEND:
+		if len(data) < 3 {
+			return 0, false
+		}
+		return int(data[1]) | int(data[2]) << 7, true
+	default:
+		if len(data) < 2 {
+			return 0, false
+		}
+		return int(data[1]), true
+	}
+}
+
+// e.message() returns message data for value on channel index ci.
+//
+func (e ctrlEndpoint) message(ci byte, value int) []byte {
+	st := byte(e.status) | ci
+	switch e.status {
+	case midi.CONTROLLER:
+		return []byte{st, e.number, byte(value)}
+	case midi.BEND:
+		return []byte{st, byte(value & 0x7F), byte(value >> 7)}
+	default:
+		return []byte{st, byte(value)}
+	}
+}
+
+// ctrlMapping is a single ControllerMapper row.
+// Input values are clamped to the input range and linearly scaled to the
+// output range.  Either range may be reversed.
+//
+type ctrlMapping struct {
+	channel midi.MIDIChannel  // 0 for all channels
+	source ctrlEndpoint
+	dest ctrlEndpoint
+	inLow, inHigh int
+	outLow, outHigh int
+}
+
+func (m *ctrlMapping) validate() error {
+	var err error
+	inMax, outMax := m.source.maxValue(), m.dest.maxValue()
+	if m.inLow < 0 || m.inHigh < 0 || m.inLow > inMax || m.inHigh > inMax {
+		errmsg := "%s input range must be between 0 and %d, got %d %d"
+		err = fmt.Errorf(errmsg, m.source, inMax, m.inLow, m.inHigh)
+		return err
+	}
+	if m.outLow < 0 || m.outHigh < 0 || m.outLow > outMax || m.outHigh > outMax {
+		errmsg := "%s output range must be between 0 and %d, got %d %d"
+		err = fmt.Errorf(errmsg, m.dest, outMax, m.outLow, m.outHigh)
+		return err
+	}
+	if m.channel != 0 {
+		err = midi.ValidateMIDIChannel(m.channel)
+	}
+	return err
+}
+
+// m.convert() maps input value v to the output range.
+//
+func (m *ctrlMapping) convert(v int) int {
+	lo, hi := m.inLow, m.inHigh
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	v = int(math.Max(float64(lo), math.Min(float64(hi), float64(v))))
+	t := 0.0
+	if m.inHigh != m.inLow {
+		t = float64(v - m.inLow) / float64(m.inHigh - m.inLow)
+	}
+	return int(math.Round(float64(m.outLow) + t * float64(m.outHigh - m.outLow)))
+}
+
+func (m *ctrlMapping) String() string {
+	channel := "all"
+	if m.channel != 0 {
+		channel = fmt.Sprintf("%d", m.channel)
+	}
+	msg := "%s %s %s %d %d %d %d"
+	return fmt.Sprintf(msg, channel, m.source, m.dest, m.inLow, m.inHigh, m.outLow, m.outHigh)
+}
+
+// ControllerMapper is an Operator which converts controller-like messages.
+// Each mapping row selects a source (controller number, pitch bend,
+// channel pressure or program change) optionally on a single channel, and
+// converts it to a destination type with range scaling.
+//
+// A message matching one or more rows is replaced by the output of each
+// matching row.  All other messages are passed unchanged.
+//
+type ControllerMapper struct {
+	baseOperator
+	lock sync.Mutex
+	mappings []*ctrlMapping
+}
+
+func newControllerMapper(name string) *ControllerMapper {
+	op := new(ControllerMapper)
+	initOperator(&op.baseOperator, "ControllerMapper", name, midi.NoChannel)
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() removes all mappings.
+//
+func (op *ControllerMapper) Reset() {
+	op.ClearMappings()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+// op.AddMapping() adds a mapping row.
+//
+// channel - 1..16, or 0 for all channels.
+// source, dest - endpoint names: ccN, bend, pressure or program.
+// ranges - optional inLow, inHigh, outLow, outHigh, defaults to the full
+//          range of the source and destination.
+//
+// Returns the row index.
+//
+func (op *ControllerMapper) AddMapping(channel midi.MIDIChannel, source string, dest string, ranges ...int) (int, error) {
+	var err error
+	m := &ctrlMapping{channel: channel}
+	if m.source, err = parseCtrlEndpoint(source); err != nil {
+		return -1, err
+	}
+	if m.dest, err = parseCtrlEndpoint(dest); err != nil {
+		return -1, err
+	}
+	m.inHigh, m.outHigh = m.source.maxValue(), m.dest.maxValue()
+	switch len(ranges) {
+	case 0:
+	case 4:
+		m.inLow, m.inHigh, m.outLow, m.outHigh = ranges[0], ranges[1], ranges[2], ranges[3]
+	default:
+		errmsg := "Expected 0 or 4 range values, got %d"
+		err = fmt.Errorf(errmsg, len(ranges))
+		return -1, err
+	}
+	if err = m.validate(); err != nil {
+		return -1, err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.mappings = append(op.mappings, m)
+	return len(op.mappings) - 1, err
+}
+
+// op.RemoveMapping() removes indexed mapping row.
+//
+func (op *ControllerMapper) RemoveMapping(index int) error {
+	var err error
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if index < 0 || len(op.mappings) <= index {
+		errmsg := "Mapping index out of range: %d"
+		err = fmt.Errorf(errmsg, index)
+		return err
+	}
+	op.mappings = append(op.mappings[:index:index], op.mappings[index+1:]...)
+	return err
+}
+
+// op.ClearMappings() removes all mapping rows.
+//
+func (op *ControllerMapper) ClearMappings() {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.mappings = make([]*ctrlMapping, 0)
+}
+
+// op.Mappings() returns string representation of all mapping rows.
+//
+func (op *ControllerMapper) Mappings() []string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	acc := make([]string, len(op.mappings))
+	for i, m := range op.mappings {
+		acc[i] = m.String()
+	}
+	return acc
+}
+
+// op.convert() returns converted messages, or nil if no row matches.
+//
+func (op *ControllerMapper) convert(data []byte) [][]byte {
+	var acc [][]byte
+	ci := data[0] & 0x0F
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	for _, m := range op.mappings {
+		if m.channel != 0 && byte(m.channel - 1) != ci {
+			continue
+		}
+		if v, ok := m.source.value(data); ok {
+			acc = append(acc, m.dest.message(ci, m.convert(v)))
+		}
+	}
+	return acc
+}
+
+func (op *ControllerMapper) Send(msg gomidi.Message) {
+	if !midi.IsChannelStatus(midi.StatusByte(msg.Data[0])) {
+		op.distribute(msg)
+		return
+	}
+	converted := op.convert(msg.Data)
+	if converted == nil {
+		op.distribute(msg)
+		return
+	}
+	for _, data := range converted {
+		op.distribute(gomidi.NewMessage(data))
+	}
+}
+
+func (op *ControllerMapper) Info() string {
+	s := op.commonInfo()
+	s += "\tmappings: "
+	rows := op.Mappings()
+	if len(rows) == 0 {
+		s += "<none>\n"
+	} else {
+		s += "(channel source dest in-low in-high out-low out-high)\n"
+		for i, row := range rows {
+			s += fmt.Sprintf("\t\t[%2d] %s\n", i, row)
+		}
+	}
+	return s
+}
+
+
+func (op *ControllerMapper) initLocalHandlers() {
+
+	// op name, add-map, channel|all, source, dest [, in-low, in-high, out-low, out-high]
+	// Returns row index.
+	//
+	remoteAddMap := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("ossss", msg)
+		if err != nil {
+			return empty, err
+		}
+		channel, err := parseCurveChannel(args[2].S)
+		if err != nil {
+			return empty, err
+		}
+		ranges := make([]int, 0, 4)
+		if len(msg.Arguments) > 5 {
+			rargs, err := ExpectMsg("ossssiiii", msg)
+			if err != nil {
+				return empty, err
+			}
+			for _, r := range rargs[5:] {
+				ranges = append(ranges, int(r.I))
+			}
+		}
+		index, err := op.AddMapping(channel, args[3].S, args[4].S, ranges...)
+		if err != nil {
+			return empty, err
+		}
+		return []string{fmt.Sprintf("%d", index)}, err
+	}
+
+	// op name, remove-map, index
+	//
+	remoteRemoveMap := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.RemoveMapping(int(args[2].I))
+		return empty, err
+	}
+
+	// op name, clear-maps
+	//
+	remoteClearMaps := func(msg *goosc.Message)([]string, error) {
+		var err error
+		op.ClearMappings()
+		return empty, err
+	}
+
+	// op name, q-maps
+	// Returns list of rows as 'channel source dest in-low in-high out-low out-high'
+	//
+	remoteQueryMaps := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return op.Mappings(), err
+	}
+
+	op.addCommandHandler("add-map", remoteAddMap)
+	op.addCommandHandler("remove-map", remoteRemoveMap)
+	op.addCommandHandler("clear-maps", remoteClearMaps)
+	op.addCommandHandler("q-maps", remoteQueryMaps)
+}
+
+
+type ctrlMappingSession struct {
+	Channel int     `json:"channel"`
+	Source string   `json:"source"`
+	Dest string     `json:"dest"`
+	Ranges []int    `json:"ranges"`
+}
+
+func (op *ControllerMapper) sessionState() interface{} {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	acc := make([]ctrlMappingSession, len(op.mappings))
+	for i, m := range op.mappings {
+		ranges := []int{m.inLow, m.inHigh, m.outLow, m.outHigh}
+		acc[i] = ctrlMappingSession{int(m.channel), m.source.String(), m.dest.String(), ranges}
+	}
+	return acc
+}
+
+func (op *ControllerMapper) restoreSessionState(data json.RawMessage) error {
+	var state []ctrlMappingSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	op.ClearMappings()
+	for _, m := range state {
+		_, err = op.AddMapping(midi.MIDIChannel(m.Channel), m.Source, m.Dest, m.Ranges...)
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
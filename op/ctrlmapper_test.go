@@ -0,0 +1,69 @@
+package op
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestControllerMapper(t *testing.T) {
+	mapper := newControllerMapper("mapper")
+	out := newCollectingOperator("out")
+	mapper.Connect(out)
+
+	// Unmapped messages pass unchanged.
+	sendBytes(mapper, 0xB0, 74, 64)
+	sendBytes(mapper, 0x90, 60, 100)
+	expectMessages(t, out, []byte{0xB0, 74, 64}, []byte{0x90, 60, 100})
+
+	if _, err := mapper.AddMapping(0, "cc128", "cc1"); err == nil {
+		t.Fatal("Expected error for controller 128")
+	}
+	if _, err := mapper.AddMapping(0, "cc1", "bend", 0, 127, 0, 16384); err == nil {
+		t.Fatal("Expected error for out of range bend value")
+	}
+	if _, err := mapper.AddMapping(0, "cc1", "cc2", 0, 127); err == nil {
+		t.Fatal("Expected error for partial range")
+	}
+
+	mapper.AddMapping(3, "cc74", "cc74", 0, 127, 20, 100)
+	mapper.AddMapping(0, "cc1", "cc11")
+	mapper.AddMapping(0, "cc1", "bend", 0, 127, 8192, 16383)
+	mapper.AddMapping(0, "pressure", "cc7", 0, 127, 127, 0)
+	mapper.AddMapping(0, "bend", "program", 8192, 16383, 0, 127)
+
+	sendBytes(mapper, 0xB2, 74, 127)
+	sendBytes(mapper, 0xB2, 74, 0)
+	sendBytes(mapper, 0xB0, 74, 127)
+	expectMessages(t, out, []byte{0xB2, 74, 100}, []byte{0xB2, 74, 20}, []byte{0xB0, 74, 127})
+
+	sendBytes(mapper, 0xB5, 1, 127)
+	expectMessages(t, out, []byte{0xB5, 11, 127}, []byte{0xE5, 0x7F, 0x7F})
+
+	sendBytes(mapper, 0xD0, 100)
+	expectMessages(t, out, []byte{0xB0, 7, 27})
+
+	sendBytes(mapper, 0xE1, 0x00, 0x20) // below input range, clamped
+	sendBytes(mapper, 0xE1, 0x7F, 0x7F)
+	expectMessages(t, out, []byte{0xC1, 0}, []byte{0xC1, 127})
+
+	// Session round trip
+	data, _ := json.Marshal(mapper.sessionState())
+	restored := newControllerMapper("restored")
+	if err := restored.restoreSessionState(data); err != nil {
+		t.Fatal(err)
+	}
+	expect, got := mapper.Mappings(), restored.Mappings()
+	if len(got) != len(expect) || got[0] != expect[0] || got[0] != "3 cc74 cc74 0 127 20 100" {
+		t.Fatalf("Session not restored, expected %v, got %v", expect, got)
+	}
+
+	if err := mapper.RemoveMapping(5); err == nil {
+		t.Fatal("Expected error for mapping index 5")
+	}
+	mapper.RemoveMapping(0)
+	sendBytes(mapper, 0xB2, 74, 127)
+	expectMessages(t, out, []byte{0xB2, 74, 127})
+	mapper.Reset()
+	sendBytes(mapper, 0xB5, 1, 127)
+	expectMessages(t, out, []byte{0xB5, 1, 127})
+}
@@ -0,0 +1,545 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+const (
+	DELAY_DEFAULT_TIME = 250.0  // msec
+	DELAY_MIN_TIME = 1.0
+	DELAY_MAX_TIME = 10000.0
+	DELAY_DEFAULT_REPEATS = 3
+	DELAY_MAX_REPEATS = 32
+	DELAY_DEFAULT_DECAY = 0.7
+	DELAY_MAX_TRANSPOSE = 24
+	DELAY_DEFAULT_TEMPO = 120.0
+)
+
+// delayedNote is a single scheduled repeat of a NOTE_ON.
+//
+type delayedNote struct {
+	key byte
+	when time.Time
+	repeat int
+}
+
+// Delay is an Operator which repeats notes as echoes.
+//
+// Each NOTE_ON is repeated a number of times, every repeat is delayed by
+// the delay time, its velocity scaled by the decay and its key shifted by
+// the transposition.  Repeats whose velocity falls below 1, or key leaves
+// the MIDI range, are dropped.  The delay time is given either in
+// milliseconds or as a note value at the Delay's tempo.
+//
+// A NOTE_OFF is repeated for each repeat of its NOTE_ON, and never before
+// it.  Where repeats overlap a shared key is turned off when the last of
+// them is released.
+//
+// Repeats are timed by the shared scheduler.  All messages, including
+// the original notes, are passed immediately unless dry output is
+// disabled, in which case only repeats are sent.
+//
+type Delay struct {
+	baseOperator
+	lock sync.Mutex
+	delayTime float64   // msec, used if noteValue is ""
+	noteValue string
+	noteClocks int
+	tempo float64
+	repeats int
+	decay float64
+	transpose int
+	dry bool
+	held map[int][][]delayedNote   // indexed by channel * 128 + key
+	sounding midi.NoteQueue
+	generation uint64
+}
+
+func newDelay(name string) *Delay {
+	op := new(Delay)
+	initOperator(&op.baseOperator, "Delay", name, midi.NoChannel)
+	op.sounding = *midi.MakeNoteQueue()
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() cancels all repeats and restores default settings.
+//
+func (op *Delay) Reset() {
+	op.lock.Lock()
+	op.stop()
+	op.delayTime = DELAY_DEFAULT_TIME
+	op.noteValue = ""
+	op.tempo = DELAY_DEFAULT_TEMPO
+	op.repeats = DELAY_DEFAULT_REPEATS
+	op.decay = DELAY_DEFAULT_DECAY
+	op.transpose = 0
+	op.dry = true
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+func (op *Delay) Panic() {
+	op.lock.Lock()
+	op.stop()
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Panic()
+}
+
+func (op *Delay) Close() {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.stop()
+}
+
+// op.stop() cancels scheduled repeats and turns off sounding repeats.
+// The lock must be held by the caller.
+//
+func (op *Delay) stop() {
+	op.generation++
+	sharedScheduler.cancel(op)
+	for _, off := range op.sounding.OffEvents() {
+		op.distribute(off)
+	}
+	op.sounding.Reset()
+	op.held = make(map[int][][]delayedNote)
+}
+
+// op.interval() returns the current delay between repeats.
+// The lock must be held by the caller.
+//
+func (op *Delay) interval() time.Duration {
+	if op.noteValue != "" {
+		return clockDuration(op.noteClocks, op.tempo)
+	}
+	return time.Duration(op.delayTime * float64(time.Millisecond))
+}
+
+// op.SetDelayTime() sets delay in milliseconds.
+//
+func (op *Delay) SetDelayTime(msec float64) error {
+	var err error
+	if msec < DELAY_MIN_TIME || DELAY_MAX_TIME < msec {
+		errmsg := "Expected delay time between %.0f and %.0f msec, got %f"
+		err = fmt.Errorf(errmsg, DELAY_MIN_TIME, DELAY_MAX_TIME, msec)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.delayTime = msec
+	op.noteValue = ""
+	return err
+}
+
+// op.SetDelayNote() sets delay as a note value at the Delay's tempo,
+// for example 1/8 or 1/8. (dotted eighth).
+//
+func (op *Delay) SetDelayNote(value string) error {
+	clocks, err := parseNoteValue(value)
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.noteValue = strings.ToLower(strings.TrimSpace(value))
+	op.noteClocks = clocks
+	return err
+}
+
+// op.Delay() returns the delay setting, note value or time in msec, and
+// the current delay in msec.
+//
+func (op *Delay) Delay() (setting string, msec float64) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	msec = float64(op.interval()) / float64(time.Millisecond)
+	if op.noteValue != "" {
+		return op.noteValue, msec
+	}
+	return fmt.Sprintf("%.1f", op.delayTime), msec
+}
+
+// op.SetTempo() sets tempo in BPM, used with note value delays.
+//
+func (op *Delay) SetTempo(tempo float64) error {
+	err := validateTempo(tempo)
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.tempo = tempo
+	return err
+}
+
+func (op *Delay) Tempo() float64 {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.tempo
+}
+
+// op.SetRepeats() sets number of repeats, 0 <= n <= DELAY_MAX_REPEATS.
+//
+func (op *Delay) SetRepeats(n int) error {
+	var err error
+	if n < 0 || DELAY_MAX_REPEATS < n {
+		errmsg := "Expected repeats between 0 and %d, got %d"
+		err = fmt.Errorf(errmsg, DELAY_MAX_REPEATS, n)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.repeats = n
+	return err
+}
+
+func (op *Delay) Repeats() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.repeats
+}
+
+// op.SetDecay() sets velocity scale applied at each repeat, 0 < decay <= 1.
+//
+func (op *Delay) SetDecay(decay float64) error {
+	var err error
+	if decay <= 0 || 1 < decay {
+		errmsg := "Expected decay 0 < decay <= 1, got %f"
+		err = fmt.Errorf(errmsg, decay)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.decay = decay
+	return err
+}
+
+func (op *Delay) Decay() float64 {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.decay
+}
+
+// op.SetTranspose() sets key shift in semitones applied at each repeat.
+//
+func (op *Delay) SetTranspose(n int) error {
+	var err error
+	if n < -DELAY_MAX_TRANSPOSE || DELAY_MAX_TRANSPOSE < n {
+		errmsg := "Expected transpose between -%d and %d, got %d"
+		err = fmt.Errorf(errmsg, DELAY_MAX_TRANSPOSE, DELAY_MAX_TRANSPOSE, n)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.transpose = n
+	return err
+}
+
+func (op *Delay) Transpose() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.transpose
+}
+
+// op.EnableDry() sets whether incoming messages are passed immediately.
+//
+func (op *Delay) EnableDry(flag bool) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.dry = flag
+}
+
+func (op *Delay) DryEnabled() bool {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.dry
+}
+
+// op.schedule() schedules a repeat message.
+// NOTE_OFF is only sent once no other repeat holds the key.
+// The lock must be held by the caller.
+//
+func (op *Delay) schedule(when time.Time, data []byte) {
+	generation := op.generation
+	msg := gomidi.NewMessage(data)
+	sharedScheduler.schedule(when, op, func() {
+		op.lock.Lock()
+		defer op.lock.Unlock()
+		if generation != op.generation {
+			return
+		}
+		op.sounding.Update(msg)
+		if midi.IsNoteOff(msg) && op.sounding.OpenCount(data[0] & 0x0F, data[1]) > 0 {
+			return
+		}
+		op.distribute(msg)
+	})
+}
+
+// op.noteOn() schedules repeats of a NOTE_ON.
+// The lock must be held by the caller.
+//
+func (op *Delay) noteOn(d []byte, now time.Time) {
+	interval := op.interval()
+	repeats := make([]delayedNote, 0, op.repeats)
+	for r := 1; r <= op.repeats; r++ {
+		key := int(d[1]) + r * op.transpose
+		velocity := math.Round(float64(d[2]) * math.Pow(op.decay, float64(r)))
+		if key < 0 || 127 < key || velocity < 1 {
+			break
+		}
+		when := now.Add(time.Duration(r) * interval)
+		repeats = append(repeats, delayedNote{byte(key), when, r})
+		op.schedule(when, []byte{d[0], byte(key), byte(velocity)})
+	}
+	index := noteMapIndex(d)
+	op.held[index] = append(op.held[index], repeats)
+}
+
+// op.noteOff() schedules NOTE_OFF for each repeat of the oldest matching
+// NOTE_ON.
+// The lock must be held by the caller.
+//
+func (op *Delay) noteOff(d []byte, now time.Time) {
+	index := noteMapIndex(d)
+	held := op.held[index]
+	if len(held) == 0 {
+		return
+	}
+	if len(held) == 1 {
+		delete(op.held, index)
+	} else {
+		op.held[index] = held[1:]
+	}
+	interval := op.interval()
+	st := byte(midi.NOTE_OFF) | (d[0] & 0x0F)
+	for _, n := range held[0] {
+		when := now.Add(time.Duration(n.repeat) * interval)
+		if when.Before(n.when) {
+			when = n.when
+		}
+		op.schedule(when, []byte{st, n.key, d[2]})
+	}
+}
+
+func (op *Delay) Send(msg gomidi.Message) {
+	now := time.Now()
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	switch {
+	case midi.IsNoteOn(msg):
+		op.noteOn(msg.Data, now)
+	case midi.IsNoteOff(msg):
+		op.noteOff(msg.Data, now)
+	}
+	if op.dry {
+		op.distribute(msg)
+	}
+}
+
+func (op *Delay) Info() string {
+	s := op.commonInfo()
+	setting, msec := op.Delay()
+	s += fmt.Sprintf("\tdelay: %s (%.1f msec)  tempo: %.1f\n", setting, msec, op.Tempo())
+	s += fmt.Sprintf("\trepeats: %d  decay: %.2f  transpose: %d\n", op.Repeats(), op.Decay(), op.Transpose())
+	s += fmt.Sprintf("\tdry: %v\n", op.DryEnabled())
+	return s
+}
+
+
+func (op *Delay) initLocalHandlers() {
+
+	// op name, set-delay-time, msec
+	//
+	remoteSetDelayTime := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetDelayTime(args[2].F)
+		return empty, err
+	}
+
+	// op name, set-delay-note, note-value
+	//
+	remoteSetDelayNote := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetDelayNote(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-delay
+	// Returns delay setting, note value or msec, and current delay in msec.
+	//
+	remoteQueryDelay := func(msg *goosc.Message)([]string, error) {
+		var err error
+		setting, msec := op.Delay()
+		return []string{setting, fmt.Sprintf("%.1f", msec)}, err
+	}
+
+	// op name, set-tempo, bpm
+	//
+	remoteSetTempo := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetTempo(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-tempo
+	//
+	remoteQueryTempo := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%.3f", op.Tempo())}, err
+	}
+
+	// op name, set-repeats, n
+	//
+	remoteSetRepeats := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetRepeats(int(args[2].I))
+		return empty, err
+	}
+
+	// op name, q-repeats
+	//
+	remoteQueryRepeats := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.Repeats())}, err
+	}
+
+	// op name, set-decay, scale
+	//
+	remoteSetDecay := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetDecay(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-decay
+	//
+	remoteQueryDecay := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%.3f", op.Decay())}, err
+	}
+
+	// op name, set-transpose, semitones
+	//
+	remoteSetTranspose := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetTranspose(int(args[2].I))
+		return empty, err
+	}
+
+	// op name, q-transpose
+	//
+	remoteQueryTranspose := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.Transpose())}, err
+	}
+
+	// op name, pass-dry, bool
+	//
+	remotePassDry := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osb", msg)
+		if err != nil {
+			return empty, err
+		}
+		op.EnableDry(args[2].B)
+		return empty, err
+	}
+
+	// op name, q-pass-dry
+	//
+	remoteQueryDry := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%v", op.DryEnabled())}, err
+	}
+
+	op.addCommandHandler("set-delay-time", remoteSetDelayTime)
+	op.addCommandHandler("set-delay-note", remoteSetDelayNote)
+	op.addCommandHandler("q-delay", remoteQueryDelay)
+	op.addCommandHandler("set-tempo", remoteSetTempo)
+	op.addCommandHandler("q-tempo", remoteQueryTempo)
+	op.addCommandHandler("set-repeats", remoteSetRepeats)
+	op.addCommandHandler("q-repeats", remoteQueryRepeats)
+	op.addCommandHandler("set-decay", remoteSetDecay)
+	op.addCommandHandler("q-decay", remoteQueryDecay)
+	op.addCommandHandler("set-transpose", remoteSetTranspose)
+	op.addCommandHandler("q-transpose", remoteQueryTranspose)
+	op.addCommandHandler("pass-dry", remotePassDry)
+	op.addCommandHandler("q-pass-dry", remoteQueryDry)
+}
+
+
+type delaySession struct {
+	DelayTime float64   `json:"delay-time"`
+	NoteValue string    `json:"note-value"`
+	Tempo float64       `json:"tempo"`
+	Repeats int         `json:"repeats"`
+	Decay float64       `json:"decay"`
+	Transpose int       `json:"transpose"`
+	Dry bool            `json:"dry"`
+}
+
+func (op *Delay) sessionState() interface{} {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return &delaySession{op.delayTime, op.noteValue, op.tempo, op.repeats,
+		op.decay, op.transpose, op.dry}
+}
+
+func (op *Delay) restoreSessionState(data json.RawMessage) error {
+	var state delaySession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	if err = op.SetDelayTime(state.DelayTime); err != nil {
+		return err
+	}
+	if state.NoteValue != "" {
+		if err = op.SetDelayNote(state.NoteValue); err != nil {
+			return err
+		}
+	}
+	if err = op.SetTempo(state.Tempo); err != nil {
+		return err
+	}
+	if err = op.SetRepeats(state.Repeats); err != nil {
+		return err
+	}
+	if err = op.SetDecay(state.Decay); err != nil {
+		return err
+	}
+	if err = op.SetTranspose(state.Transpose); err != nil {
+		return err
+	}
+	op.EnableDry(state.Dry)
+	return err
+}
@@ -0,0 +1,109 @@
+package op
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDelayRepeats(t *testing.T) {
+	delay := newDelay("delay")
+	defer delay.Close()
+	out := newCollectingOperator("out")
+	delay.Connect(out)
+	delay.SetDelayTime(10)
+	delay.SetRepeats(3)
+	delay.SetDecay(0.5)
+	delay.SetTranspose(12)
+	delay.EnableDry(false)
+
+	// Times in the past run immediately, in time order.  The lock holds
+	// the scheduler until all events are queued.
+	start := time.Now().Add(-time.Second)
+	delay.lock.Lock()
+	delay.noteOn([]byte{0x90, 60, 100}, start)
+	delay.noteOff([]byte{0x80, 60, 0}, start.Add(5 * time.Millisecond))
+	delay.lock.Unlock()
+	waitForScheduler(t, delay)
+	expectMessages(t, out,
+		[]byte{0x90, 72, 50}, []byte{0x80, 72, 0},
+		[]byte{0x90, 84, 25}, []byte{0x80, 84, 0},
+		[]byte{0x90, 96, 13}, []byte{0x80, 96, 0})
+
+	// Repeats end when velocity or key leave range.
+	delay.SetTranspose(-24)
+	delay.lock.Lock()
+	delay.noteOn([]byte{0x90, 40, 3}, start)
+	delay.noteOff([]byte{0x80, 40, 0}, start)
+	delay.lock.Unlock()
+	waitForScheduler(t, delay)
+	expectMessages(t, out, []byte{0x90, 16, 2}, []byte{0x80, 16, 0})
+
+	// Overlapping repeats of a key are turned off by the last one.
+	delay.SetTranspose(0)
+	delay.SetDecay(1)
+	delay.SetRepeats(2)
+	delay.lock.Lock()
+	delay.noteOn([]byte{0x90, 60, 100}, start)
+	delay.noteOff([]byte{0x80, 60, 0}, start.Add(15 * time.Millisecond))
+	delay.lock.Unlock()
+	waitForScheduler(t, delay)
+	expectMessages(t, out,
+		[]byte{0x90, 60, 100}, []byte{0x90, 60, 100}, []byte{0x80, 60, 0})
+
+	// A shorter delay never moves a note off before its note on.
+	delay.SetRepeats(1)
+	delay.lock.Lock()
+	delay.noteOn([]byte{0x90, 60, 100}, start)
+	delay.delayTime = 1
+	delay.noteOff([]byte{0x80, 60, 0}, start)
+	delay.lock.Unlock()
+	waitForScheduler(t, delay)
+	expectMessages(t, out, []byte{0x90, 60, 100}, []byte{0x80, 60, 0})
+}
+
+func TestDelaySend(t *testing.T) {
+	delay := newDelay("delay")
+	defer delay.Close()
+	out := newCollectingOperator("out")
+	delay.Connect(out)
+	if err := delay.SetDelayNote("1/32"); err != nil {
+		t.Fatal(err)
+	}
+	if err := delay.SetTempo(300); err != nil {
+		t.Fatal(err)
+	}
+	if _, msec := delay.Delay(); msec != 25 {
+		t.Fatalf("Expected 25 msec delay, got %f", msec)
+	}
+	sendBytes(delay, 0x90, 60, 100)
+	sendBytes(delay, 0xB0, 7, 100)
+	expectMessages(t, out, []byte{0x90, 60, 100}, []byte{0xB0, 7, 100})
+	sendBytes(delay, 0x80, 60, 0)
+	waitForScheduler(t, delay)
+	got := out.take()
+	if len(got) != 7 {
+		t.Fatalf("Expected note off and 3 repeats, got %v", got)
+	}
+
+	// Panic cancels pending repeats and turns off sounding ones.
+	delay.SetDelayTime(1000)
+	delay.SetRepeats(1)
+	sendBytes(delay, 0x90, 60, 100)
+	out.take()
+	delay.Panic()
+	if sharedScheduler.pending(delay) != 0 {
+		t.Fatal("Panic left repeats pending")
+	}
+
+	// Session round trip
+	delay.SetDelayNote("1/8.")
+	data, _ := json.Marshal(delay.sessionState())
+	restored := newDelay("restored")
+	if err := restored.restoreSessionState(data); err != nil {
+		t.Fatal(err)
+	}
+	if setting, _ := restored.Delay(); setting != "1/8." || restored.Repeats() != 1 {
+		t.Fatalf("Session not restored: %s", restored.Info())
+	}
+}
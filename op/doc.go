@@ -13,6 +13,13 @@
 ** The baseXformOperator, implemented in tbase.go, extends baseOperator to
 ** implement midi.Transform interface.
 **
+** The registry and operator connections may be changed from any goroutine.
+** Connections are held in copy-on-write tables (see base.go) so MIDI
+** messages are delivered without locking while the graph is edited.
+**
+** Operators which produce messages at a later time use the shared
+** scheduler (see scheduler.go) rather than their own goroutines.
+**
 */
 
 package op
@@ -0,0 +1,146 @@
+package op
+
+/*
+** graph.go defines export of the MIDI process graph as Graphviz DOT or JSON.
+**
+** Each operator appears exactly once, regardless of how many roots it is
+** reachable from.  Nodes and edges are sorted by name so exported graphs
+** may be compared with diff.
+**
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"github.com/plewto/pigiron/midi"
+	"github.com/plewto/pigiron/pigpath"
+)
+
+type graphNode struct {
+	Name string          `json:"name"`
+	Type string          `json:"type"`
+	ChannelMode string   `json:"channel-mode"`
+	Channels []int       `json:"channels,omitempty"`
+	Enabled bool         `json:"midi-enabled"`
+	Device string        `json:"device,omitempty"`
+}
+
+type graphEdge struct {
+	Parent string `json:"parent"`
+	Child string  `json:"child"`
+}
+
+type graph struct {
+	Nodes []graphNode  `json:"nodes"`
+	Edges []graphEdge  `json:"edges"`
+}
+
+// captureGraph returns all operators and connections.
+//
+func captureGraph() *graph {
+	g := &graph{make([]graphNode, 0), make([]graphEdge, 0)}
+	for _, op := range sortedOperators() {
+		node := graphNode{
+			Name: op.Name(),
+			Type: op.OperatorType(),
+			ChannelMode: op.ChannelMode().String(),
+			Enabled: op.MIDIOutputEnabled()}
+		if op.ChannelMode() != midi.NoChannel {
+			for _, ci := range op.SelectedChannelIndexes() {
+				node.Channels = append(node.Channels, int(ci) + 1)
+			}
+		}
+		if dev, ok := op.(deviceOperator); ok {
+			node.Device = dev.DeviceName()
+		}
+		g.Nodes = append(g.Nodes, node)
+		for _, child := range sortedNames(op.Children()) {
+			g.Edges = append(g.Edges, graphEdge{op.Name(), child})
+		}
+	}
+	return g
+}
+
+// dotEscape returns s with DOT string special characters escaped.
+//
+func dotEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+// dotQuote returns s as a quoted DOT identifier.
+//
+func dotQuote(s string) string {
+	return `"` + dotEscape(s) + `"`
+}
+
+func (g *graph) dot() string {
+	acc := "digraph pigiron {\n"
+	acc += "\trankdir=LR;\n"
+	acc += "\tnode [shape=box];\n"
+	for _, node := range g.Nodes {
+		label := []string{dotEscape(node.Name), node.Type}
+		if len(node.Channels) > 0 {
+			chans := make([]string, len(node.Channels))
+			for i, c := range node.Channels {
+				chans[i] = fmt.Sprintf("%d", c)
+			}
+			label = append(label, fmt.Sprintf("%s %s", node.ChannelMode, strings.Join(chans, ",")))
+		} else if node.ChannelMode != midi.NoChannel.String() {
+			label = append(label, node.ChannelMode + " none")
+		}
+		if node.Device != "" {
+			label = append(label, "device: " + dotEscape(node.Device))
+		}
+		style := ""
+		if !node.Enabled {
+			style = ", style=dashed"
+		}
+		acc += fmt.Sprintf("\t%s [label=\"%s\"%s];\n", dotQuote(node.Name), strings.Join(label, `\n`), style)
+	}
+	for _, edge := range g.Edges {
+		acc += fmt.Sprintf("\t%s -> %s;\n", dotQuote(edge.Parent), dotQuote(edge.Child))
+	}
+	acc += "}\n"
+	return acc
+}
+
+// ExportGraph returns the process graph in the given format, either
+// "dot" for Graphviz or "json".
+//
+func ExportGraph(format string) (string, error) {
+	var err error
+	g := captureGraph()
+	switch strings.ToLower(format) {
+	case "dot":
+		return g.dot(), err
+	case "json":
+		var data []byte
+		data, err = json.MarshalIndent(g, "", "  ")
+		return string(data) + "\n", err
+	default:
+		errmsg := "Expected graph format dot or json, got '%s'"
+		err = fmt.Errorf(errmsg, format)
+		return "", err
+	}
+}
+
+// ExportGraphFile writes the process graph to a file.
+// The filename may use the special directory prefixes ~/ and !/
+// Returns the expanded filename.
+//
+func ExportGraphFile(format string, filename string) (string, error) {
+	filename = pigpath.SubSpecialDirectories(filename)
+	text, err := ExportGraph(format)
+	if err != nil {
+		return filename, err
+	}
+	err = ioutil.WriteFile(filename, []byte(text), 0644)
+	if err != nil {
+		errmsg := "Can not write graph file: '%s'\n%s"
+		err = fmt.Errorf(errmsg, filename, err)
+	}
+	return filename, err
+}
@@ -0,0 +1,97 @@
+package op
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// buildTestGraph creates three operators with connections
+//
+//     filter -> delay -> mon "a"
+//     filter -> mon "a"
+//
+func buildTestGraph(t *testing.T) {
+	t.Helper()
+	filter, err := NewOperator("ChannelFilter", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delay, err := NewOperator("Delay", "delay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon, err := NewOperator("Monitor", `mon "a"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon.DeselectAllChannels()
+	mon.EnableChannel(16, true)
+	filter.DeselectAllChannels()
+	filter.EnableChannel(1, true)
+	filter.EnableChannel(3, true)
+	delay.SetMIDIOutputEnabled(false)
+	for _, edge := range [][2]Operator{{filter, delay}, {filter, mon}, {delay, mon}} {
+		if err = edge[0].Connect(edge[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportGraphDot(t *testing.T) {
+	defer ClearRegistry()
+	buildTestGraph(t)
+	text, err := ExportGraph("DOT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "digraph pigiron {\n" +
+		"\trankdir=LR;\n" +
+		"\tnode [shape=box];\n" +
+		"\t\"delay\" [label=\"delay\\nDelay\", style=dashed];\n" +
+		"\t\"filter\" [label=\"filter\\nChannelFilter\\nMultiChannel 1,3\"];\n" +
+		"\t\"mon \\\"a\\\"\" [label=\"mon \\\"a\\\"\\nMonitor\\nMultiChannel 16\"];\n" +
+		"\t\"delay\" -> \"mon \\\"a\\\"\";\n" +
+		"\t\"filter\" -> \"delay\";\n" +
+		"\t\"filter\" -> \"mon \\\"a\\\"\";\n" +
+		"}\n"
+	if text != expect {
+		t.Fatalf("Expected DOT graph\n%s\ngot\n%s", expect, text)
+	}
+}
+
+func TestExportGraphJSON(t *testing.T) {
+	defer ClearRegistry()
+	buildTestGraph(t)
+	filename, err := ExportGraphFile("json", filepath.Join(t.TempDir(), "graph.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g graph
+	if err = json.Unmarshal(data, &g); err != nil {
+		t.Fatal(err)
+	}
+	nodes := []graphNode{
+		{Name: "delay", Type: "Delay", ChannelMode: "NoChannel", Enabled: false},
+		{Name: "filter", Type: "ChannelFilter", ChannelMode: "MultiChannel", Channels: []int{1, 3}, Enabled: true},
+		{Name: `mon "a"`, Type: "Monitor", ChannelMode: "MultiChannel", Channels: []int{16}, Enabled: true}}
+	edges := []graphEdge{
+		{"delay", `mon "a"`},
+		{"filter", "delay"},
+		{"filter", `mon "a"`}}
+	if !reflect.DeepEqual(g.Nodes, nodes) {
+		t.Fatalf("Expected nodes %v, got %v", nodes, g.Nodes)
+	}
+	if !reflect.DeepEqual(g.Edges, edges) {
+		t.Fatalf("Expected edges %v, got %v", edges, g.Edges)
+	}
+	if _, err = ExportGraph("svg"); err == nil {
+		t.Fatal("Expected error for graph format svg")
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/plewto/pigiron/help"
 	"github.com/plewto/pigiron/macro"
 	"github.com/plewto/pigiron/backend"
+	"github.com/plewto/pigiron/pigpath"
 )
 
 var empty []string
@@ -34,6 +35,8 @@ func Init() {
 	osc.AddHandler(server, "new", remoteNewOperator)
 	osc.AddHandler(server, "del-op", remoteDeleteOperator)
 	osc.AddHandler(server, "del-all", remoteDeleteAllOperators)
+	osc.AddHandler(server, "save-session", remoteSaveSession)
+	osc.AddHandler(server, "load-session", remoteLoadSession)
 	osc.AddHandler(server, "connect", remoteConnect)
 	osc.AddHandler(server, "disconnect-child", remoteDisconnect)
 	osc.AddHandler(server, "disconnect-all", remoteDisconnectAll)
@@ -42,6 +45,8 @@ func Init() {
 	osc.AddHandler(server, "reset-all", remoteResetAll)  
 	osc.AddHandler(server, "enable-midi", remoteEnableMIDI)
 	osc.AddHandler(server, "q-midi-enabled", remoteQueryMIDIEnabled)
+	osc.AddHandler(server, "set-queue", remoteSetQueue)
+	osc.AddHandler(server, "q-queue", remoteQueryQueue)
 	osc.AddHandler(server, "q-channel-mode", remoteQueryChannelMode)
 	osc.AddHandler(server, "q-channels", remoteQuerySelectedChannels)
 	osc.AddHandler(server, "q-channel-selected", remoteQueryChannelSelected)
@@ -55,9 +60,11 @@ func Init() {
 	osc.AddHandler(server, "q-operators", remoteQueryOperators)
 	osc.AddHandler(server, "q-roots", remoteQueryRoots)
 	osc.AddHandler(server, "q-graph", remoteQueryGraph)
+	osc.AddHandler(server, "export-graph", remoteExportGraph)
 	osc.AddHandler(server, "q-commands", remoteQueryCommands)
 	osc.AddHandler(server, "q-children", remoteQueryChildren)
 	osc.AddHandler(server, "q-parents", remoteQueryParents)
+	osc.AddHandler(server, "q-path", remoteQueryPath)
 	osc.AddHandler(server, "info", remotePrintInfo)
 	osc.AddHandler(server, "print-config", remotePrintConfig)
 	osc.AddHandler(server, "midi", remoteMIDIInsert)
@@ -263,7 +270,6 @@ func remoteEnableMIDI(msg *goosc.Message)([]string, error) {
 	op.SetMIDIOutputEnabled(flag)
 	rs := []string{fmt.Sprintf("%v", flag)}
 	return rs, err
-	return empty, err
 }
 
 // remoteQueryMIDIEnabled() handler for /pig/q-midi-enabled
@@ -282,6 +288,56 @@ func remoteQueryMIDIEnabled(msg *goosc.Message)([]string, error) {
 }
 
 
+// remoteSetQueue() handler for /pig/set-queue
+// Sets operator message queue depth and overflow policy.
+// A depth of 0 removes the queue.
+// osc /pig/set-queue <name>, <depth> [, <policy>]
+// osc returns depth and policy.
+//
+func remoteSetQueue(msg *goosc.Message)([]string, error) {
+	args, err := ExpectMsg("oi", msg)
+	if err != nil {
+		return empty, err
+	}
+	op := args[0].O
+	depth := int(args[1].I)
+	policy := QUEUE_DROP_OLDEST
+	if len(msg.Arguments) > 2 {
+		args, err = ExpectMsg("ois", msg)
+		if err != nil {
+			return empty, err
+		}
+		policy, err = ParseQueuePolicy(args[2].S)
+		if err != nil {
+			return empty, err
+		}
+	}
+	err = op.SetQueue(depth, policy)
+	if err != nil {
+		return empty, err
+	}
+	return []string{fmt.Sprintf("%d", depth), policy.String()}, err
+}
+
+// remoteQueryQueue() handler for /pig/q-queue
+// osc /pig/q-queue <name>
+// osc returns queue depth, policy, pending message count and drop count.
+//
+func remoteQueryQueue(msg *goosc.Message)([]string, error) {
+	args, err := ExpectMsg("o", msg)
+	if err != nil {
+		return empty, err
+	}
+	depth, policy, pending, dropped := args[0].O.QueueState()
+	acc := []string{
+		fmt.Sprintf("%d", depth),
+		policy.String(),
+		fmt.Sprintf("%d", pending),
+		fmt.Sprintf("%d", dropped)}
+	return acc, err
+}
+
+
 // remoteQueryChannelMode() handler for /pig/q-midi-channel-mode
 // osc /pig/q-midi-channel-mode <name>
 // osc returns the ChannelSelector mode
@@ -677,6 +733,24 @@ func remoteQueryCommands(msg *goosc.Message)([]string, error) {
 	
 
 
+// remoteQueryPath() handler for /pig/q-path
+// Lists all routes between two operators.
+// osc /pig/q-path <from>, <to>
+// osc returns list of routes, "from -> a -> b -> to"
+//
+func remoteQueryPath(msg *goosc.Message)([]string, error) {
+	args, err := ExpectMsg("oo", msg)
+	if err != nil {
+		return empty, err
+	}
+	routes := Routes(args[0].O, args[1].O, false)
+	acc := make([]string, len(routes))
+	for i, route := range routes {
+		acc[i] = strings.Join(route, " -> ")
+	}
+	return acc, err
+}
+
 // remoteQueryChildren() handler for /pig/q-children
 // Prints list of operator's children.
 // osc /pig/q-children <name>
@@ -863,6 +937,68 @@ func remoteClearMacros(msg *goosc.Message)([]string, error) {
 	return empty, err
 }
 
+// remoteExportGraph() handler for /pig/export-graph
+// Exports the process graph as Graphviz DOT or JSON.
+// osc /pig/export-graph format [, filename]
+// osc returns ACK filename if a file is specified,
+//             otherwise the graph text, one line per value.
+//
+func remoteExportGraph(msg *goosc.Message)([]string, error) {
+	args, err := ExpectMsg("s", msg)
+	if err != nil {
+		return empty, err
+	}
+	format := args[0].S
+	if len(msg.Arguments) > 1 {
+		args, err = ExpectMsg("ss", msg)
+		if err != nil {
+			return empty, err
+		}
+		filename, err := ExportGraphFile(format, args[1].S)
+		if err != nil {
+			return empty, err
+		}
+		return []string{filename}, err
+	}
+	text, err := ExportGraph(format)
+	if err != nil {
+		return empty, err
+	}
+	return strings.Split(strings.TrimRight(text, "\n"), "\n"), err
+}
+
+// remoteSaveSession() handler for /pig/save-session
+// Saves all operators and connections.
+// osc /pig/save-session filename
+// osc returns ACK filename
+//
+func remoteSaveSession(msg *goosc.Message)([]string, error) {
+	args, err := ExpectMsg("s", msg)
+	if err != nil {
+		return empty, err
+	}
+	filename := pigpath.SubSpecialDirectories(args[0].S)
+	err = SaveSession(filename)
+	if err != nil {
+		return empty, err
+	}
+	return []string{filename}, err
+}
+
+// remoteLoadSession() handler for /pig/load-session
+// Replaces all operators and connections with a saved session.
+// osc /pig/load-session filename
+// osc returns ACK
+//
+func remoteLoadSession(msg *goosc.Message)([]string, error) {
+	args, err := ExpectMsg("s", msg)
+	if err != nil {
+		return empty, err
+	}
+	err = LoadSession(args[0].S)
+	return empty, err
+}
+
 func remoteDebug(msg *goosc.Message)([]string, error) {
 	var err error
 	return empty, err
@@ -0,0 +1,72 @@
+package op
+
+import (
+	"sync"
+	"testing"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	"github.com/plewto/pigiron/midi"
+)
+
+// collectingOperator saves copies of received messages.
+//
+type collectingOperator struct {
+	baseOperator
+	lock sync.Mutex
+	messages [][]byte
+}
+
+func newCollectingOperator(name string) *collectingOperator {
+	op := new(collectingOperator)
+	initOperator(&op.baseOperator, "Collector", name, midi.NoChannel)
+	return op
+}
+
+func (op *collectingOperator) Send(msg gomidi.Message) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.messages = append(op.messages, append([]byte(nil), msg.Data...))
+}
+
+// op.take() returns and clears received messages.
+//
+func (op *collectingOperator) take() [][]byte {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	acc := op.messages
+	op.messages = nil
+	return acc
+}
+
+// sendBytes sends a message with the given data to op.
+//
+func sendBytes(op Operator, data ...byte) {
+	op.Send(gomidi.NewMessage(data))
+}
+
+func expectMessages(t *testing.T, op *collectingOperator, expect ...[]byte) {
+	t.Helper()
+	got := op.take()
+	if len(got) != len(expect) {
+		t.Fatalf("%s: expected %v, got %v", op.Name(), expect, got)
+	}
+	for i := range got {
+		if string(got[i]) != string(expect[i]) {
+			t.Fatalf("%s: expected %v, got %v", op.Name(), expect, got)
+		}
+	}
+}
+
+// waitForScheduler waits until all scheduled events of owner have run.
+//
+func waitForScheduler(t *testing.T, owner interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for sharedScheduler.pending(owner) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Scheduled events still pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,517 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+const (
+	HUMANIZE_MAX_TIMING = 500.0  // msec
+	HUMANIZE_MAX_VELOCITY = 64
+	HUMANIZE_DEFAULT_GRID = "1/8"
+	HUMANIZE_DEFAULT_TEMPO = 120.0
+)
+
+// Humanizer is an Operator which adds random variation to note timing and
+// velocity, and optional swing.
+//
+// Each NOTE_ON is delayed by a random time up to the timing range, its
+// NOTE_OFF by the same time so note lengths are kept.  Notes are only
+// ever delayed.  NOTE_ON velocities are changed by a random amount up to
+// the velocity range, either way.  Messages for a key are never reordered.
+//
+// Swing delays NOTE_ON messages nearest the off-beat steps of a grid by a
+// fraction of the step.  The grid is anchored at the first NOTE_ON after
+// a reset, or at START.
+//
+// A non-zero seed makes the variation repeatable, the random sequence
+// restarts when the seed is set and on reset.
+//
+// Non-note messages are passed immediately.
+//
+type Humanizer struct {
+	baseOperator
+	lock sync.Mutex
+	timing float64      // msec
+	velocity int
+	seed int64          // 0 for non-repeatable
+	rng *rand.Rand
+	swing float64       // fraction of grid step
+	gridName string
+	grid int            // MIDI clocks per step
+	tempo float64
+	anchor time.Time    // grid origin, zero if not set
+	held map[int][]time.Duration   // NOTE_ON delays indexed by channel * 128 + key
+	last map[int]time.Time         // time of latest scheduled event per key
+	queued map[int]int             // scheduled events per key
+	sounding midi.NoteQueue
+	generation uint64
+}
+
+func newHumanizer(name string) *Humanizer {
+	op := new(Humanizer)
+	initOperator(&op.baseOperator, "Humanizer", name, midi.NoChannel)
+	op.sounding = *midi.MakeNoteQueue()
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() cancels scheduled notes and restores default settings.
+//
+func (op *Humanizer) Reset() {
+	op.lock.Lock()
+	op.stop()
+	op.timing = 0
+	op.velocity = 0
+	op.seed = 0
+	op.reseed()
+	op.swing = 0
+	op.gridName = HUMANIZE_DEFAULT_GRID
+	op.grid, _ = parseNoteValue(HUMANIZE_DEFAULT_GRID)
+	op.tempo = HUMANIZE_DEFAULT_TEMPO
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+func (op *Humanizer) Panic() {
+	op.lock.Lock()
+	op.stop()
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Panic()
+}
+
+func (op *Humanizer) Close() {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.stop()
+}
+
+// op.stop() cancels scheduled notes and turns off sounding notes.
+// The lock must be held by the caller.
+//
+func (op *Humanizer) stop() {
+	op.generation++
+	sharedScheduler.cancel(op)
+	for _, off := range op.sounding.OffEvents() {
+		op.distribute(off)
+	}
+	op.sounding.Reset()
+	op.held = make(map[int][]time.Duration)
+	op.last = make(map[int]time.Time)
+	op.queued = make(map[int]int)
+	op.anchor = time.Time{}
+}
+
+// op.reseed() restarts the random sequence.
+// The lock must be held by the caller.
+//
+func (op *Humanizer) reseed() {
+	seed := op.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	op.rng = rand.New(rand.NewSource(seed))
+}
+
+// op.SetTiming() sets maximum NOTE_ON delay in msec.
+//
+func (op *Humanizer) SetTiming(msec float64) error {
+	var err error
+	if msec < 0 || HUMANIZE_MAX_TIMING < msec {
+		errmsg := "Expected timing between 0 and %.0f msec, got %f"
+		err = fmt.Errorf(errmsg, HUMANIZE_MAX_TIMING, msec)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.timing = msec
+	return err
+}
+
+func (op *Humanizer) Timing() float64 {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.timing
+}
+
+// op.SetVelocity() sets maximum velocity change.
+//
+func (op *Humanizer) SetVelocity(n int) error {
+	var err error
+	if n < 0 || HUMANIZE_MAX_VELOCITY < n {
+		errmsg := "Expected velocity range between 0 and %d, got %d"
+		err = fmt.Errorf(errmsg, HUMANIZE_MAX_VELOCITY, n)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.velocity = n
+	return err
+}
+
+func (op *Humanizer) Velocity() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.velocity
+}
+
+// op.SetSeed() sets random seed and restarts the random sequence.
+// A seed of 0 is not repeatable.
+//
+func (op *Humanizer) SetSeed(seed int64) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.seed = seed
+	op.reseed()
+}
+
+func (op *Humanizer) Seed() int64 {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.seed
+}
+
+// op.SetSwing() sets the fraction of a grid step by which off-beat notes
+// are delayed, 0 <= swing < 1.
+//
+func (op *Humanizer) SetSwing(swing float64) error {
+	var err error
+	if swing < 0 || 1 <= swing {
+		errmsg := "Expected swing 0 <= swing < 1, got %f"
+		err = fmt.Errorf(errmsg, swing)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.swing = swing
+	return err
+}
+
+func (op *Humanizer) Swing() float64 {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.swing
+}
+
+// op.SetGrid() sets swing grid step as a note value, for example 1/8.
+//
+func (op *Humanizer) SetGrid(value string) error {
+	clocks, err := parseNoteValue(value)
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.grid = clocks
+	op.gridName = strings.ToLower(strings.TrimSpace(value))
+	return err
+}
+
+func (op *Humanizer) Grid() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.gridName
+}
+
+// op.SetTempo() sets swing grid tempo in BPM.
+//
+func (op *Humanizer) SetTempo(tempo float64) error {
+	err := validateTempo(tempo)
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.tempo = tempo
+	return err
+}
+
+func (op *Humanizer) Tempo() float64 {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.tempo
+}
+
+// op.swingDelay() returns swing delay for a NOTE_ON at time now.
+// The lock must be held by the caller.
+//
+func (op *Humanizer) swingDelay(now time.Time) time.Duration {
+	if op.swing == 0 {
+		return 0
+	}
+	if op.anchor.IsZero() {
+		op.anchor = now
+	}
+	step := clockDuration(op.grid, op.tempo)
+	n := int64(math.Round(float64(now.Sub(op.anchor)) / float64(step)))
+	if n % 2 == 0 {
+		return 0
+	}
+	return time.Duration(op.swing * float64(step))
+}
+
+// op.emit() sends msg after delay.  Messages are scheduled after earlier
+// messages for the same key.
+// The lock must be held by the caller.
+//
+func (op *Humanizer) emit(msg gomidi.Message, index int, now time.Time, delay time.Duration) {
+	if delay == 0 && op.queued[index] == 0 {
+		op.sounding.Update(msg)
+		op.distribute(msg)
+		return
+	}
+	when := now.Add(delay)
+	if last, ok := op.last[index]; ok && when.Before(last) {
+		when = last
+	}
+	op.last[index] = when
+	op.queued[index]++
+	generation := op.generation
+	sharedScheduler.schedule(when, op, func() {
+		op.lock.Lock()
+		defer op.lock.Unlock()
+		if generation != op.generation {
+			return
+		}
+		op.queued[index]--
+		if op.queued[index] == 0 {
+			delete(op.queued, index)
+			delete(op.last, index)
+		}
+		op.sounding.Update(msg)
+		op.distribute(msg)
+	})
+}
+
+func (op *Humanizer) noteOn(msg gomidi.Message, now time.Time) {
+	d := msg.Data
+	index := noteMapIndex(d)
+	var delay time.Duration
+	if op.timing > 0 {
+		delay = time.Duration(op.rng.Int63n(int64(op.timing * float64(time.Millisecond)) + 1))
+	}
+	delay += op.swingDelay(now)
+	velocity := int(d[2])
+	if op.velocity > 0 {
+		velocity += op.rng.Intn(2 * op.velocity + 1) - op.velocity
+		velocity = int(math.Max(1, math.Min(127, float64(velocity))))
+	}
+	op.held[index] = append(op.held[index], delay)
+	op.emit(gomidi.NewMessage([]byte{d[0], d[1], byte(velocity)}), index, now, delay)
+}
+
+func (op *Humanizer) noteOff(msg gomidi.Message, now time.Time) {
+	index := noteMapIndex(msg.Data)
+	var delay time.Duration
+	if held := op.held[index]; len(held) > 0 {
+		delay = held[0]
+		if len(held) == 1 {
+			delete(op.held, index)
+		} else {
+			op.held[index] = held[1:]
+		}
+	}
+	op.emit(gomidi.NewMessage(append([]byte(nil), msg.Data...)), index, now, delay)
+}
+
+func (op *Humanizer) Send(msg gomidi.Message) {
+	now := time.Now()
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	switch {
+	case midi.IsNoteOn(msg):
+		op.noteOn(msg, now)
+		return
+	case midi.IsNoteOff(msg):
+		op.noteOff(msg, now)
+		return
+	case midi.StatusByte(msg.Data[0]) == midi.START:
+		op.anchor = now
+	}
+	op.distribute(msg)
+}
+
+func (op *Humanizer) Info() string {
+	s := op.commonInfo()
+	s += fmt.Sprintf("\ttiming: %.1f msec  velocity: %d  seed: %d\n", op.Timing(), op.Velocity(), op.Seed())
+	s += fmt.Sprintf("\tswing: %.3f  grid: %s  tempo: %.1f\n", op.Swing(), op.Grid(), op.Tempo())
+	return s
+}
+
+
+func (op *Humanizer) initLocalHandlers() {
+
+	// op name, set-timing, msec
+	//
+	remoteSetTiming := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetTiming(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-timing
+	//
+	remoteQueryTiming := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%.1f", op.Timing())}, err
+	}
+
+	// op name, set-velocity, n
+	//
+	remoteSetVelocity := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetVelocity(int(args[2].I))
+		return empty, err
+	}
+
+	// op name, q-velocity
+	//
+	remoteQueryVelocity := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.Velocity())}, err
+	}
+
+	// op name, set-seed, n
+	//
+	remoteSetSeed := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		op.SetSeed(args[2].I)
+		return empty, err
+	}
+
+	// op name, q-seed
+	//
+	remoteQuerySeed := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.Seed())}, err
+	}
+
+	// op name, set-swing, fraction
+	//
+	remoteSetSwing := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetSwing(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-swing
+	//
+	remoteQuerySwing := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%.3f", op.Swing())}, err
+	}
+
+	// op name, set-grid, note-value
+	//
+	remoteSetGrid := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetGrid(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-grid
+	//
+	remoteQueryGrid := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.Grid()}, err
+	}
+
+	// op name, set-tempo, bpm
+	//
+	remoteSetTempo := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetTempo(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-tempo
+	//
+	remoteQueryTempo := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%.3f", op.Tempo())}, err
+	}
+
+	op.addCommandHandler("set-timing", remoteSetTiming)
+	op.addCommandHandler("q-timing", remoteQueryTiming)
+	op.addCommandHandler("set-velocity", remoteSetVelocity)
+	op.addCommandHandler("q-velocity", remoteQueryVelocity)
+	op.addCommandHandler("set-seed", remoteSetSeed)
+	op.addCommandHandler("q-seed", remoteQuerySeed)
+	op.addCommandHandler("set-swing", remoteSetSwing)
+	op.addCommandHandler("q-swing", remoteQuerySwing)
+	op.addCommandHandler("set-grid", remoteSetGrid)
+	op.addCommandHandler("q-grid", remoteQueryGrid)
+	op.addCommandHandler("set-tempo", remoteSetTempo)
+	op.addCommandHandler("q-tempo", remoteQueryTempo)
+}
+
+
+type humanizerSession struct {
+	Timing float64    `json:"timing"`
+	Velocity int      `json:"velocity"`
+	Seed int64        `json:"seed"`
+	Swing float64     `json:"swing"`
+	Grid string       `json:"grid"`
+	Tempo float64     `json:"tempo"`
+}
+
+func (op *Humanizer) sessionState() interface{} {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return &humanizerSession{op.timing, op.velocity, op.seed, op.swing,
+		op.gridName, op.tempo}
+}
+
+func (op *Humanizer) restoreSessionState(data json.RawMessage) error {
+	var state humanizerSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	if err = op.SetTiming(state.Timing); err != nil {
+		return err
+	}
+	if err = op.SetVelocity(state.Velocity); err != nil {
+		return err
+	}
+	op.SetSeed(state.Seed)
+	if err = op.SetSwing(state.Swing); err != nil {
+		return err
+	}
+	if err = op.SetGrid(state.Grid); err != nil {
+		return err
+	}
+	if err = op.SetTempo(state.Tempo); err != nil {
+		return err
+	}
+	return err
+}
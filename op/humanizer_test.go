@@ -0,0 +1,121 @@
+package op
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHumanizerVelocity(t *testing.T) {
+	human := newHumanizer("human")
+	defer human.Close()
+	out := newCollectingOperator("out")
+	human.Connect(out)
+
+	// Default settings pass notes unchanged.
+	sendBytes(human, 0x90, 60, 100)
+	sendBytes(human, 0x80, 60, 0)
+	expectMessages(t, out, []byte{0x90, 60, 100}, []byte{0x80, 60, 0})
+
+	// Seeded variation is repeatable and within range.
+	if err := human.SetVelocity(100); err == nil {
+		t.Fatal("Expected error for velocity range out of bounds")
+	}
+	play := func() []byte {
+		human.SetSeed(42)
+		human.SetVelocity(10)
+		acc := make([]byte, 0, 20)
+		for i := 0; i < 20; i++ {
+			sendBytes(human, 0x90, byte(60 + i), 64)
+			got := out.take()
+			v := got[0][2]
+			if v < 54 || 74 < v {
+				t.Fatalf("Velocity %d out of range", v)
+			}
+			acc = append(acc, v)
+		}
+		return acc
+	}
+	first, second := play(), play()
+	if string(first) != string(second) {
+		t.Fatalf("Seeded velocities differ: %v %v", first, second)
+	}
+}
+
+func TestHumanizerTiming(t *testing.T) {
+	human := newHumanizer("human")
+	defer human.Close()
+	out := newCollectingOperator("out")
+	human.Connect(out)
+	human.SetSeed(7)
+	human.SetTiming(20)
+
+	// Messages for a key keep their order.
+	for i := 0; i < 10; i++ {
+		sendBytes(human, 0x90, 60, 100)
+		sendBytes(human, 0x80, 60, 0)
+	}
+	waitForScheduler(t, human)
+	got := out.take()
+	if len(got) != 20 {
+		t.Fatalf("Expected 20 messages, got %v", got)
+	}
+	for i, data := range got {
+		if (i % 2 == 0) != (data[0] == 0x90) {
+			t.Fatalf("Notes out of order: %v", got)
+		}
+	}
+
+	// Panic cancels scheduled notes.
+	human.SetTiming(500)
+	sendBytes(human, 0x90, 60, 100)
+	human.Panic()
+	if sharedScheduler.pending(human) != 0 {
+		t.Fatal("Panic left notes pending")
+	}
+}
+
+func TestHumanizerSwing(t *testing.T) {
+	human := newHumanizer("human")
+	defer human.Close()
+	human.SetTempo(120)
+	human.SetGrid("1/8")
+	if err := human.SetSwing(1); err == nil {
+		t.Fatal("Expected error for swing out of range")
+	}
+	human.SetSwing(0.5)
+	start := time.Now()
+	human.lock.Lock()
+	defer human.lock.Unlock()
+	human.anchor = start
+	for _, step := range []struct{
+		at time.Duration
+		delay time.Duration
+	}{
+		{0, 0},
+		{240 * time.Millisecond, 125 * time.Millisecond},
+		{510 * time.Millisecond, 0},
+		{760 * time.Millisecond, 125 * time.Millisecond},
+	} {
+		if got := human.swingDelay(start.Add(step.at)); got != step.delay {
+			t.Fatalf("Swing at %v expected %v, got %v", step.at, step.delay, got)
+		}
+	}
+}
+
+func TestHumanizerSession(t *testing.T) {
+	human := newHumanizer("human")
+	human.SetTiming(15)
+	human.SetVelocity(8)
+	human.SetSeed(99)
+	human.SetSwing(0.25)
+	human.SetGrid("1/16")
+	data, _ := json.Marshal(human.sessionState())
+	restored := newHumanizer("restored")
+	if err := restored.restoreSessionState(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Timing() != 15 || restored.Seed() != 99 || restored.Grid() != "1/16" {
+		t.Fatalf("Session not restored: %s", restored.Info())
+	}
+}
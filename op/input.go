@@ -2,6 +2,7 @@ package op
 
 import (
 	"fmt"
+	"sync"
 	gomidi "gitlab.com/gomidi/midi/v2"
 	goosc "github.com/hypebeast/go-osc/osc"
 	"github.com/plewto/pigiron/backend"
@@ -20,6 +21,7 @@ type MIDIInput struct {
 }
 
 var inputCache = make(map[string]*MIDIInput)
+var inputCacheLock sync.Mutex
 
 func newMIDIInput(name string, port gomidi.In) (*MIDIInput, error) {
 	op := new(MIDIInput)
@@ -28,7 +30,7 @@ func newMIDIInput(name string, port gomidi.In) (*MIDIInput, error) {
 	op.port = port
 	callback := func(msg gomidi.Message, delta int64) {
 		if op.MIDIOutputEnabled() {
-			op.Send(msg)
+			deliver(op, msg)
 		}
 	}
 	listener, err := gomidi.NewListener(port, callback)
@@ -50,6 +52,8 @@ func NewMIDIInput(name string, deviceSpec string) (*MIDIInput, error) {
 	if err != nil {
 		return op, err
 	}
+	inputCacheLock.Lock()
+	defer inputCacheLock.Unlock()
 	op, cached := inputCache[port.String()]
 	if !cached {
 		op, err = newMIDIInput(name, port)
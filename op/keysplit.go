@@ -0,0 +1,356 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+// splitZone is a key range routed to a single child.
+//
+type splitZone struct {
+	Child string    `json:"child"`
+	Low int         `json:"low"`
+	High int        `json:"high"`
+	Transpose int   `json:"transpose"`
+}
+
+func (z *splitZone) String() string {
+	return fmt.Sprintf("%s %d %d %d", z.Child, z.Low, z.High, z.Transpose)
+}
+
+// heldNote records where a NOTE_ON was sent so the matching NOTE_OFF
+// follows it, even if the zones have since changed.
+//
+type heldNote struct {
+	child string
+	key byte
+}
+
+// KeySplit is an Operator which routes keyed messages (NOTE_OFF, NOTE_ON
+// and POLY_PRESSURE) to children by key range.
+//
+// Each zone names a child, a key range and a transposition.  Zones may
+// overlap to layer sounds.  Children without a zone receive no keyed
+// messages.   Non-keyed messages are sent either to all children or to a
+// single selected child.
+//
+type KeySplit struct {
+	baseOperator
+	lock sync.Mutex
+	zones map[string]*splitZone
+	nonKeyedRoute string    // "" sends to all children
+	held map[int][]heldNote // indexed by channel * 128 + key
+}
+
+func newKeySplit(name string) *KeySplit {
+	op := new(KeySplit)
+	initOperator(&op.baseOperator, "KeySplit", name, midi.NoChannel)
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+func (op *KeySplit) Reset() {
+	op.lock.Lock()
+	op.zones = make(map[string]*splitZone)
+	op.nonKeyedRoute = ""
+	op.held = make(map[int][]heldNote)
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+func (op *KeySplit) Panic() {
+	op.lock.Lock()
+	op.held = make(map[int][]heldNote)
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Panic()
+}
+
+// op.SetZone() routes keys between low and high inclusive to the named child.
+// Keys are shifted by transpose, transposed keys outside the MIDI range are
+// dropped.  Any existing zone for child is replaced.
+//
+func (op *KeySplit) SetZone(child string, low int, high int, transpose int) error {
+	var err error
+	if low < 0 || high > 127 || low > high {
+		errmsg := "Expected key range 0 <= low <= high <= 127, got %d %d"
+		err = fmt.Errorf(errmsg, low, high)
+		return err
+	}
+	if transpose < -127 || transpose > 127 {
+		errmsg := "Expected transpose between -127 and 127, got %d"
+		err = fmt.Errorf(errmsg, transpose)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.zones[child] = &splitZone{child, low, high, transpose}
+	return err
+}
+
+// op.RemoveZone() removes the zone for child.
+// It is not an error if child does not have a zone.
+//
+func (op *KeySplit) RemoveZone(child string) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	delete(op.zones, child)
+}
+
+// op.ClearZones() removes all zones.
+//
+func (op *KeySplit) ClearZones() {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.zones = make(map[string]*splitZone)
+}
+
+// op.Zones() returns all zones ordered by child name.
+//
+func (op *KeySplit) Zones() []splitZone {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.sortedZones()
+}
+
+// The lock must be held by the caller.
+//
+func (op *KeySplit) sortedZones() []splitZone {
+	acc := make([]splitZone, 0, len(op.zones))
+	for _, z := range op.zones {
+		acc = append(acc, *z)
+	}
+	sort.Slice(acc, func(i, j int) bool { return acc[i].Child < acc[j].Child })
+	return acc
+}
+
+// op.SetNonKeyedRoute() selects the child which receives non-keyed messages.
+// An empty string or "all" sends non-keyed messages to all children.
+//
+func (op *KeySplit) SetNonKeyedRoute(child string) {
+	if strings.ToLower(child) == "all" {
+		child = ""
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.nonKeyedRoute = child
+}
+
+// op.NonKeyedRoute() returns the child which receives non-keyed messages,
+// or "all".
+//
+func (op *KeySplit) NonKeyedRoute() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if op.nonKeyedRoute == "" {
+		return "all"
+	}
+	return op.nonKeyedRoute
+}
+
+// op.zoneRoutes() returns destinations for key using current zones.
+// The lock must be held by the caller.
+//
+func (op *KeySplit) zoneRoutes(key byte) []heldNote {
+	acc := make([]heldNote, 0, 2)
+	for _, z := range op.sortedZones() {
+		k := int(key)
+		if k < z.Low || k > z.High {
+			continue
+		}
+		k += z.Transpose
+		if 0 <= k && k < 128 {
+			acc = append(acc, heldNote{z.Child, byte(k)})
+		}
+	}
+	return acc
+}
+
+// op.keyedRoutes() returns destinations for a keyed message.
+// NOTE_OFF and POLY_PRESSURE follow their NOTE_ON.
+//
+func (op *KeySplit) keyedRoutes(msg gomidi.Message) []heldNote {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	key := msg.Data[1]
+	index := int(msg.Data[0] & 0x0F) * 128 + int(key)
+	held, isHeld := op.held[index]
+	switch {
+	case midi.IsNoteOn(msg):
+		routes := op.zoneRoutes(key)
+		op.held[index] = append(held, routes...)
+		return routes
+	case midi.IsNoteOff(msg):
+		if isHeld {
+			delete(op.held, index)
+			return held
+		}
+	default:
+		if isHeld {
+			return held
+		}
+	}
+	return op.zoneRoutes(key)
+}
+
+func (op *KeySplit) Send(msg gomidi.Message) {
+	if !op.MIDIOutputEnabled() {
+		return
+	}
+	st := midi.StatusByte(msg.Data[0])
+	children := op.children()
+	if !midi.IsKeyedStatus(st) || len(msg.Data) < 3 {
+		op.lock.Lock()
+		route := op.nonKeyedRoute
+		op.lock.Unlock()
+		if route == "" {
+			op.distribute(msg)
+		} else if child, ok := children[route]; ok {
+			deliver(child, msg)
+		}
+		return
+	}
+	for _, r := range op.keyedRoutes(msg) {
+		if child, ok := children[r.child]; ok {
+			deliver(child, gomidi.NewMessage([]byte{msg.Data[0], r.key, msg.Data[2]}))
+		}
+	}
+}
+
+func (op *KeySplit) Info() string {
+	s := op.commonInfo()
+	s += "\tzones: "
+	zones := op.Zones()
+	if len(zones) == 0 {
+		s += "<none>\n"
+	} else {
+		s += "\n"
+		for _, z := range zones {
+			msg := "\t\t%-12s keys %3d..%3d  transpose %d\n"
+			s += fmt.Sprintf(msg, z.Child, z.Low, z.High, z.Transpose)
+		}
+	}
+	s += fmt.Sprintf("\tnon-keyed route: %s\n", op.NonKeyedRoute())
+	return s
+}
+
+
+func (op *KeySplit) initLocalHandlers() {
+
+	// op name, set-zone, child, low, high [, transpose]
+	//
+	remoteSetZone := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osoii", msg)
+		if err != nil {
+			return empty, err
+		}
+		transpose := int64(0)
+		if len(msg.Arguments) > 5 {
+			targs, err := ExpectMsg("osoiii", msg)
+			if err != nil {
+				return empty, err
+			}
+			transpose = targs[5].I
+		}
+		err = op.SetZone(args[2].O.Name(), int(args[3].I), int(args[4].I), int(transpose))
+		return empty, err
+	}
+
+	// op name, remove-zone, child
+	//
+	remoteRemoveZone := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		op.RemoveZone(args[2].S)
+		return empty, err
+	}
+
+	// op name, clear-zones
+	//
+	remoteClearZones := func(msg *goosc.Message)([]string, error) {
+		var err error
+		op.ClearZones()
+		return empty, err
+	}
+
+	// op name, q-zones
+	// Returns list of zones, each as 'child low high transpose'
+	//
+	remoteQueryZones := func(msg *goosc.Message)([]string, error) {
+		var err error
+		zones := op.Zones()
+		acc := make([]string, len(zones))
+		for i, z := range zones {
+			acc[i] = z.String()
+		}
+		return acc, err
+	}
+
+	// op name, route-non-keyed, child|all
+	//
+	remoteRouteNonKeyed := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		route := args[2].S
+		if strings.ToLower(route) != "all" {
+			if _, err = GetOperator(route); err != nil {
+				return empty, err
+			}
+		}
+		op.SetNonKeyedRoute(route)
+		return empty, err
+	}
+
+	// op name, q-route-non-keyed
+	//
+	remoteQueryRouteNonKeyed := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.NonKeyedRoute()}, err
+	}
+
+	op.addCommandHandler("set-zone", remoteSetZone)
+	op.addCommandHandler("remove-zone", remoteRemoveZone)
+	op.addCommandHandler("clear-zones", remoteClearZones)
+	op.addCommandHandler("q-zones", remoteQueryZones)
+	op.addCommandHandler("route-non-keyed", remoteRouteNonKeyed)
+	op.addCommandHandler("q-route-non-keyed", remoteQueryRouteNonKeyed)
+}
+
+
+type keySplitSession struct {
+	Zones []splitZone       `json:"zones"`
+	NonKeyedRoute string    `json:"non-keyed-route"`
+}
+
+func (op *KeySplit) sessionState() interface{} {
+	return &keySplitSession{op.Zones(), op.NonKeyedRoute()}
+}
+
+func (op *KeySplit) restoreSessionState(data json.RawMessage) error {
+	var state keySplitSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	op.ClearZones()
+	for _, z := range state.Zones {
+		err = op.SetZone(z.Child, z.Low, z.High, z.Transpose)
+		if err != nil {
+			return err
+		}
+	}
+	op.SetNonKeyedRoute(state.NonKeyedRoute)
+	return err
+}
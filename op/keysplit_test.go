@@ -0,0 +1,66 @@
+package op
+
+import (
+	"encoding/json"
+	"testing"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+func TestKeySplit(t *testing.T) {
+	split := newKeySplit("split")
+	lower := newCollectingOperator("lower")
+	upper := newCollectingOperator("upper")
+	layer := newCollectingOperator("layer")
+	other := newCollectingOperator("other")
+	for _, child := range []Operator{lower, upper, layer, other} {
+		split.Connect(child)
+	}
+	split.SetZone("lower", 0, 59, 12)
+	split.SetZone("upper", 60, 127, 0)
+	split.SetZone("layer", 60, 120, -12)
+	if err := split.SetZone("bad", 60, 59, 0); err == nil {
+		t.Fatal("Expected error for invalid key range")
+	}
+
+	split.Send(gomidi.NewMessage([]byte{0x91, 48, 100}))
+	split.Send(gomidi.NewMessage([]byte{0x91, 64, 100}))
+	split.Send(gomidi.NewMessage([]byte{0x91, 125, 100}))
+	expectMessages(t, lower, []byte{0x91, 60, 100})
+	expectMessages(t, upper, []byte{0x91, 64, 100}, []byte{0x91, 125, 100})
+	expectMessages(t, layer, []byte{0x91, 52, 100})
+	expectMessages(t, other)
+
+	// Note off follows note on after zones change.
+	split.ClearZones()
+	split.SetZone("other", 0, 127, 0)
+	split.Send(gomidi.NewMessage([]byte{0xA1, 64, 30}))
+	split.Send(gomidi.NewMessage([]byte{0x81, 64, 0}))
+	split.Send(gomidi.NewMessage([]byte{0x91, 48, 0}))
+	expectMessages(t, upper, []byte{0xA1, 64, 30}, []byte{0x81, 64, 0})
+	expectMessages(t, layer, []byte{0xA1, 52, 30}, []byte{0x81, 52, 0})
+	expectMessages(t, lower, []byte{0x91, 60, 0})
+	expectMessages(t, other)
+	split.Send(gomidi.NewMessage([]byte{0x81, 64, 0}))
+	expectMessages(t, other, []byte{0x81, 64, 0})
+
+	// Non-keyed messages
+	bend := []byte{0xE1, 0x00, 0x40}
+	split.Send(gomidi.NewMessage(bend))
+	for _, child := range []*collectingOperator{lower, upper, layer, other} {
+		expectMessages(t, child, bend)
+	}
+	split.SetNonKeyedRoute("upper")
+	split.Send(gomidi.NewMessage(bend))
+	expectMessages(t, upper, bend)
+	expectMessages(t, lower)
+
+	// Session round trip
+	data, _ := json.Marshal(split.sessionState())
+	restored := newKeySplit("restored")
+	if err := restored.restoreSessionState(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.NonKeyedRoute() != "upper" || len(restored.Zones()) != 1 {
+		t.Fatalf("Session not restored: %s", restored.Info())
+	}
+}
@@ -0,0 +1,404 @@
+package op
+
+/*
+** locate.go defines MIDIPlayer position conversions and controller chasing.
+**
+** A locate point may be specified as:
+**    seconds     - "12.5"
+**    bar:beat    - "9:1"   bars and beats start at 1.
+**    marker-name - the text of a meta marker message.
+**
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+	"github.com/plewto/pigiron/smf"
+)
+
+// timeSignature records a meta time-signature change.
+// denominator is a power of 2, as stored in the MIDI file.
+//
+type timeSignature struct {
+	tick uint64
+	numerator int
+	denominator int
+}
+
+// chaseState records the most recent channel state prior to a locate point.
+// Values of -1 indicate no message was found.
+// Channels used anywhere in the track, and controllers changed after the
+// locate point, are also noted so that they may be restored to defaults.
+//
+type chaseState struct {
+	program [16]int
+	pressure [16]int
+	bend [16]int
+	controllers [16][128]int
+	used [16]bool
+	later [16][128]bool
+}
+
+func newChaseState() *chaseState {
+	cs := new(chaseState)
+	for ci := 0; ci < 16; ci++ {
+		cs.program[ci] = -1
+		cs.pressure[ci] = -1
+		cs.bend[ci] = -1
+		for ctrl := 0; ctrl < 128; ctrl++ {
+			cs.controllers[ci][ctrl] = -1
+		}
+	}
+	return cs
+}
+
+// cs.update() records the channel state of msg.
+// Channel mode messages (controllers 120..127) are ignored.
+//
+func (cs *chaseState) update(msg gomidi.Message) {
+	d := msg.Data
+	if len(d) < 2 || !midi.IsChannelStatus(midi.StatusByte(d[0])) {
+		return
+	}
+	st, ci := midi.StatusByte(d[0] & 0xF0), d[0] & 0x0F
+	cs.used[ci] = true
+	switch {
+	case st == midi.PROGRAM:
+		cs.program[ci] = int(d[1])
+	case st == midi.CHANNEL_PRESSURE:
+		cs.pressure[ci] = int(d[1])
+	case st == midi.BEND && len(d) > 2:
+		cs.bend[ci] = int(d[1]) | int(d[2]) << 7
+	case st == midi.CONTROLLER && len(d) > 2 && d[1] < 120:
+		cs.controllers[ci][d[1]] = int(d[2])
+	default:
+	}
+}
+
+// cs.follow() notes channel use and controller changes by msg, which
+// follows the locate point.
+//
+func (cs *chaseState) follow(msg gomidi.Message) {
+	d := msg.Data
+	if len(d) < 2 || !midi.IsChannelStatus(midi.StatusByte(d[0])) {
+		return
+	}
+	st, ci := midi.StatusByte(d[0] & 0xF0), d[0] & 0x0F
+	cs.used[ci] = true
+	if st == midi.CONTROLLER && len(d) > 2 && d[1] < 120 {
+		cs.later[ci][d[1]] = true
+	}
+}
+
+// cs.messages() returns the messages required to restore the chased state.
+// Bank select precedes program change, which precedes all other controllers.
+//
+// On channels used by the track, controllers changed after the locate
+// point without an earlier value are set to their defaults, see
+// ControllerDefaults, and pressure and bend are reset unless chased.
+//
+func (cs *chaseState) messages() []gomidi.Message {
+	acc := make([]gomidi.Message, 0, 64)
+	controller := func(ci byte, ctrl byte) {
+		v := cs.controllers[ci][ctrl]
+		if v < 0 && cs.later[ci][ctrl] {
+			v = int(ControllerDefaults[ctrl])
+		}
+		if v >= 0 {
+			acc = append(acc, gomidi.NewMessage([]byte{byte(midi.CONTROLLER) | ci, ctrl, byte(v)}))
+		}
+	}
+	for ci := byte(0); ci < 16; ci++ {
+		if !cs.used[ci] {
+			continue
+		}
+		controller(ci, 0)
+		controller(ci, 32)
+		if v := cs.program[ci]; v >= 0 {
+			acc = append(acc, gomidi.NewMessage([]byte{byte(midi.PROGRAM) | ci, byte(v)}))
+		}
+		for ctrl := byte(1); ctrl < 120; ctrl++ {
+			if ctrl != 32 {
+				controller(ci, ctrl)
+			}
+		}
+		pressure, bend := cs.pressure[ci], cs.bend[ci]
+		if pressure < 0 {
+			pressure = 0
+		}
+		if bend < 0 {
+			bend = 0x2000
+		}
+		acc = append(acc, gomidi.NewMessage([]byte{byte(midi.CHANNEL_PRESSURE) | ci, byte(pressure)}))
+		acc = append(acc, gomidi.NewMessage([]byte{byte(midi.BEND) | ci, byte(bend & 0x7F), byte(bend >> 7)}))
+	}
+	return acc
+}
+
+// absoluteTicks returns absolute tick time for each event in track.
+//
+func absoluteTicks(track smf.Track) []uint64 {
+	events := track.Events()
+	acc := make([]uint64, len(events))
+	var tick uint64 = 0
+	for i, ev := range events {
+		tick += ev.DeltaTime()
+		acc[i] = tick
+	}
+	return acc
+}
+
+// op.endTick() returns the time of the final event.
+//
+func (op *MIDIPlayer) endTick() uint64 {
+	if len(op.ticks) == 0 {
+		return 0
+	}
+	return op.ticks[len(op.ticks)-1]
+}
+
+// op.indexAtTick() returns index of the first event at or after tick.
+//
+func (op *MIDIPlayer) indexAtTick(tick uint64) int {
+	for i, t := range op.ticks {
+		if t >= tick {
+			return i
+		}
+	}
+	return len(op.ticks)
+}
+
+// op.tickToSeconds() converts absolute tick time to seconds using the tempo map.
+//
+func (op *MIDIPlayer) tickToSeconds(tick uint64) float64 {
+	div := op.midifile.Division()
+	tickDuration := smf.TickDuration(div, PLAYER_DEFAULT_TEMPO)
+	var acc float64 = 0
+	var previous uint64 = 0
+	for i, ev := range op.track.Events() {
+		t := op.ticks[i]
+		if t >= tick {
+			break
+		}
+		if smf.IsTempoChange(ev.Message()) {
+			acc += float64(t - previous) * tickDuration
+			previous = t
+			tempo, _ := smf.MetaTempoBPM(ev.Message())
+			tickDuration = smf.TickDuration(div, tempo)
+		}
+	}
+	return acc + float64(tick - previous) * tickDuration
+}
+
+// op.secondsToTick() converts time in seconds to absolute tick time.
+//
+func (op *MIDIPlayer) secondsToTick(seconds float64) uint64 {
+	div := op.midifile.Division()
+	tickDuration := smf.TickDuration(div, PLAYER_DEFAULT_TEMPO)
+	var elapsed float64 = 0
+	var previous uint64 = 0
+	for i, ev := range op.track.Events() {
+		if !smf.IsTempoChange(ev.Message()) {
+			continue
+		}
+		t := op.ticks[i]
+		span := float64(t - previous) * tickDuration
+		if elapsed + span >= seconds {
+			break
+		}
+		elapsed += span
+		previous = t
+		tempo, _ := smf.MetaTempoBPM(ev.Message())
+		tickDuration = smf.TickDuration(div, tempo)
+	}
+	return previous + uint64((seconds - elapsed) / tickDuration + 0.5)
+}
+
+// op.timeSignatures() returns all time-signature changes in the track.
+//
+func (op *MIDIPlayer) timeSignatures() []timeSignature {
+	acc := make([]timeSignature, 0, 4)
+	for i, ev := range op.track.Events() {
+		d := ev.Message().Data
+		if len(d) >= 5 && d[0] == byte(midi.META) && d[1] == byte(midi.META_TIME_SIGNATURE) {
+			acc = append(acc, timeSignature{op.ticks[i], int(d[3]), int(d[4])})
+		}
+	}
+	return acc
+}
+
+// op.barToTick() converts bar and beat numbers to absolute tick time.
+// Bars and beats are numbered from 1.  Time signature changes are assumed
+// to occur at the start of a bar, the default is 4/4.
+//
+func (op *MIDIPlayer) barToTick(bar int, beat int) (uint64, error) {
+	var err error
+	if bar < 1 || beat < 1 {
+		errmsg := "Expected bar and beat >= 1, got %d:%d"
+		err = fmt.Errorf(errmsg, bar, beat)
+		return 0, err
+	}
+	div := uint64(op.midifile.Division())
+	numerator, denominator := 4, 2
+	sigs := op.timeSignatures()
+	var tick uint64 = 0
+	si := 0
+	apply := func() {
+		for si < len(sigs) && sigs[si].tick <= tick {
+			numerator, denominator = sigs[si].numerator, sigs[si].denominator
+			si++
+		}
+	}
+	beatTicks := func() uint64 {
+		return div * 4 >> uint(denominator)
+	}
+	apply()
+	for b := 1; b < bar; b++ {
+		tick += uint64(numerator) * beatTicks()
+		apply()
+	}
+	if beat > numerator {
+		errmsg := "Beat %d out of bounds for %d/%d bar %d"
+		err = fmt.Errorf(errmsg, beat, numerator, 1 << uint(denominator), bar)
+		return 0, err
+	}
+	tick += uint64(beat - 1) * beatTicks()
+	return tick, err
+}
+
+// op.Markers() returns the names of all meta marker messages.
+//
+func (op *MIDIPlayer) Markers() []string {
+	acc := make([]string, 0, 8)
+	for _, ev := range op.track.Events() {
+		text, txType, err := smf.ExtractMetaText(ev.Message())
+		if err == nil && midi.MetaType(txType) == midi.META_MARKER {
+			acc = append(acc, strings.TrimSpace(text))
+		}
+	}
+	return acc
+}
+
+// op.markerToTick() returns the time of the first marker with matching text.
+//
+func (op *MIDIPlayer) markerToTick(name string) (uint64, error) {
+	var err error
+	for i, ev := range op.track.Events() {
+		text, txType, terr := smf.ExtractMetaText(ev.Message())
+		if terr == nil && midi.MetaType(txType) == midi.META_MARKER && strings.TrimSpace(text) == name {
+			return op.ticks[i], err
+		}
+	}
+	errmsg := "MIDIPlayer %s, marker '%s' not found in %s"
+	err = fmt.Errorf(errmsg, op.Name(), name, op.MediaFilename())
+	return 0, err
+}
+
+// op.locateTick() converts a locate specification to absolute tick time.
+// spec may be seconds, bar:beat or a marker name.
+//
+func (op *MIDIPlayer) locateTick(spec string) (uint64, error) {
+	spec = strings.TrimSpace(spec)
+	if pos := strings.Index(spec, ":"); pos > 0 {
+		bar, berr := strconv.Atoi(spec[:pos])
+		beat, terr := strconv.Atoi(spec[pos+1:])
+		if berr == nil && terr == nil {
+			return op.barToTick(bar, beat)
+		}
+	}
+	if seconds, err := strconv.ParseFloat(spec, 64); err == nil {
+		if seconds < 0 {
+			errmsg := "Expected non-negative locate time, got %f"
+			return 0, fmt.Errorf(errmsg, seconds)
+		}
+		return op.secondsToTick(seconds), nil
+	}
+	return op.markerToTick(spec)
+}
+
+// op.chase() returns tempo and channel state at the start of event index.
+//
+func (op *MIDIPlayer) chase(index int) (tempo float64, state *chaseState) {
+	tempo = PLAYER_DEFAULT_TEMPO
+	state = newChaseState()
+	for i, ev := range op.track.Events() {
+		msg := ev.Message()
+		switch {
+		case i >= index:
+			state.follow(msg)
+		case smf.IsTempoChange(msg):
+			tempo, _ = smf.MetaTempoBPM(msg)
+		default:
+			state.update(msg)
+		}
+	}
+	return tempo, state
+}
+
+
+func (op *MIDIPlayer) initLocateHandlers() {
+
+	// op name, seek, position
+	// position may be seconds, bar:beat or a marker name.
+	//
+	remoteSeek := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.Seek(args[2].S)
+		if err != nil {
+			return empty, err
+		}
+		return []string{smf.FormatTime(op.Position())}, err
+	}
+
+	// op name, loop, start, end
+	// op name, loop, off
+	//
+	remoteLoop := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		if strings.ToLower(args[2].S) == "off" {
+			op.ClearLoop()
+			return empty, err
+		}
+		args, err = ExpectMsg("osss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetLoop(args[2].S, args[3].S)
+		return empty, err
+	}
+
+	// op name, q-loop
+	// Returns loop start and end times or 'off'
+	//
+	remoteQueryLoop := func(msg *goosc.Message)([]string, error) {
+		var err error
+		looping, start, end := op.loopRegion()
+		if !looping {
+			return []string{"off"}, err
+		}
+		return []string{smf.FormatTime(op.tickToSeconds(start)), smf.FormatTime(op.tickToSeconds(end))}, err
+	}
+
+	// op name, q-markers
+	// Returns list of marker names.
+	//
+	remoteQueryMarkers := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return op.Markers(), err
+	}
+
+	op.addCommandHandler("seek", remoteSeek)
+	op.addCommandHandler("loop", remoteLoop)
+	op.addCommandHandler("q-loop", remoteQueryLoop)
+	op.addCommandHandler("q-markers", remoteQueryMarkers)
+}
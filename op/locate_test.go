@@ -0,0 +1,140 @@
+package op
+
+import (
+	"testing"
+	"time"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/smf"
+)
+
+// a3.mid is 4/4 at 60 BPM for one bar, then 3/4 at 120 BPM, division 24.
+//
+func newTestPlayer(t *testing.T, name string) *MIDIPlayer {
+	player := newMIDIPlayer(name)
+	if err := player.LoadMedia("!/resources/testFiles/a3.mid"); err != nil {
+		t.Fatal(err)
+	}
+	return player
+}
+
+func TestPlayerTickConversion(t *testing.T) {
+	player := newTestPlayer(t, "player")
+	var bars = []struct{
+		bar int
+		beat int
+		tick uint64
+	}{
+		{1, 1, 0},
+		{1, 3, 48},
+		{2, 1, 96},
+		{2, 3, 144},
+		{3, 1, 168},
+	}
+	for _, b := range bars {
+		tick, err := player.barToTick(b.bar, b.beat)
+		if err != nil || tick != b.tick {
+			t.Fatalf("Expected %d:%d at tick %d, got %d %v", b.bar, b.beat, b.tick, tick, err)
+		}
+	}
+	if _, err := player.barToTick(2, 4); err == nil {
+		t.Fatal("Expected error for beat 4 of 3/4 bar")
+	}
+	if _, err := player.barToTick(0, 1); err == nil {
+		t.Fatal("Expected error for bar 0")
+	}
+
+	var times = []struct{
+		tick uint64
+		seconds float64
+	}{
+		{0, 0},
+		{48, 2},
+		{96, 4},
+		{168, 5.5},
+		{240, 7},
+	}
+	for _, tt := range times {
+		if s := player.tickToSeconds(tt.tick); s < tt.seconds - 1e-6 || tt.seconds + 1e-6 < s {
+			t.Fatalf("Expected tick %d at %f seconds, got %f", tt.tick, tt.seconds, s)
+		}
+		if tick := player.secondsToTick(tt.seconds); tick != tt.tick {
+			t.Fatalf("Expected %f seconds at tick %d, got %d", tt.seconds, tt.tick, tick)
+		}
+	}
+
+	for _, spec := range []string{"bridge", "3:1", "5.5"} {
+		if tick, err := player.locateTick(spec); err != nil || tick != 168 {
+			t.Fatalf("Expected '%s' at tick 168, got %d %v", spec, tick, err)
+		}
+	}
+	for _, spec := range []string{"coda", "-1"} {
+		if _, err := player.locateTick(spec); err == nil {
+			t.Fatalf("Expected error for locate '%s'", spec)
+		}
+	}
+}
+
+func TestPlayerSeekChase(t *testing.T) {
+	player := newTestPlayer(t, "player")
+	out := newCollectingOperator("out")
+	player.Connect(out)
+
+	// Values before the locate point are chased.  Channel 2 is first used
+	// later, it is reset to defaults.
+	if err := player.Seek("verse"); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, out,
+		[]byte{0xC0, 5}, []byte{0xB0, 7, 100}, []byte{0xB0, 64, 127},
+		[]byte{0xD0, 0}, []byte{0xE0, 0, 0x60},
+		[]byte{0xB1, 1, 0}, []byte{0xD1, 0}, []byte{0xE1, 0, 0x40})
+	if player.Position() != 4 {
+		t.Fatalf("Expected position 4, got %f", player.Position())
+	}
+
+	// Seeking back resets values which are first set later.
+	player.Seek("1:1")
+	expectMessages(t, out,
+		[]byte{0xB0, 7, ControllerDefaults[7]}, []byte{0xB0, 64, 0},
+		[]byte{0xD0, 0}, []byte{0xE0, 0, 0x40},
+		[]byte{0xB1, 1, 0}, []byte{0xD1, 0}, []byte{0xE1, 0, 0x40})
+}
+
+func TestPlayerLoop(t *testing.T) {
+	player := newTestPlayer(t, "player")
+	out := newCollectingOperator("out")
+	player.Connect(out)
+	if err := player.SetLoop("2:1", "1:3"); err == nil {
+		t.Fatal("Expected error for loop end before start")
+	}
+	if err := player.SetLoop("1:3", "verse"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := player.DispatchCommand("q-loop", goosc.NewMessage("/pig/op"))
+	if len(got) != 2 || got[0] != smf.FormatTime(2) || got[1] != smf.FormatTime(4) {
+		t.Fatalf("Unexpected q-loop %v", got)
+	}
+
+	// The sustain and bend set inside the loop are reset on each pass.
+	// At 8 x 60 BPM a pass takes 250 msec.
+	player.SetTempoScale(8)
+	player.Seek("1:3")
+	out.take()
+	player.Continue()
+	time.Sleep((PLAYER_START_DELAY + 400) * time.Millisecond)
+	received := out.take()
+	player.Stop()
+	sustain := 0
+	for _, d := range received {
+		if len(d) == 3 && d[0] == 0xB0 && d[1] == 64 && (d[2] == 0) == (sustain % 2 == 1) {
+			sustain++
+		}
+	}
+	if sustain < 2 {
+		t.Fatalf("Expected sustain released at loop end, got %v", received)
+	}
+	player.ClearLoop()
+	if got, _ := player.DispatchCommand("q-loop", goosc.NewMessage("/pig/op")); got[0] != "off" {
+		t.Fatalf("Expected loop off, got %v", got)
+	}
+}
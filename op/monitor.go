@@ -1,8 +1,10 @@
 package op
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 	"time"
 	gomidi "gitlab.com/gomidi/midi/v2"
 	goosc "github.com/hypebeast/go-osc/osc"
@@ -297,3 +299,40 @@ func (op *Monitor) initLocalHandlers() {
 }
 
 
+type monitorSession struct {
+	Enabled bool      `json:"enabled"`
+	Excluded []int    `json:"excluded-status"`
+	LogFile string    `json:"logfile,omitempty"`
+}
+
+func (op *Monitor) sessionState() interface{} {
+	excluded := make([]int, 0)
+	for st, flag := range op.excludeStatusFlags {
+		if flag {
+			excluded = append(excluded, int(st))
+		}
+	}
+	sort.Ints(excluded)
+	return &monitorSession{op.enable, excluded, op.logFilename}
+}
+
+func (op *Monitor) restoreSessionState(data json.RawMessage) error {
+	state := &monitorSession{Enabled: true}
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+	op.enable = state.Enabled
+	for key, _ := range op.excludeStatusFlags {
+		op.excludeStatusFlags[key] = false
+	}
+	for _, st := range state.Excluded {
+		op.excludeStatusFlags[midi.StatusByte(st)] = true
+	}
+	op.CloseLogFile()
+	op.logFilename = ""
+	if state.LogFile != "" {
+		_, err = op.OpenLogFile(state.LogFile)
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package op
+
+import (
+	gomidi "gitlab.com/gomidi/midi/v2"
+	"github.com/plewto/pigiron/midi"
+)
+
+// noteMap records the keys produced for each incoming NOTE_ON so the
+// matching NOTE_OFF and POLY_PRESSURE messages follow them, even if the
+// operator's settings have since changed.
+//
+// Produced keys are counted.  A key produced by several held notes is
+// turned off when the last of them is released.
+//
+// noteMap is not thread safe, the owning operator's lock must be held.
+//
+type noteMap struct {
+	held map[int][][]byte     // produced keys indexed by channel * 128 + key
+	sounding midi.NoteQueue
+}
+
+func newNoteMap() *noteMap {
+	nm := &noteMap{sounding: *midi.MakeNoteQueue()}
+	nm.held = make(map[int][][]byte)
+	return nm
+}
+
+func noteMapIndex(d []byte) int {
+	return int(d[0] & 0x0F) * 128 + int(d[1])
+}
+
+// nm.noteOn() records keys produced by a NOTE_ON and returns the NOTE_ON
+// messages to send.
+//
+func (nm *noteMap) noteOn(msg gomidi.Message, keys []byte) []gomidi.Message {
+	d := msg.Data
+	index := noteMapIndex(d)
+	nm.held[index] = append(nm.held[index], keys)
+	acc := make([]gomidi.Message, len(keys))
+	for i, k := range keys {
+		acc[i] = gomidi.NewMessage([]byte{d[0], k, d[2]})
+		nm.sounding.Update(acc[i])
+	}
+	return acc
+}
+
+// nm.noteOff() returns the NOTE_OFF messages for the oldest NOTE_ON of the
+// same channel and key.  Keys still produced by other held notes are
+// omitted.  Returns false if the key is not held.
+//
+func (nm *noteMap) noteOff(msg gomidi.Message) ([]gomidi.Message, bool) {
+	d := msg.Data
+	index := noteMapIndex(d)
+	held := nm.held[index]
+	if len(held) == 0 {
+		return nil, false
+	}
+	if len(held) == 1 {
+		delete(nm.held, index)
+	} else {
+		nm.held[index] = held[1:]
+	}
+	ci := d[0] & 0x0F
+	acc := make([]gomidi.Message, 0, len(held[0]))
+	for _, k := range held[0] {
+		off := gomidi.NewMessage([]byte{byte(midi.NOTE_OFF) | ci, k, d[2]})
+		nm.sounding.Update(off)
+		if nm.sounding.OpenCount(ci, k) == 0 {
+			acc = append(acc, off)
+		}
+	}
+	return acc, true
+}
+
+// nm.pressure() returns POLY_PRESSURE messages for keys produced by the
+// oldest held NOTE_ON of the same channel and key.
+// Returns false if the key is not held.
+//
+func (nm *noteMap) pressure(msg gomidi.Message) ([]gomidi.Message, bool) {
+	d := msg.Data
+	held := nm.held[noteMapIndex(d)]
+	if len(held) == 0 {
+		return nil, false
+	}
+	acc := make([]gomidi.Message, len(held[0]))
+	for i, k := range held[0] {
+		acc[i] = gomidi.NewMessage([]byte{d[0], k, d[2]})
+	}
+	return acc, true
+}
+
+// nm.reset() forgets all held notes and returns NOTE_OFF messages for all
+// sounding keys.
+//
+func (nm *noteMap) reset() []gomidi.Message {
+	acc := nm.sounding.OffEvents()
+	nm.sounding.Reset()
+	nm.held = make(map[int][][]byte)
+	return acc
+}
@@ -1,6 +1,7 @@
 package op
 
 import (
+	"encoding/json"
 	goosc "github.com/hypebeast/go-osc/osc"
 	gomidi "gitlab.com/gomidi/midi/v2"
 	"github.com/plewto/pigiron/midi"
@@ -36,9 +37,10 @@ type Operator interface {
 	Parents() map[string]Operator
 	children() map[string]Operator
 	Children() map[string]Operator
+	setParent(name string, parent Operator)
+	setChild(name string, child Operator)
 	IsParentOf(child Operator) bool
 	IsChildOf(parent Operator) bool
-	circularTreeTest(depth int) bool
 	Connect(child Operator) error
 	Disconnect(child Operator) Operator
 	DisconnectAll()
@@ -50,6 +52,10 @@ type Operator interface {
 	Commands() []string
 	addCommandHandler(command string, handler func(*goosc.Message)([]string, error))
 	
+	// Session
+	sessionState() interface{}
+	restoreSessionState(data json.RawMessage) error
+
 	// MIDI
 	MIDIOutputEnabled() bool
 	SetMIDIOutputEnabled(flag bool)
@@ -57,4 +63,9 @@ type Operator interface {
 	Accept(msg gomidi.Message) bool
 	distribute(msg gomidi.Message)
 	Send(msg gomidi.Message)
+
+	// Queue
+	queue() *messageQueue
+	SetQueue(depth int, policy QueuePolicy) error
+	QueueState() (depth int, policy QueuePolicy, pending int, dropped uint64)
 }
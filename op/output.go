@@ -3,6 +3,7 @@ package op
 import (
 	"C"
 	"fmt"
+	"sync"
 	gomidi "gitlab.com/gomidi/midi/v2"
 	goosc "github.com/hypebeast/go-osc/osc"
 	"github.com/plewto/pigiron/backend"
@@ -21,6 +22,7 @@ type MIDIOutput struct {
 }
 
 var outputCache = make(map[string]*MIDIOutput)
+var outputCacheLock sync.Mutex
 
 
 //  Creates new MIDIOutput, does not cache it.
@@ -51,9 +53,21 @@ func NewMIDIOutput(name string, deviceSpec string) (*MIDIOutput, error) {
 		return op, err
 	}
 	portName := port.String()
-	if op, cached = outputCache[portName]; !cached {
-		op = newMIDIOutput(name, port)
+	outputCacheLock.Lock()
+	defer outputCacheLock.Unlock()
+	if op, cached = outputCache[portName]; cached {
+		if current, _ := GetOperator(op.Name()); current == Operator(op) {
+			return op, err
+		}
 	}
+	// Either the device is unused or its MIDIOutput has been deleted, in
+	// which case the cached port is still open and is reused.
+	if OperatorExists(name) {
+		errmsg := "Can not create MIDIOutput, an operator named %s already exists"
+		err = fmt.Errorf(errmsg, name)
+		return nil, err
+	}
+	op = newMIDIOutput(name, port)
 	return op, err
 }
 		
@@ -0,0 +1,157 @@
+package op
+
+/*
+** playclock.go defines absolute time scheduling for MIDIPlayer.
+**
+** Event times are calculated from an anchor point (wall-clock time and
+** track tick) and the current tick duration.  Timing errors therefore do
+** not accumulate over the length of a song.   The anchor is moved whenever
+** the tempo changes.
+**
+*/
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Sleeps shorter than SCHEDULER_SPIN_THRESHOLD are completed by polling.
+//
+const SCHEDULER_SPIN_THRESHOLD = 500 * time.Microsecond
+
+type sleepResult int
+
+const (
+	SLEEP_DONE sleepResult = iota
+	SLEEP_HALTED
+	SLEEP_INTERRUPTED
+)
+
+// sleepUntil blocks until target time.
+// Returns early with SLEEP_HALTED if halt is closed, or SLEEP_INTERRUPTED
+// if a value is received on interrupt.
+//
+func sleepUntil(target time.Time, halt chan bool, interrupt chan bool) sleepResult {
+	if delay := time.Until(target) - SCHEDULER_SPIN_THRESHOLD; delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-halt:
+			timer.Stop()
+			return SLEEP_HALTED
+		case <-interrupt:
+			timer.Stop()
+			return SLEEP_INTERRUPTED
+		case <-timer.C:
+		}
+	}
+	for time.Now().Before(target) {
+		select {
+		case <-halt:
+			return SLEEP_HALTED
+		default:
+			runtime.Gosched()
+		}
+	}
+	return SLEEP_DONE
+}
+
+// playClock converts track ticks to wall-clock time.
+//
+type playClock struct {
+	anchorTime time.Time
+	anchorTick float64
+	tickDuration float64 // μseconds
+}
+
+// pc.start() anchors tick at time t.
+//
+func (pc *playClock) start(tick uint64, t time.Time, tickDuration float64) {
+	pc.anchorTime = t
+	pc.anchorTick = float64(tick)
+	pc.tickDuration = tickDuration
+}
+
+// pc.target() returns the wall-clock time of tick.
+//
+func (pc *playClock) target(tick uint64) time.Time {
+	return pc.targetAt(float64(tick))
+}
+
+// pc.targetAt() returns the wall-clock time of a fractional tick.
+//
+func (pc *playClock) targetAt(tick float64) time.Time {
+	usec := (tick - pc.anchorTick) * pc.tickDuration
+	return pc.anchorTime.Add(time.Duration(usec * 1e3))
+}
+
+// pc.tickAt() returns the, possibly fractional, tick at time t.
+//
+func (pc *playClock) tickAt(t time.Time) float64 {
+	usec := float64(t.Sub(pc.anchorTime)) / 1e3
+	return pc.anchorTick + usec / pc.tickDuration
+}
+
+// pc.retime() changes tick duration, moving the anchor to time t.
+//
+func (pc *playClock) retime(t time.Time, tickDuration float64) {
+	pc.anchorTick = pc.tickAt(t)
+	pc.anchorTime = t
+	pc.tickDuration = tickDuration
+}
+
+// timingStats accumulates event lateness measurements.
+//
+type timingStats struct {
+	lock sync.Mutex
+	count int
+	total time.Duration
+	max time.Duration
+	sumSquares float64
+}
+
+func (ts *timingStats) reset() {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.count = 0
+	ts.total = 0
+	ts.max = 0
+	ts.sumSquares = 0
+}
+
+func (ts *timingStats) update(lateness time.Duration) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.count++
+	ts.total += lateness
+	if lateness > ts.max {
+		ts.max = lateness
+	}
+	usec := float64(lateness) / 1e3
+	ts.sumSquares += usec * usec
+}
+
+// ts.values() returns event count and the mean, maximum and standard
+// deviation of lateness in μseconds.
+//
+func (ts *timingStats) values() (count int, mean float64, max float64, deviation float64) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	count = ts.count
+	if count == 0 {
+		return
+	}
+	mean = float64(ts.total) / 1e3 / float64(count)
+	max = float64(ts.max) / 1e3
+	variance := ts.sumSquares / float64(count) - mean * mean
+	deviation = math.Sqrt(math.Max(variance, 0))
+	return
+}
+
+func (ts *timingStats) String() string {
+	count, mean, max, deviation := ts.values()
+	msg := "events %d, lateness μsec mean %.1f, max %.1f, deviation %.1f"
+	return fmt.Sprintf(msg, count, mean, max, deviation)
+}
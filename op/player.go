@@ -1,8 +1,11 @@
 package op
 
 import (
+	"encoding/json"
 	"time"
 	"fmt"
+	"sync"
+	goosc "github.com/hypebeast/go-osc/osc"
 	"github.com/plewto/pigiron/midi"
 	"github.com/plewto/pigiron/pigerr"
 	"github.com/plewto/pigiron/smf"
@@ -11,6 +14,9 @@ import (
 
 const (
 	PLAYER_START_DELAY = 200 // msec
+	PLAYER_DEFAULT_TEMPO = 120.0
+	PLAYER_MIN_TEMPO_SCALE = 0.1
+	PLAYER_MAX_TEMPO_SCALE = 10.0
 )
 
 var (
@@ -53,15 +59,37 @@ func (st PlayerState) String() string {
 
 type MIDIPlayer struct {
 	baseOperator
+	transportLock sync.Mutex
 	midifile *smf.SMF
+	track smf.Track     // all midifile tracks merged
+	ticks []uint64      // absolute tick time of each track event
 	noteQueue midi.NoteQueue
 	state PlayerState
 	eventIndex int
-	tempo float64
+	currentTick uint64
+	tempoLock sync.Mutex
+	tempo float64         // current tempo from file's tempo map
 	tempoScale float64
-	tickDuration uint64 // μseconds
+	tempoOverride float64 // if non-zero, replaces file's tempo map
+	tempoChanged chan bool
+	clockFollow bool      // tempo follows incoming MIDI clock
+	clockTempo float64    // smoothed tempo of incoming MIDI clock, 0 if unknown
+	clockInterval float64 // smoothed interval between incoming clocks, seconds
+	lastClock time.Time
+	tickDuration uint64 // μseconds, unscaled file time
+	clock playClock
+	timing timingStats
+	clockOut bool       // MIDI clock output enabled
+	clockRunning bool   // clock output enabled for current playLoop
+	clockIndex uint64   // next MIDI clock number
+	positionLock sync.Mutex  // guards fields read by playLoop and queries
 	currentTime uint64  // μseconds
 	enableMIDITransport bool
+	looping bool
+	loopStart uint64    // ticks
+	loopEnd uint64      // ticks
+	halt chan bool      // closed to halt playLoop
+	done chan bool      // closed by playLoop on exit
 }
 
 func newMIDIPlayer(name string) *MIDIPlayer {
@@ -70,17 +98,49 @@ func newMIDIPlayer(name string) *MIDIPlayer {
 	op.midifile = smf.NewSMF()
 	op.noteQueue = *midi.MakeNoteQueue()
 	initTransportHandlers(op)
+	op.initLocateHandlers()
+	op.initTempoHandlers()
+	op.initClockOutHandlers()
+	op.initClockInHandlers()
 	op.enableMIDITransport = true
-	go op.Reset()
+	op.tempoScale = 1.0
+	op.tempoChanged = make(chan bool, 1)
+	op.setTempo(PLAYER_DEFAULT_TEMPO)
+	op.Reset()
 	return op
 }
 
 func (op *MIDIPlayer) Reset() {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	if op.state == PLAYING {
+		op.stop()
+		return
+	}
 	op.killActiveNotes()
 	op.resetControllers()
 	op.state = READY
 }
 
+func (op *MIDIPlayer) Info() string {
+	op.transportLock.Lock()
+	state := op.state
+	op.transportLock.Unlock()
+	s := op.commonInfo()
+	s += fmt.Sprintf("\tState    : %s\n", state)
+	s += fmt.Sprintf("\tFilename : %s\n", op.MediaFilename())
+	s += fmt.Sprintf("\tPosition : %s\n", smf.FormatTime(op.Position()))
+	s += fmt.Sprintf("\tTempo    : %5.1f BPM  (scale %.3f)\n", op.EffectiveTempo(), op.TempoScale())
+	s += fmt.Sprintf("\tTiming   : %s\n", op.timing.String())
+	if looping, start, end := op.loopRegion(); looping {
+		start, end := op.tickToSeconds(start), op.tickToSeconds(end)
+		s += fmt.Sprintf("\tLoop     : %s - %s\n", smf.FormatTime(start), smf.FormatTime(end))
+	} else {
+		s += "\tLoop     : <off>\n"
+	}
+	return s
+}
+
 func (op *MIDIPlayer) MediaFilename() string {
 	return op.midifile.Filename()
 }
@@ -91,6 +151,13 @@ func (op *MIDIPlayer) LoadMedia(filename string) error {
 		return err
 	}
 	op.midifile = mf
+	op.track = mf.MergedTrack()
+	op.ticks = absoluteTicks(op.track)
+	op.positionLock.Lock()
+	if op.loopEnd > op.endTick() {
+		op.looping = false
+	}
+	op.positionLock.Unlock()
 	return err
 }
 
@@ -133,68 +200,414 @@ func (op *MIDIPlayer) killActiveNotes() {
 	op.noteQueue.Reset()
 }
 
+// op.setTempo() sets the file tempo in BPM.
+// The actual playback tempo may differ, see EffectiveTempo().
+//
+func (op *MIDIPlayer) setTempo(tempo float64) {
+	op.tempoLock.Lock()
+	op.tempo = tempo
+	tck := smf.TickDuration(op.midifile.Division(), op.tempo)
+	op.tickDuration = uint64(tck * 1e6)
+	op.tempoLock.Unlock()
+	op.notifyTempoChange()
+}
 
-func (op *MIDIPlayer) Stop() {
+// op.notifyTempoChange() signals playLoop that the playback tempo has changed.
+//
+func (op *MIDIPlayer) notifyTempoChange() {
+	select {
+	case op.tempoChanged <- true:
+	default:
+	}
+}
+
+// op.clearTempoChange() discards a pending tempo change signal.
+//
+func (op *MIDIPlayer) clearTempoChange() {
+	select {
+	case <-op.tempoChanged:
+	default:
+	}
+}
+
+// op.EffectiveTempo() returns the actual playback tempo in BPM.
+// The effective tempo is either the file tempo or the override tempo,
+// multiplied by the tempo scale.  If following MIDI clock, the incoming
+// clock tempo is used.
+//
+func (op *MIDIPlayer) EffectiveTempo() float64 {
+	op.tempoLock.Lock()
+	defer op.tempoLock.Unlock()
+	if op.clockFollow && op.clockTempo > 0 {
+		return op.clockTempo
+	}
+	tempo := op.tempo
+	if op.tempoOverride > 0 {
+		tempo = op.tempoOverride
+	}
+	return tempo * op.tempoScale
+}
+
+// op.playbackTickDuration() returns the actual tick duration in μseconds.
+//
+func (op *MIDIPlayer) playbackTickDuration() float64 {
+	return smf.TickDuration(op.midifile.Division(), op.EffectiveTempo()) * 1e6
+}
+
+// op.SetTempoScale() sets playback tempo scale factor.
+// 1.0 is normal speed, 0.5 half speed.
+//
+func (op *MIDIPlayer) SetTempoScale(scale float64) error {
+	var err error
+	if scale < PLAYER_MIN_TEMPO_SCALE || PLAYER_MAX_TEMPO_SCALE < scale {
+		errmsg := "MIDIPlayer tempo scale out of bounds, expected %.1f <= scale <= %.1f, got %f"
+		err = fmt.Errorf(errmsg, PLAYER_MIN_TEMPO_SCALE, PLAYER_MAX_TEMPO_SCALE, scale)
+		return err
+	}
+	op.tempoLock.Lock()
+	op.tempoScale = scale
+	op.tempoLock.Unlock()
+	op.notifyTempoChange()
+	return err
+}
+
+func (op *MIDIPlayer) TempoScale() float64 {
+	op.tempoLock.Lock()
+	defer op.tempoLock.Unlock()
+	return op.tempoScale
+}
+
+// op.SetTempoOverride() sets a fixed tempo which replaces the file's tempo map.
+// A tempo of 0 restores the file's tempo map.
+//
+func (op *MIDIPlayer) SetTempoOverride(tempo float64) error {
+	var err error
+	if tempo < 0 || smf.MAX_TEMPO < tempo {
+		errmsg := "MIDIPlayer tempo out of bounds: %f"
+		err = fmt.Errorf(errmsg, tempo)
+		return err
+	}
+	op.tempoLock.Lock()
+	op.tempoOverride = tempo
+	op.tempoLock.Unlock()
+	op.notifyTempoChange()
+	return err
+}
+
+// op.start() launches playLoop from the current position.
+// Tempo changes made while stopped are already included in the position,
+// the pending signal is discarded.
+// The transportLock must be held by the caller.
+//
+func (op *MIDIPlayer) start() {
+	op.startAt(time.Time{})
+}
+
+// op.startAt() launches playLoop with the current position anchored at
+// time at.  If at is zero playback begins after PLAYER_START_DELAY.
+// The transportLock must be held by the caller.
+//
+func (op *MIDIPlayer) startAt(at time.Time) {
+	op.clearTempoChange()
+	op.state = PLAYING
+	op.clockRunning = false
+	op.halt = make(chan bool)
+	op.done = make(chan bool)
+	go op.playLoop(op.halt, op.done, at, op.clockOut)
+}
+
+// op.haltPlayLoop() stops playLoop and waits for it to exit.
+// Active notes and controllers are not altered.
+// The transportLock must be held by the caller.
+//
+func (op *MIDIPlayer) haltPlayLoop() {
+	if op.state == PLAYING {
+		op.state = STOPPING
+		close(op.halt)
+		<-op.done
+		if op.clockRunning {
+			op.sendRealtime(midi.STOP)
+		}
+	}
+}
+
+// op.stop() halts playback and resets all notes and controllers.
+// The transportLock must be held by the caller.
+//
+func (op *MIDIPlayer) stop() {
 	fmt.Printf("\nMIDIPlayer %s: STOPPING\n", op.Name())
-	op.state = STOPPING
-	time.Sleep(20 * time.Millisecond)
+	op.haltPlayLoop()
 	op.killActiveNotes()
 	op.resetControllers()
 	op.state = READY
 	fmt.Printf("\nMIDIPlayer %s: STOPPED\n", op.Name())
 }
 
+func (op *MIDIPlayer) Stop() {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	op.stop()
+}
+
+// op.playbackFinished() is called when playLoop reaches the end of the track.
+// The halt argument identifies the playLoop, if playback has since been
+// restarted it is not stopped.
+//
+func (op *MIDIPlayer) playbackFinished(halt chan bool) {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	if op.halt == halt && op.state == PLAYING {
+		op.stop()
+	}
+}
+
 func (op *MIDIPlayer) Continue() error {
 	var err error
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
 	if op.MediaFilename() == "" {
 		errmsg := "No MIDI file loaded"
 		err = fmt.Errorf(errmsg)
 		return err
 	}
+	if op.state == PLAYING {
+		return err
+	}
 	op.noteQueue.Reset()
-	go op.playLoop()
+	op.start()
 	return err
 }
 
 func (op *MIDIPlayer) Play() error {
 	var err error
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	op.haltPlayLoop()
+	op.killActiveNotes()
 	err = op.Reload()
 	if err != nil {
+		op.state = READY
 		return err
 	}
-	op.currentTime = 0
+	op.setPosition(0, 0)
 	op.eventIndex = 0
-	err = op.Continue()
+	op.setTempo(PLAYER_DEFAULT_TEMPO)
+	op.start()
 	return err
 }
-	
-func (op *MIDIPlayer) playLoop() error {
-	var err error
-	var track smf.Track
-	if !(op.state == READY) {
-		errmsg := "MIDIPlayer %s is not ready, try again in a few seconds."
-		err = fmt.Errorf(errmsg, op.Name())
+
+// op.locate() moves the playback position to tick.
+// Tempo, program, controller, pressure and bend values are chased up to
+// the new position and transmitted.
+// The transportLock must be held by the caller and playLoop must not be
+// running.
+//
+func (op *MIDIPlayer) locate(tick uint64) {
+	if tick > op.endTick() {
+		tick = op.endTick()
+	}
+	op.eventIndex = op.indexAtTick(tick)
+	op.setPosition(tick, uint64(op.tickToSeconds(tick) * 1e6))
+	tempo, state := op.chase(op.eventIndex)
+	op.setTempo(tempo)
+	for _, msg := range state.messages() {
+		op.distribute(msg)
+	}
+}
+
+// op.Seek() moves the playback position.
+// spec may be a time in seconds, bar:beat or a marker name.
+// If playing, active notes are stopped and playback continues from the
+// new position.
+//
+func (op *MIDIPlayer) Seek(spec string) error {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	if op.MediaFilename() == "" {
+		return fmt.Errorf("No MIDI file loaded")
+	}
+	tick, err := op.locateTick(spec)
+	if err != nil {
 		return err
 	}
-	op.state = PLAYING
-	time.Sleep(PLAYER_START_DELAY * time.Millisecond)
-	fmt.Printf("\nMIDIPlayer %s: PLAYING\n", op.Name())
-	track, err = op.midifile.Track(0)
+	op.seekTick(tick)
+	return err
+}
+
+// op.seekTick() moves the playback position to tick, restarting playback
+// if the player is running.
+// The transportLock must be held by the caller.
+//
+func (op *MIDIPlayer) seekTick(tick uint64) {
+	wasPlaying := op.state == PLAYING
+	op.haltPlayLoop()
+	op.killActiveNotes()
+	op.locate(tick)
+	if wasPlaying {
+		op.start()
+	} else {
+		op.state = READY
+		if op.clockOut {
+			op.sendSongPosition(op.songPosition(tick))
+		}
+	}
+}
+
+// op.SetLoop() sets a region which is repeated during playback.
+// start and end use the same specifications as Seek.
+//
+func (op *MIDIPlayer) SetLoop(start string, end string) error {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	if op.MediaFilename() == "" {
+		return fmt.Errorf("No MIDI file loaded")
+	}
+	t0, err := op.locateTick(start)
 	if err != nil {
 		return err
 	}
-	events := track.Events()
-	op.eventIndex = 0
+	t1, err := op.locateTick(end)
+	if err != nil {
+		return err
+	}
+	if t1 > op.endTick() {
+		t1 = op.endTick()
+	}
+	if t0 >= t1 {
+		errmsg := "Loop start '%s' must be before loop end '%s'"
+		err = fmt.Errorf(errmsg, start, end)
+		return err
+	}
+	op.positionLock.Lock()
+	op.loopStart, op.loopEnd = t0, t1
+	op.looping = true
+	op.positionLock.Unlock()
+	return err
+}
+
+// op.ClearLoop() disables looping.
+//
+func (op *MIDIPlayer) ClearLoop() {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
+	op.positionLock.Lock()
+	op.looping = false
+	op.positionLock.Unlock()
+}
+
+// op.loopRegion() returns true, with start and end ticks, if looping is
+// enabled.
+//
+func (op *MIDIPlayer) loopRegion() (looping bool, start uint64, end uint64) {
+	op.positionLock.Lock()
+	defer op.positionLock.Unlock()
+	return op.looping, op.loopStart, op.loopEnd
+}
+
+// op.setPosition() sets the current position in ticks and μseconds.
+// The position is only changed by playLoop, or while playLoop is not
+// running.
+//
+func (op *MIDIPlayer) setPosition(tick uint64, usec uint64) {
+	op.positionLock.Lock()
+	defer op.positionLock.Unlock()
+	op.currentTick = tick
+	op.currentTime = usec
+}
+
+// op.sleepToTick() sleeps until the scheduled time of, possibly fractional, tick.
+// Tempo changes made while waiting are applied to the remaining time.
+// Returns the scheduled time and false if playback was halted while waiting.
+//
+func (op *MIDIPlayer) sleepToTick(tick float64, halt chan bool) (time.Time, bool) {
+	for {
+		target := op.clock.targetAt(tick)
+		switch sleepUntil(target, halt, op.tempoChanged) {
+		case SLEEP_HALTED:
+			return target, false
+		case SLEEP_INTERRUPTED:
+			op.clock.retime(time.Now(), op.playbackTickDuration())
+		default:
+			return target, true
+		}
+	}
+}
+
+// op.waitUntil() sleeps until the scheduled time of tick, sending any
+// MIDI clocks due before then.
+// The current position advances in unscaled file time.
+// Returns false if playback was halted while waiting.
+//
+func (op *MIDIPlayer) waitUntil(tick uint64, halt chan bool) bool {
+	if !op.sendClocks(tick, halt) {
+		return false
+	}
+	target, ok := op.sleepToTick(float64(tick), halt)
+	if !ok {
+		return false
+	}
+	op.timing.update(time.Since(target))
+	op.setPosition(tick, op.currentTime + op.tickDuration * (tick - op.currentTick))
+	return true
+}
+
+// op.retimeAt() applies a tempo change scheduled at tick.
+//
+func (op *MIDIPlayer) retimeAt(tick uint64) {
+	op.clearTempoChange()
+	op.clock.retime(op.clock.target(tick), op.playbackTickDuration())
+}
+
+func (op *MIDIPlayer) playLoop(halt chan bool, done chan bool, at time.Time, clockOut bool) {
+	defer close(done)
+	if at.IsZero() {
+		select {
+		case <-halt:
+			return
+		case <-time.After(PLAYER_START_DELAY * time.Millisecond):
+		}
+		at = time.Now()
+	}
+	fmt.Printf("\nMIDIPlayer %s: PLAYING\n", op.Name())
+	events := op.track.Events()
+	op.timing.reset()
+	op.clock.start(op.currentTick, at, op.playbackTickDuration())
+	op.clockRunning = clockOut
+	op.clockStart()
 	for op.eventIndex < len(events) {
-		event := events[op.eventIndex]
-		delay := time.Duration(op.tickDuration * event.DeltaTime())
-		time.Sleep(delay * time.Microsecond)
-		d := event.Message().Data
+		tick := op.ticks[op.eventIndex]
+		looping, loopStart, loopEnd := op.loopRegion()
+		if looping && op.currentTick < loopEnd && tick >= loopEnd {
+			if !op.waitUntil(loopEnd, halt) {
+				return
+			}
+			op.killActiveNotes()
+			op.eventIndex = op.indexAtTick(loopStart)
+			tempo, state := op.chase(op.eventIndex)
+			op.setTempo(tempo)
+			for _, msg := range state.messages() {
+				op.distribute(msg)
+			}
+			wrapTime := op.clock.target(loopEnd)
+			op.clock.start(loopStart, wrapTime, op.playbackTickDuration())
+			op.clearTempoChange()
+			op.setPosition(loopStart, uint64(op.tickToSeconds(loopStart) * 1e6))
+			if op.clockRunning {
+				op.sendRealtime(midi.STOP)
+				op.clockStart()
+			}
+			continue
+		}
+		if !op.waitUntil(tick, halt) {
+			return
+		}
+		msg := events[op.eventIndex].Message()
+		op.eventIndex++
+		d := msg.Data
 		if len(d) == 0 {
 			continue
 		}
 		st := midi.StatusByte(d[0])
-		msg := event.Message()
 		switch {
 		case midi.IsChannelStatus(st):
 			op.distribute(msg)
@@ -202,22 +615,22 @@ func (op *MIDIPlayer) playLoop() error {
 		case midi.IsSystemStatus(st):
 			op.distribute(msg)
 		case midi.IsMetaStatus(st):
-			var exitFlag bool
-			exitFlag, err = op.handleMeta(msg)
-			if exitFlag || err != nil {
-				break
+			exitFlag, err := op.handleMeta(msg)
+			if err != nil {
+				pigerr.Warning(err.Error())
+			}
+			if smf.IsTempoChange(msg) {
+				op.retimeAt(tick)
+			}
+			if exitFlag {
+				go op.playbackFinished(halt)
+				return
 			}
 		default:
 			// ignore
 		} 
-		if op.state != PLAYING {
-			break
-		}
-		op.currentTime += uint64(delay)
-		op.eventIndex++
 	}
-	op.Stop()
-	return err
+	go op.playbackFinished(halt)
 }
 
 func (op *MIDIPlayer) handleMeta(msg gomidi.Message) (exitFlag bool, err error) {
@@ -230,15 +643,13 @@ func (op *MIDIPlayer) handleMeta(msg gomidi.Message) (exitFlag bool, err error)
 	mtype := midi.MetaType(msg.Data[1])
 	switch {
 	case smf.IsTempoChange(msg):
-		op.tempo, err = smf.MetaTempoBPM(msg)
-		if err != nil {
+		tempo, terr := smf.MetaTempoBPM(msg)
+		if terr != nil {
 			errmsg := "Meta tempo message looks weird, using default 120 BPM"
-			pigerr.Warning(errmsg, err.Error())
-			op.tempo = 120.0
+			pigerr.Warning(errmsg, terr.Error())
+			tempo = PLAYER_DEFAULT_TEMPO
 		}
-		div := op.midifile.Division()
-		tck := smf.TickDuration(div, op.tempo)
-		op.tickDuration = uint64(tck * 1e6)
+		op.setTempo(tempo)
 		exitFlag, err = false, nil
 		return
 	case smf.IsTextMessage(msg):
@@ -254,11 +665,15 @@ func (op *MIDIPlayer) handleMeta(msg gomidi.Message) (exitFlag bool, err error)
 }
 
 func (op *MIDIPlayer) IsReady() bool {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
 	return op.state == READY
 }
 
 
 func (op *MIDIPlayer) IsPlaying() bool {
+	op.transportLock.Lock()
+	defer op.transportLock.Unlock()
 	return op.state == PLAYING
 }
 	
@@ -271,7 +686,9 @@ func (op *MIDIPlayer) Duration() float64 {
 }
 
 func (op *MIDIPlayer) Position() float64 {
-	return float64(op.currentTime / 1e6)
+	op.positionLock.Lock()
+	defer op.positionLock.Unlock()
+	return float64(op.currentTime) / 1e6
 }
 	
 func (op *MIDIPlayer) EnableMIDITransport(flag bool) {
@@ -281,3 +698,124 @@ func (op *MIDIPlayer) EnableMIDITransport(flag bool) {
 func (op *MIDIPlayer) MIDITransportEnabled() bool {
 	return op.enableMIDITransport
 }
+
+func (op *MIDIPlayer) initTempoHandlers() {
+
+	// op name, set-tempo-scale, scale
+	//
+	remoteSetTempoScale := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetTempoScale(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-tempo-scale
+	//
+	remoteQueryTempoScale := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%.3f", op.TempoScale())}, err
+	}
+
+	// op name, set-tempo, bpm
+	// A tempo of 0 restores the file's tempo map.
+	//
+	remoteSetTempo := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetTempoOverride(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-tempo
+	// Returns effective playback tempo in BPM.
+	//
+	remoteQueryTempo := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%.3f", op.EffectiveTempo())}, err
+	}
+
+	// op name, q-timing-stats
+	// Returns event count and the mean, maximum and standard deviation of
+	// event lateness in μseconds, since playback started.
+	//
+	remoteQueryTimingStats := func(msg *goosc.Message)([]string, error) {
+		var err error
+		count, mean, max, deviation := op.timing.values()
+		acc := []string{
+			fmt.Sprintf("%d", count),
+			fmt.Sprintf("%.1f", mean),
+			fmt.Sprintf("%.1f", max),
+			fmt.Sprintf("%.1f", deviation)}
+		return acc, err
+	}
+
+	op.addCommandHandler("set-tempo-scale", remoteSetTempoScale)
+	op.addCommandHandler("q-tempo-scale", remoteQueryTempoScale)
+	op.addCommandHandler("set-tempo", remoteSetTempo)
+	op.addCommandHandler("q-tempo", remoteQueryTempo)
+	op.addCommandHandler("q-timing-stats", remoteQueryTimingStats)
+}
+
+
+type playerSession struct {
+	Filename string       `json:"filename,omitempty"`
+	MIDITransport bool    `json:"midi-transport"`
+	TempoScale float64    `json:"tempo-scale"`
+	Tempo float64         `json:"tempo"`  // override, 0 for file's tempo map
+	ClockOut bool         `json:"clock-out"`
+	ClockFollow bool      `json:"clock-follow"`
+	Loop []uint64         `json:"loop,omitempty"`  // start and end ticks
+}
+
+func (op *MIDIPlayer) sessionState() interface{} {
+	state := &playerSession{
+		Filename: op.MediaFilename(),
+		MIDITransport: op.enableMIDITransport,
+		TempoScale: op.TempoScale(),
+		ClockOut: op.ClockOutEnabled(),
+		ClockFollow: op.ClockFollowEnabled()}
+	op.tempoLock.Lock()
+	state.Tempo = op.tempoOverride
+	op.tempoLock.Unlock()
+	if looping, start, end := op.loopRegion(); looping {
+		state.Loop = []uint64{start, end}
+	}
+	return state
+}
+
+func (op *MIDIPlayer) restoreSessionState(data json.RawMessage) error {
+	state := op.sessionState().(*playerSession)
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+	op.EnableMIDITransport(state.MIDITransport)
+	op.EnableClockOut(state.ClockOut)
+	op.EnableClockFollow(state.ClockFollow)
+	if err = op.SetTempoScale(state.TempoScale); err != nil {
+		return err
+	}
+	if err = op.SetTempoOverride(state.Tempo); err != nil {
+		return err
+	}
+	if state.Filename != "" {
+		if err = op.LoadMedia(state.Filename); err != nil {
+			return err
+		}
+	}
+	op.ClearLoop()
+	if len(state.Loop) == 2 && state.Loop[0] < state.Loop[1] && state.Loop[1] <= op.endTick() {
+		op.transportLock.Lock()
+		op.positionLock.Lock()
+		op.loopStart, op.loopEnd = state.Loop[0], state.Loop[1]
+		op.looping = true
+		op.positionLock.Unlock()
+		op.transportLock.Unlock()
+	}
+	return err
+}
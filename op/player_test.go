@@ -0,0 +1,155 @@
+package op
+
+import (
+	"sync"
+	"testing"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	"github.com/plewto/pigiron/midi"
+)
+
+func TestPlayerSlaveStart(t *testing.T) {
+	player := newMIDIPlayer("player")
+	if err := player.LoadMedia("!/resources/testFiles/a1.mid"); err != nil {
+		t.Fatal(err)
+	}
+	first := -1
+	for i, ev := range player.track.Events() {
+		d := ev.Message().Data
+		if len(d) > 0 && midi.IsChannelStatus(midi.StatusByte(d[0])) {
+			first = i
+			break
+		}
+	}
+	if first == -1 {
+		t.Fatal("Test file has no channel events")
+	}
+	due := time.Duration(player.tickToSeconds(player.ticks[first]) * float64(time.Second))
+	out := newCollectingOperator("out")
+	player.Connect(out)
+	out.take()
+
+	start := time.Now()
+	player.Send(gomidi.NewMessage([]byte{byte(midi.START)}))
+	defer player.Stop()
+	deadline := start.Add(due + time.Second)
+	// Chased controller values are sent immediately, wait for the first note.
+	for noteOn := false; !noteOn; {
+		for _, d := range out.take() {
+			noteOn = noteOn || d[0] & 0xF0 == 0x90
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("No events after START")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	late := time.Since(start) - due
+	if late > 50 * time.Millisecond {
+		t.Fatalf("First event %v late after START", late)
+	}
+}
+
+func TestPlayerTempo(t *testing.T) {
+	player := newMIDIPlayer("player")
+	if err := player.LoadMedia("!/resources/testFiles/a3.mid"); err != nil {
+		t.Fatal(err)
+	}
+	player.Seek("1:1")
+	if player.EffectiveTempo() != PLAYER_DEFAULT_TEMPO {
+		t.Fatalf("Expected default tempo at start, got %f", player.EffectiveTempo())
+	}
+	player.Seek("1:2")
+	expect := func(tempo float64) {
+		t.Helper()
+		if got := player.EffectiveTempo(); got < tempo - 1e-9 || tempo + 1e-9 < got {
+			t.Fatalf("Expected tempo %f, got %f", tempo, got)
+		}
+		// division 24
+		usec := 60e6 / tempo / 24
+		if got := player.playbackTickDuration(); got < usec - 1e-6 || usec + 1e-6 < got {
+			t.Fatalf("Expected tick duration %f, got %f", usec, got)
+		}
+	}
+	expect(60)
+	player.SetTempoScale(1.5)
+	expect(90)
+	player.SetTempoOverride(100)
+	expect(150)
+	player.SetTempoOverride(0)
+	player.SetTempoScale(1)
+	player.Seek("verse")
+	expect(60)
+	player.Seek("3:1")
+	expect(120)
+	if err := player.SetTempoScale(PLAYER_MAX_TEMPO_SCALE * 2); err == nil {
+		t.Fatal("Expected error for excessive tempo scale")
+	}
+	if err := player.SetTempoOverride(-1); err == nil {
+		t.Fatal("Expected error for negative tempo")
+	}
+}
+
+// clockCounter counts realtime messages and records the time of each
+// MIDI clock.
+//
+type clockCounter struct {
+	baseOperator
+	lock sync.Mutex
+	counts map[byte]int
+	clocks []time.Time
+}
+
+func newClockCounter(name string) *clockCounter {
+	op := new(clockCounter)
+	initOperator(&op.baseOperator, "ClockCounter", name, midi.NoChannel)
+	op.counts = make(map[byte]int)
+	return op
+}
+
+func (op *clockCounter) Send(msg gomidi.Message) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	st := msg.Data[0]
+	op.counts[st]++
+	if st == byte(midi.CLOCK) {
+		op.clocks = append(op.clocks, time.Now())
+	}
+}
+
+func TestPlayerClockOut(t *testing.T) {
+	player := newMIDIPlayer("player")
+	if err := player.LoadMedia("!/resources/testFiles/a1.mid"); err != nil {
+		t.Fatal(err)
+	}
+	counter := newClockCounter("counter")
+	player.Connect(counter)
+	player.EnableClockOut(true)
+
+	// a1.mid is 144 ticks at 60 BPM, division 24, one MIDI clock per tick.
+	// At 10 x 60 BPM each clock is 4.167 msec.
+	player.SetTempoScale(10)
+	player.Play()
+	deadline := time.Now().Add(2 * time.Second)
+	for player.IsPlaying() {
+		if time.Now().After(deadline) {
+			player.Stop()
+			t.Fatal("Playback did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	if counter.counts[byte(midi.START)] != 1 || counter.counts[byte(midi.STOP)] != 1 {
+		t.Fatalf("Expected one START and STOP, got %v", counter.counts)
+	}
+	if n := len(counter.clocks); n != 144 {
+		t.Fatalf("Expected 144 clocks, got %d", n)
+	}
+
+	// Clocks are scheduled from the start time and do not drift.
+	span := counter.clocks[143].Sub(counter.clocks[0])
+	due := 143 * time.Minute / 600 / 24
+	if span < due - 10 * time.Millisecond || due + 10 * time.Millisecond < span {
+		t.Fatalf("Expected clocks spanning %v, got %v", due, span)
+	}
+}
@@ -0,0 +1,566 @@
+package op
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+const (
+	QUANTIZE_NEAREST = "nearest"
+	QUANTIZE_UP = "up"
+	QUANTIZE_DOWN = "down"
+	QUANTIZE_DROP = "drop"
+	QUANTIZE_CUSTOM_SCALE = "custom"
+	QUANTIZE_MAX_HARMONY = 14
+)
+
+// QuantizeRoundingModes lists the ScaleQuantizer rounding modes.
+//
+var QuantizeRoundingModes = []string{QUANTIZE_NEAREST, QUANTIZE_UP, QUANTIZE_DOWN, QUANTIZE_DROP}
+
+// scaleTypes defines the built-in scales as pitch classes relative to the
+// root.
+//
+var scaleTypes = map[string][]int{
+	"major":            {0, 2, 4, 5, 7, 9, 11},
+	"ionian":           {0, 2, 4, 5, 7, 9, 11},
+	"dorian":           {0, 2, 3, 5, 7, 9, 10},
+	"phrygian":         {0, 1, 3, 5, 7, 8, 10},
+	"lydian":           {0, 2, 4, 6, 7, 9, 11},
+	"mixolydian":       {0, 2, 4, 5, 7, 9, 10},
+	"minor":            {0, 2, 3, 5, 7, 8, 10},
+	"aeolian":          {0, 2, 3, 5, 7, 8, 10},
+	"locrian":          {0, 1, 3, 5, 6, 8, 10},
+	"harmonic-minor":   {0, 2, 3, 5, 7, 8, 11},
+	"melodic-minor":    {0, 2, 3, 5, 7, 9, 11},
+	"major-pentatonic": {0, 2, 4, 7, 9},
+	"minor-pentatonic": {0, 3, 5, 7, 10},
+	"blues":            {0, 3, 5, 6, 7, 10},
+	"whole-tone":       {0, 2, 4, 6, 8, 10},
+	"chromatic":        {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+}
+
+// ScaleTypes() returns sorted list of built-in scale names.
+//
+func ScaleTypes() []string {
+	acc := make([]string, 0, len(scaleTypes))
+	for name := range scaleTypes {
+		acc = append(acc, name)
+	}
+	sort.Strings(acc)
+	return acc
+}
+
+// ScaleQuantizer is an Operator which moves notes to a scale.
+//
+// Keys outside the scale are moved to the nearest scale key, the next key
+// up or down, or dropped, depending on the rounding mode.  An optional
+// diatonic harmony adds notes a number of scale degrees from the
+// quantized key, for example 2 for a third above or 5 for a sixth.
+//
+// NOTE_OFF and POLY_PRESSURE follow the keys produced by their NOTE_ON,
+// even if the scale has since changed.  All other messages are passed
+// unchanged.
+//
+type ScaleQuantizer struct {
+	baseOperator
+	lock sync.Mutex
+	root int
+	scale string
+	pitchClasses [12]bool   // relative to root
+	rounding string
+	harmony []int
+	notes *noteMap
+}
+
+func newScaleQuantizer(name string) *ScaleQuantizer {
+	op := new(ScaleQuantizer)
+	initOperator(&op.baseOperator, "ScaleQuantizer", name, midi.NoChannel)
+	op.notes = newNoteMap()
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() releases all notes and selects C major, nearest rounding
+// without harmony.
+//
+func (op *ScaleQuantizer) Reset() {
+	op.lock.Lock()
+	op.release()
+	op.root = 0
+	op.rounding = QUANTIZE_NEAREST
+	op.harmony = []int{}
+	op.lock.Unlock()
+	op.SelectScale("major")
+	base := &op.baseOperator
+	base.Reset()
+}
+
+func (op *ScaleQuantizer) Panic() {
+	op.lock.Lock()
+	op.release()
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Panic()
+}
+
+// The lock must be held by the caller.
+//
+func (op *ScaleQuantizer) release() {
+	for _, off := range op.notes.reset() {
+		op.distribute(off)
+	}
+}
+
+// op.SetRoot() sets scale root pitch class.
+//
+func (op *ScaleQuantizer) SetRoot(pc int) error {
+	var err error
+	if pc < 0 || 11 < pc {
+		errmsg := "Expected root pitch class between 0 and 11, got %d"
+		err = fmt.Errorf(errmsg, pc)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.root = pc
+	return err
+}
+
+func (op *ScaleQuantizer) Root() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.root
+}
+
+// op.SelectScale() selects a built-in scale, see ScaleTypes().
+//
+func (op *ScaleQuantizer) SelectScale(name string) error {
+	var err error
+	name = strings.ToLower(strings.TrimSpace(name))
+	pcs, exists := scaleTypes[name]
+	if !exists {
+		errmsg := "Unknown scale '%s', expected one of: %s"
+		err = fmt.Errorf(errmsg, name, strings.Join(ScaleTypes(), ", "))
+		return err
+	}
+	op.setPitchClasses(name, pcs)
+	return err
+}
+
+// op.SetPitchClasses() selects a custom scale.
+// Pitch classes, 0 <= pc < 12, are relative to the root.
+//
+func (op *ScaleQuantizer) SetPitchClasses(pcs []int) error {
+	var err error
+	if len(pcs) == 0 {
+		err = errors.New("Expected at least one pitch class")
+		return err
+	}
+	for _, pc := range pcs {
+		if pc < 0 || 11 < pc {
+			errmsg := "Expected pitch class between 0 and 11, got %d"
+			err = fmt.Errorf(errmsg, pc)
+			return err
+		}
+	}
+	op.setPitchClasses(QUANTIZE_CUSTOM_SCALE, pcs)
+	return err
+}
+
+func (op *ScaleQuantizer) setPitchClasses(name string, pcs []int) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.scale = name
+	op.pitchClasses = [12]bool{}
+	for _, pc := range pcs {
+		op.pitchClasses[pc] = true
+	}
+}
+
+// op.Scale() returns scale name, or QUANTIZE_CUSTOM_SCALE.
+//
+func (op *ScaleQuantizer) Scale() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.scale
+}
+
+// op.PitchClasses() returns the scale pitch classes relative to the root.
+//
+func (op *ScaleQuantizer) PitchClasses() []int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	acc := make([]int, 0, 12)
+	for pc, flag := range op.pitchClasses {
+		if flag {
+			acc = append(acc, pc)
+		}
+	}
+	return acc
+}
+
+// op.SetRounding() selects how keys outside the scale are treated, see
+// QuantizeRoundingModes.  Keys exactly between scale keys are rounded down
+// in nearest mode.
+//
+func (op *ScaleQuantizer) SetRounding(mode string) error {
+	var err error
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	for _, m := range QuantizeRoundingModes {
+		if m == mode {
+			op.lock.Lock()
+			op.rounding = mode
+			op.lock.Unlock()
+			return err
+		}
+	}
+	errmsg := "Unknown rounding mode '%s', expected one of: %s"
+	err = fmt.Errorf(errmsg, mode, strings.Join(QuantizeRoundingModes, ", "))
+	return err
+}
+
+func (op *ScaleQuantizer) Rounding() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.rounding
+}
+
+// op.SetHarmony() sets harmony notes as scale degrees relative to the
+// quantized key.  For example 2 adds a third above, -2 a third below and
+// 5 a sixth above.  An empty list disables harmony.
+//
+func (op *ScaleQuantizer) SetHarmony(degrees []int) error {
+	var err error
+	for _, d := range degrees {
+		if d == 0 || d < -QUANTIZE_MAX_HARMONY || QUANTIZE_MAX_HARMONY < d {
+			errmsg := "Expected non-zero harmony degree between -%d and %d, got %d"
+			err = fmt.Errorf(errmsg, QUANTIZE_MAX_HARMONY, QUANTIZE_MAX_HARMONY, d)
+			return err
+		}
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.harmony = append([]int{}, degrees...)
+	return err
+}
+
+func (op *ScaleQuantizer) Harmony() []int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return append([]int{}, op.harmony...)
+}
+
+// The lock must be held by the caller.
+//
+func (op *ScaleQuantizer) inScale(key int) bool {
+	return 0 <= key && key < 128 && op.pitchClasses[(key - op.root + 120) % 12]
+}
+
+// op.quantize() returns the scale key for key.
+// Returns false if the key is dropped.
+// The lock must be held by the caller.
+//
+func (op *ScaleQuantizer) quantize(key int) (int, bool) {
+	if op.inScale(key) {
+		return key, true
+	}
+	for d := 1; d < 12; d++ {
+		switch op.rounding {
+		case QUANTIZE_UP:
+			if op.inScale(key + d) {
+				return key + d, true
+			}
+		case QUANTIZE_DOWN:
+			if op.inScale(key - d) {
+				return key - d, true
+			}
+		case QUANTIZE_NEAREST:
+			if op.inScale(key - d) {
+				return key - d, true
+			}
+			if op.inScale(key + d) {
+				return key + d, true
+			}
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// op.scaleStep() returns the scale key degrees steps from key.
+// Returns false if the result is outside the MIDI key range.
+// The lock must be held by the caller.
+//
+func (op *ScaleQuantizer) scaleStep(key int, degrees int) (int, bool) {
+	direction := 1
+	if degrees < 0 {
+		direction, degrees = -1, -degrees
+	}
+	for ; degrees > 0; degrees-- {
+		key += direction
+		for !op.inScale(key) {
+			if key < 0 || 127 < key {
+				return 0, false
+			}
+			key += direction
+		}
+	}
+	return key, true
+}
+
+// op.keys() returns the quantized and harmony keys for key.
+// The lock must be held by the caller.
+//
+func (op *ScaleQuantizer) keys(key byte) []byte {
+	acc := make([]byte, 0, 1 + len(op.harmony))
+	q, ok := op.quantize(int(key))
+	if !ok {
+		return acc
+	}
+	acc = append(acc, byte(q))
+	for _, d := range op.harmony {
+		if k, ok := op.scaleStep(q, d); ok && bytes.IndexByte(acc, byte(k)) < 0 {
+			acc = append(acc, byte(k))
+		}
+	}
+	return acc
+}
+
+func (op *ScaleQuantizer) Send(msg gomidi.Message) {
+	d := msg.Data
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	var messages []gomidi.Message
+	held := true
+	switch {
+	case midi.IsNoteOn(msg):
+		messages = op.notes.noteOn(msg, op.keys(d[1]))
+	case midi.IsNoteOff(msg):
+		messages, held = op.notes.noteOff(msg)
+	case midi.StatusByte(d[0] & 0xF0) == midi.POLY_PRESSURE && len(d) > 2:
+		messages, held = op.notes.pressure(msg)
+	default:
+		held = false
+	}
+	if !held {
+		op.distribute(msg)
+		return
+	}
+	for _, m := range messages {
+		op.distribute(m)
+	}
+}
+
+// rootName() returns the note name of pitch class pc.
+//
+func rootName(pc int) string {
+	return strings.TrimSuffix(midi.KeyName(byte(pc)), "0")
+}
+
+func (op *ScaleQuantizer) Info() string {
+	s := op.commonInfo()
+	s += fmt.Sprintf("\tscale: %s %s %v\n", rootName(op.Root()), op.Scale(), op.PitchClasses())
+	s += fmt.Sprintf("\trounding: %s\n", op.Rounding())
+	s += fmt.Sprintf("\tharmony: %v\n", op.Harmony())
+	return s
+}
+
+
+func (op *ScaleQuantizer) initLocalHandlers() {
+
+	// op name, set-root, pitch-class
+	// pitch-class may be a name (C, F#, Bb ...) or number 0..11.
+	//
+	remoteSetRoot := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		pc, err := midi.ParsePitchClass(args[2].S)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetRoot(pc)
+		return empty, err
+	}
+
+	// op name, q-root
+	//
+	remoteQueryRoot := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{rootName(op.Root())}, err
+	}
+
+	// op name, set-scale, name
+	//
+	remoteSetScale := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SelectScale(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-scale
+	//
+	remoteQueryScale := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.Scale()}, err
+	}
+
+	// op name, q-scales
+	//
+	remoteQueryScales := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return ScaleTypes(), err
+	}
+
+	// op name, set-pitch-classes, pc [, pc ...]
+	//
+	remoteSetPitchClasses := func(msg *goosc.Message)([]string, error) {
+		template := "osi"
+		for i := 3; i < len(msg.Arguments); i++ {
+			template += "i"
+		}
+		args, err := ExpectMsg(template, msg)
+		if err != nil {
+			return empty, err
+		}
+		pcs := make([]int, 0, len(args) - 2)
+		for _, arg := range args[2:] {
+			pcs = append(pcs, int(arg.I))
+		}
+		err = op.SetPitchClasses(pcs)
+		return empty, err
+	}
+
+	// op name, q-pitch-classes
+	//
+	remoteQueryPitchClasses := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return intStrings(op.PitchClasses()), err
+	}
+
+	// op name, set-rounding, mode
+	//
+	remoteSetRounding := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetRounding(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-rounding
+	//
+	remoteQueryRounding := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.Rounding()}, err
+	}
+
+	// op name, set-harmony, degree [, degree ...]
+	// op name, set-harmony, none
+	//
+	remoteSetHarmony := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		if strings.ToLower(args[2].S) == "none" {
+			err = op.SetHarmony([]int{})
+			return empty, err
+		}
+		template := "osi"
+		for i := 3; i < len(msg.Arguments); i++ {
+			template += "i"
+		}
+		args, err = ExpectMsg(template, msg)
+		if err != nil {
+			return empty, err
+		}
+		degrees := make([]int, 0, len(args) - 2)
+		for _, arg := range args[2:] {
+			degrees = append(degrees, int(arg.I))
+		}
+		err = op.SetHarmony(degrees)
+		return empty, err
+	}
+
+	// op name, q-harmony
+	//
+	remoteQueryHarmony := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return intStrings(op.Harmony()), err
+	}
+
+	op.addCommandHandler("set-root", remoteSetRoot)
+	op.addCommandHandler("q-root", remoteQueryRoot)
+	op.addCommandHandler("set-scale", remoteSetScale)
+	op.addCommandHandler("q-scale", remoteQueryScale)
+	op.addCommandHandler("q-scales", remoteQueryScales)
+	op.addCommandHandler("set-pitch-classes", remoteSetPitchClasses)
+	op.addCommandHandler("q-pitch-classes", remoteQueryPitchClasses)
+	op.addCommandHandler("set-rounding", remoteSetRounding)
+	op.addCommandHandler("q-rounding", remoteQueryRounding)
+	op.addCommandHandler("set-harmony", remoteSetHarmony)
+	op.addCommandHandler("q-harmony", remoteQueryHarmony)
+}
+
+// intStrings() converts values to decimal strings.
+//
+func intStrings(values []int) []string {
+	acc := make([]string, len(values))
+	for i, v := range values {
+		acc[i] = fmt.Sprintf("%d", v)
+	}
+	return acc
+}
+
+
+type scaleQuantizerSession struct {
+	Root int              `json:"root"`
+	Scale string          `json:"scale"`
+	PitchClasses []int    `json:"pitch-classes"`
+	Rounding string       `json:"rounding"`
+	Harmony []int         `json:"harmony"`
+}
+
+func (op *ScaleQuantizer) sessionState() interface{} {
+	return &scaleQuantizerSession{op.Root(), op.Scale(), op.PitchClasses(), op.Rounding(), op.Harmony()}
+}
+
+func (op *ScaleQuantizer) restoreSessionState(data json.RawMessage) error {
+	var state scaleQuantizerSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	if err = op.SetRoot(state.Root); err != nil {
+		return err
+	}
+	if state.Scale == QUANTIZE_CUSTOM_SCALE {
+		err = op.SetPitchClasses(state.PitchClasses)
+	} else {
+		err = op.SelectScale(state.Scale)
+	}
+	if err != nil {
+		return err
+	}
+	if err = op.SetRounding(state.Rounding); err != nil {
+		return err
+	}
+	return op.SetHarmony(state.Harmony)
+}
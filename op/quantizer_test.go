@@ -0,0 +1,78 @@
+package op
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestScaleQuantizer(t *testing.T) {
+	quant := newScaleQuantizer("quant")
+	out := newCollectingOperator("out")
+	quant.Connect(out)
+
+	// C major, nearest: C# rounds down to C, D# down to D.
+	sendBytes(quant, 0x90, 60, 100)
+	sendBytes(quant, 0x90, 61, 100)
+	sendBytes(quant, 0x90, 63, 100)
+	expectMessages(t, out, []byte{0x90, 60, 100}, []byte{0x90, 60, 100}, []byte{0x90, 62, 100})
+
+	// Note off follows original mapping after the scale changes, the
+	// shared key is released by the last note.
+	quant.SetRoot(1)
+	quant.SetRounding(QUANTIZE_UP)
+	sendBytes(quant, 0x80, 60, 0)
+	expectMessages(t, out)
+	sendBytes(quant, 0x80, 61, 0)
+	sendBytes(quant, 0x90, 63, 0)
+	expectMessages(t, out, []byte{0x80, 60, 0}, []byte{0x80, 62, 0})
+
+	// Db major, up: D rounds up to Eb.
+	sendBytes(quant, 0x90, 62, 100)
+	sendBytes(quant, 0x80, 62, 0)
+	expectMessages(t, out, []byte{0x90, 63, 100}, []byte{0x80, 63, 0})
+
+	// Drop out-of-scale keys, including their note off.
+	quant.SetRoot(0)
+	quant.SetRounding(QUANTIZE_DROP)
+	sendBytes(quant, 0x90, 61, 100)
+	sendBytes(quant, 0xA0, 61, 20)
+	sendBytes(quant, 0x80, 61, 0)
+	expectMessages(t, out)
+
+	// Diatonic thirds and sixths in A minor.
+	if err := quant.SelectScale("bogus"); err == nil {
+		t.Fatal("Expected error for unknown scale")
+	}
+	quant.SelectScale("minor")
+	quant.SetRoot(9)
+	quant.SetHarmony([]int{2, 5, -2})
+	sendBytes(quant, 0x90, 57, 100)
+	sendBytes(quant, 0x90, 64, 100)
+	expectMessages(t, out,
+		[]byte{0x90, 57, 100}, []byte{0x90, 60, 100}, []byte{0x90, 65, 100}, []byte{0x90, 53, 100},
+		[]byte{0x90, 64, 100}, []byte{0x90, 67, 100}, []byte{0x90, 72, 100}, []byte{0x90, 60, 100})
+	quant.Panic()
+	if got := out.take(); len(got) != 8 {
+		t.Fatalf("Expected 8 note offs, got %v", got)
+	}
+
+	// Custom pitch class set, relative to root.
+	quant.SetHarmony(nil)
+	quant.SetRoot(2)
+	quant.SetRounding(QUANTIZE_DOWN)
+	if err := quant.SetPitchClasses([]int{0, 7}); err != nil {
+		t.Fatal(err)
+	}
+	sendBytes(quant, 0x90, 68, 100)
+	expectMessages(t, out, []byte{0x90, 62, 100})
+
+	// Session round trip
+	data, _ := json.Marshal(quant.sessionState())
+	restored := newScaleQuantizer("restored")
+	if err := restored.restoreSessionState(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Scale() != QUANTIZE_CUSTOM_SCALE || restored.Root() != 2 || len(restored.PitchClasses()) != 2 {
+		t.Fatalf("Session not restored: %s", restored.Info())
+	}
+}
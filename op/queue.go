@@ -0,0 +1,190 @@
+package op
+
+/*
+** queue.go defines optional per-operator message queues.
+**
+** Normally an operator's parent calls its Send method directly, so a slow
+** operator stalls the parent and all siblings which follow it.  An operator
+** with a queue instead receives messages from a buffered channel serviced by
+** a dedicated worker goroutine.  When the queue is full the overflow policy
+** determines which message is lost, or if the sender waits.
+**
+*/
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+const MAX_QUEUE_DEPTH = 4096
+
+// QueuePolicy selects the action taken when a message queue is full.
+//
+type QueuePolicy int
+
+const (
+	QUEUE_DROP_OLDEST QueuePolicy = iota
+	QUEUE_DROP_NEWEST
+	QUEUE_BLOCK
+)
+
+var queuePolicyNames = map[QueuePolicy]string{
+	QUEUE_DROP_OLDEST: "drop-oldest",
+	QUEUE_DROP_NEWEST: "drop-newest",
+	QUEUE_BLOCK: "block"}
+
+func (p QueuePolicy) String() string {
+	return queuePolicyNames[p]
+}
+
+// ParseQueuePolicy() returns the QueuePolicy with the given name.
+//
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	var err error
+	for p, pname := range queuePolicyNames {
+		if strings.ToLower(name) == pname {
+			return p, err
+		}
+	}
+	errmsg := "Expected queue policy drop-oldest, drop-newest or block, got '%s'"
+	err = fmt.Errorf(errmsg, name)
+	return QUEUE_DROP_OLDEST, err
+}
+
+type queueEntry struct {
+	target Operator
+	msg gomidi.Message
+}
+
+type messageQueue struct {
+	dropped uint64  // atomic, must be first for alignment.
+	policy QueuePolicy
+	entries chan queueEntry
+	lock sync.RWMutex  // write locked while stopping.
+	quit chan bool
+	done chan bool     // closed when the worker exits.
+	retired chan bool  // closed when the operator has a replacement queue.
+}
+
+// newMessageQueue() creates a queue and starts its worker.
+//
+func newMessageQueue(depth int, policy QueuePolicy) *messageQueue {
+	q := &messageQueue{
+		policy: policy,
+		entries: make(chan queueEntry, depth),
+		quit: make(chan bool),
+		done: make(chan bool),
+		retired: make(chan bool)}
+	go q.run()
+	return q
+}
+
+// q.run() sends queued messages until the queue is stopped.
+// Pending messages are delivered before returning.
+//
+func (q *messageQueue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case e := <-q.entries:
+			e.target.Send(e.msg)
+		case <-q.quit:
+			for {
+				select {
+				case e := <-q.entries:
+					e.target.Send(e.msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// q.stop() halts the worker and waits until pending messages are
+// delivered.  Messages put after stop are refused.
+//
+func (q *messageQueue) stop() {
+	q.lock.Lock()
+	close(q.quit)
+	q.lock.Unlock()
+	<-q.done
+}
+
+// q.retire() releases senders waiting for the queue's replacement.
+//
+func (q *messageQueue) retire() {
+	close(q.retired)
+}
+
+// q.put() adds a copy of msg for delivery to target.
+// Returns false, without queueing msg, if the queue has been stopped.
+//
+func (q *messageQueue) put(target Operator, msg gomidi.Message) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	select {
+	case <-q.quit:
+		return false
+	default:
+	}
+	data := append([]byte(nil), msg.Data...)
+	e := queueEntry{target, gomidi.NewMessage(data)}
+	switch q.policy {
+	case QUEUE_BLOCK:
+		q.entries <- e
+	case QUEUE_DROP_NEWEST:
+		select {
+		case q.entries <- e:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+	default:
+		for {
+			select {
+			case q.entries <- e:
+				return true
+			default:
+				select {
+				case <-q.entries:
+					atomic.AddUint64(&q.dropped, 1)
+				default:
+				}
+			}
+		}
+	}
+	return true
+}
+
+// q.state() returns queue depth, pending message count and number of
+// dropped messages.
+//
+func (q *messageQueue) state() (depth int, pending int, dropped uint64) {
+	return cap(q.entries), len(q.entries), atomic.LoadUint64(&q.dropped)
+}
+
+func (q *messageQueue) String() string {
+	depth, pending, dropped := q.state()
+	msg := "depth %d, policy %s, pending %d, dropped %d"
+	return fmt.Sprintf(msg, depth, q.policy, pending, dropped)
+}
+
+// deliver() sends msg to op, either directly or by way of op's queue.
+// If the queue is being replaced msg follows the messages already queued.
+//
+func deliver(op Operator, msg gomidi.Message) {
+	for {
+		q := op.queue()
+		if q == nil {
+			op.Send(msg)
+			return
+		}
+		if q.put(op, msg) {
+			return
+		}
+		<-q.retired
+	}
+}
@@ -0,0 +1,226 @@
+package op
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	"github.com/plewto/pigiron/midi"
+)
+
+// gatedOperator holds each received message until the gate is opened.
+//
+type gatedOperator struct {
+	baseOperator
+	gate chan bool
+	lock sync.Mutex
+	received []byte
+}
+
+func newGatedOperator(name string) *gatedOperator {
+	op := new(gatedOperator)
+	initOperator(&op.baseOperator, "Gated", name, midi.NoChannel)
+	op.gate = make(chan bool)
+	return op
+}
+
+func (op *gatedOperator) Send(msg gomidi.Message) {
+	<-op.gate
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.received = append(op.received, msg.Data[1])
+}
+
+func (op *gatedOperator) keys() []byte {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return append([]byte(nil), op.received...)
+}
+
+// waitForPending waits until the queue holds n messages.
+//
+func waitForPending(t *testing.T, op Operator, n int) {
+	for i := 0; i < 1000; i++ {
+		if _, _, pending, _ := op.QueueState(); pending == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Queue of %s did not reach %d pending messages", op.Name(), n)
+}
+
+// waitForKeys waits until op has received n messages.
+//
+func waitForKeys(t *testing.T, op *gatedOperator, n int) []byte {
+	for i := 0; i < 1000; i++ {
+		if keys := op.keys(); len(keys) >= n {
+			return keys
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%s did not receive %d messages", op.Name(), n)
+	return nil
+}
+
+func TestQueueIsolatesSlowChild(t *testing.T) {
+	for _, policy := range []QueuePolicy{QUEUE_DROP_OLDEST, QUEUE_DROP_NEWEST} {
+		source := newDummyOperator("source")
+		slow := newGatedOperator("slow")
+		fast := newCountingOperator("fast")
+		source.Connect(slow)
+		source.Connect(fast)
+		if err := slow.SetQueue(4, policy); err != nil {
+			t.Fatal(err)
+		}
+		// First message is taken by the worker and held at the gate.
+		source.Send(noteOn(0))
+		waitForPending(t, slow, 0)
+		for key := byte(1); key <= 10; key++ {
+			msg := noteOn(key)
+			source.Send(msg)
+			msg.Data[1] = 127  // queued messages must be copies.
+		}
+		if n := atomic.LoadInt64(&fast.count); n != 11 {
+			t.Fatalf("%s: expected 11 messages at fast child, got %d", policy, n)
+		}
+		depth, qpolicy, pending, dropped := slow.QueueState()
+		if depth != 4 || qpolicy != policy || pending != 4 || dropped != 6 {
+			t.Fatalf("%s: unexpected queue state %d %s %d %d", policy, depth, qpolicy, pending, dropped)
+		}
+		close(slow.gate)
+		keys := waitForKeys(t, slow, 5)
+		expect := []byte{0, 7, 8, 9, 10}
+		if policy == QUEUE_DROP_NEWEST {
+			expect = []byte{0, 1, 2, 3, 4}
+		}
+		if string(keys) != string(expect) {
+			t.Fatalf("%s: expected keys %v, got %v", policy, expect, keys)
+		}
+		slow.SetQueue(0, policy)
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	source := newDummyOperator("source")
+	slow := newGatedOperator("slow")
+	source.Connect(slow)
+	slow.SetQueue(2, QUEUE_BLOCK)
+	done := make(chan bool)
+	go func() {
+		for key := byte(0); key < 8; key++ {
+			source.Send(noteOn(key))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected sender to block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(slow.gate)
+	<-done
+	keys := waitForKeys(t, slow, 8)
+	if string(keys) != string([]byte{0, 1, 2, 3, 4, 5, 6, 7}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+	if _, _, _, dropped := slow.QueueState(); dropped != 0 {
+		t.Fatalf("Expected no dropped messages, got %d", dropped)
+	}
+	slow.SetQueue(0, QUEUE_BLOCK)
+}
+
+func TestQueueRemoveDeliversPending(t *testing.T) {
+	source := newDummyOperator("source")
+	slow := newGatedOperator("slow")
+	source.Connect(slow)
+	slow.SetQueue(8, QUEUE_DROP_OLDEST)
+	for key := byte(0); key < 4; key++ {
+		source.Send(noteOn(key))
+	}
+	removed := make(chan bool)
+	go func() {
+		slow.SetQueue(0, QUEUE_DROP_OLDEST)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+		t.Fatal("Expected queue removal to wait for pending messages")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(slow.gate)
+	<-removed
+	if depth, _, _, _ := slow.QueueState(); depth != 0 {
+		t.Fatalf("Expected queue removed, depth is %d", depth)
+	}
+	keys := slow.keys()
+	if string(keys) != string([]byte{0, 1, 2, 3}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+	if err := slow.SetQueue(MAX_QUEUE_DEPTH + 1, QUEUE_BLOCK); err == nil {
+		t.Fatal("Expected error for excessive queue depth")
+	}
+	if _, err := ParseQueuePolicy("sometimes"); err == nil {
+		t.Fatal("Expected error for invalid policy")
+	}
+}
+
+// sequenceOperator records the sequence numbers carried in the data bytes
+// of received messages.
+//
+type sequenceOperator struct {
+	baseOperator
+	lock sync.Mutex
+	received []int
+}
+
+func newSequenceOperator(name string) *sequenceOperator {
+	op := new(sequenceOperator)
+	initOperator(&op.baseOperator, "Sequence", name, midi.NoChannel)
+	return op
+}
+
+func (op *sequenceOperator) Send(msg gomidi.Message) {
+	for start := time.Now(); time.Since(start) < 100 * time.Microsecond; {
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.received = append(op.received, int(msg.Data[1]) << 7 | int(msg.Data[2]))
+}
+
+func TestQueueReplaceKeepsOrder(t *testing.T) {
+	source := newDummyOperator("source")
+	child := newSequenceOperator("child")
+	source.Connect(child)
+	child.SetQueue(64, QUEUE_BLOCK)
+	done := make(chan bool)
+	go func() {
+		for n := 0; n < 2000; n++ {
+			source.Send(gomidi.NewMessage([]byte{0x90, byte(n >> 7), byte(n & 0x7F)}))
+			if n % 32 == 31 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		close(done)
+	}()
+	for depth := 1; ; depth++ {
+		select {
+		case <-done:
+			child.SetQueue(0, QUEUE_BLOCK)
+			child.lock.Lock()
+			defer child.lock.Unlock()
+			if len(child.received) != 2000 {
+				t.Fatalf("Expected 2000 messages, got %d", len(child.received))
+			}
+			for i := 1; i < len(child.received); i++ {
+				if child.received[i] <= child.received[i-1] {
+					t.Fatalf("Message %d received after %d", child.received[i], child.received[i-1])
+				}
+			}
+			return
+		default:
+			child.SetQueue(64 + depth % 64, QUEUE_BLOCK)
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
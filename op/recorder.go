@@ -0,0 +1,522 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+	"github.com/plewto/pigiron/smf"
+)
+
+const (
+	RECORDER_DEFAULT_DIVISION = 480
+	RECORDER_DEFAULT_TEMPO = 120.0
+)
+
+type RecorderState byte
+const (
+	REC_READY RecorderState = iota
+	REC_ARMED
+	REC_RECORDING
+)
+
+func (st RecorderState) String() string {
+	var s string
+	switch st {
+	case REC_READY: s = "READY"
+	case REC_ARMED: s = "ARMED"
+	case REC_RECORDING: s = "RECORDING"
+	default:
+		s = "?"
+	}
+	return s
+}
+
+// recordedEvent is a received MIDI message with time relative to the start of the take.
+//
+type recordedEvent struct {
+	time time.Duration
+	message gomidi.Message
+}
+
+// Recorder is an Operator which captures incoming MIDI messages.
+// All messages are passed unaltered to the Recorder's children.
+// While recording channel and system-exclusive messages are time stamped
+// and may be saved as a format 0 Standard MIDI File.
+//
+// Recorder implements the Transport interface.  play starts a new take,
+// continue appends to the current take and load selects the file
+// which is written when recording stops.
+//
+type Recorder struct {
+	baseOperator
+	lock sync.Mutex
+	saveLock sync.Mutex      // serializes file writes
+	state RecorderState
+	take []recordedEvent
+	startTime time.Time      // wall-clock time corresponding to take time 0
+	stopTime time.Duration   // take time at which recording last stopped
+	noteQueue midi.NoteQueue
+	division int
+	tempo float64
+	filename string
+	enableMIDITransport bool
+}
+
+func newRecorder(name string) *Recorder {
+	op := new(Recorder)
+	initOperator(&op.baseOperator, "Recorder", name, midi.NoChannel)
+	op.noteQueue = *midi.MakeNoteQueue()
+	op.division = RECORDER_DEFAULT_DIVISION
+	op.tempo = RECORDER_DEFAULT_TEMPO
+	op.enableMIDITransport = false
+	op.take = make([]recordedEvent, 0, 1024)
+	initTransportHandlers(op)
+	op.initLocalHandlers()
+	return op
+}
+
+func (op *Recorder) Reset() {
+	op.lock.Lock()
+	op.state = REC_READY
+	op.take = make([]recordedEvent, 0, 1024)
+	op.stopTime = 0
+	op.noteQueue.Reset()
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+func (op *Recorder) Info() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	s := op.commonInfo()
+	fname := op.filename
+	if fname == "" {
+		fname = "<none>"
+	}
+	s += fmt.Sprintf("\tState    : %s\n", op.state)
+	s += fmt.Sprintf("\tEvents   : %d\n", len(op.take))
+	s += fmt.Sprintf("\tDuration : %s\n", smf.FormatTime(op.takeDuration().Seconds()))
+	s += fmt.Sprintf("\tDivision : %d\n", op.division)
+	s += fmt.Sprintf("\tTempo    : %5.1f BPM\n", op.tempo)
+	s += fmt.Sprintf("\tFilename : %s\n", fname)
+	return s
+}
+
+// isRecordable returns true for messages which are saved to the take.
+// Only channel and system-exclusive messages are recorded.
+//
+func isRecordable(msg gomidi.Message) bool {
+	if len(msg.Data) == 0 {
+		return false
+	}
+	st := midi.StatusByte(msg.Data[0])
+	return midi.IsChannelStatus(st) || st == midi.SYSEX
+}
+
+func (op *Recorder) Send(msg gomidi.Message) {
+	if len(msg.Data) == 0 {
+		return
+	}
+	st := midi.StatusByte(msg.Data[0])
+	if op.enableMIDITransport {
+		switch st {
+		case midi.START:
+			op.Play()
+		case midi.CONTINUE:
+			op.Continue()
+		case midi.STOP:
+			// Do not write the file from the MIDI input callback.
+			if mf, filename := op.stop(); mf != nil {
+				go op.write(mf, filename)
+			}
+		default:
+		}
+	}
+	if isRecordable(msg) {
+		op.record(msg)
+	}
+	op.distribute(msg)
+}
+
+// op.record() adds a copy of msg to the take.
+// An ARMED recorder starts recording on reception of the first message.
+//
+func (op *Recorder) record(msg gomidi.Message) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	switch op.state {
+	case REC_ARMED:
+		op.startTime = time.Now().Add(-op.stopTime)
+		op.state = REC_RECORDING
+	case REC_RECORDING:
+	default:
+		return
+	}
+	data := make([]byte, len(msg.Data))
+	copy(data, msg.Data)
+	copied := gomidi.NewMessage(data)
+	op.take = append(op.take, recordedEvent{time.Since(op.startTime), copied})
+	op.noteQueue.Update(copied)
+}
+
+// op.Arm() clears the take and starts recording on the next received message.
+//
+func (op *Recorder) Arm() {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.take = make([]recordedEvent, 0, 1024)
+	op.stopTime = 0
+	op.noteQueue.Reset()
+	op.state = REC_ARMED
+}
+
+// op.Play() clears the take and starts recording immediately.
+// Play is equivalent to the record command.
+//
+func (op *Recorder) Play() error {
+	var err error
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.take = make([]recordedEvent, 0, 1024)
+	op.stopTime = 0
+	op.noteQueue.Reset()
+	op.startTime = time.Now()
+	op.state = REC_RECORDING
+	return err
+}
+
+// op.Continue() resumes recording, appending to the current take.
+// The time between stop and continue is not included in the take.
+//
+func (op *Recorder) Continue() error {
+	var err error
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if op.state == REC_RECORDING {
+		return err
+	}
+	op.startTime = time.Now().Add(-op.stopTime)
+	op.state = REC_RECORDING
+	return err
+}
+
+// op.Stop() halts recording.
+// Note-off messages are added to the take for all unresolved notes.
+// If recording was in progress and a filename has been specified the take
+// is written to it.
+//
+func (op *Recorder) Stop() {
+	if mf, filename := op.stop(); mf != nil {
+		op.write(mf, filename)
+	}
+}
+
+// op.stop() halts recording and returns the take to be written.
+// Returns nil SMF if recording was not in progress or if there is no
+// filename.
+//
+func (op *Recorder) stop() (*smf.SMF, string) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if op.state != REC_RECORDING {
+		op.state = REC_READY
+		return nil, ""
+	}
+	op.stopTime = time.Since(op.startTime)
+	for _, off := range op.noteQueue.OffEvents() {
+		op.take = append(op.take, recordedEvent{op.stopTime, off})
+	}
+	op.noteQueue.Reset()
+	op.state = REC_READY
+	if op.filename == "" {
+		return nil, ""
+	}
+	mf, err := op.takeSMF()
+	if err != nil {
+		fmt.Printf("Recorder %s: %s\n", op.Name(), err)
+		return nil, ""
+	}
+	return mf, op.filename
+}
+
+// op.write() writes mf to filename, reporting errors.
+//
+func (op *Recorder) write(mf *smf.SMF, filename string) {
+	op.saveLock.Lock()
+	defer op.saveLock.Unlock()
+	err := smf.WriteSMF(mf, filename, true)
+	if err != nil {
+		fmt.Printf("Recorder %s: %s\n", op.Name(), err)
+	}
+}
+
+func (op *Recorder) IsPlaying() bool {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.state == REC_RECORDING
+}
+
+// op.LoadMedia() sets the file written when recording stops.
+// The file is not read.
+//
+func (op *Recorder) LoadMedia(filename string) error {
+	var err error
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.filename = filename
+	return err
+}
+
+func (op *Recorder) MediaFilename() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.filename
+}
+
+// op.takeDuration() returns the take length.
+// The lock must be held by the caller.
+//
+func (op *Recorder) takeDuration() time.Duration {
+	if op.state == REC_RECORDING {
+		return time.Since(op.startTime)
+	}
+	return op.stopTime
+}
+
+// op.Duration() returns length of the take in seconds.
+//
+func (op *Recorder) Duration() float64 {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.takeDuration().Seconds()
+}
+
+// op.Position() returns current record position in seconds.
+//
+func (op *Recorder) Position() float64 {
+	return op.Duration()
+}
+
+func (op *Recorder) EnableMIDITransport(flag bool) {
+	op.enableMIDITransport = flag
+}
+
+func (op *Recorder) MIDITransportEnabled() bool {
+	return op.enableMIDITransport
+}
+
+// op.SetDivision() sets the clock division used when saving.
+//
+func (op *Recorder) SetDivision(division int) error {
+	var err error
+	if division < 24 || 960 < division {
+		errmsg := "Recorder division out of bounds, expected between 24 and 960, got %d"
+		err = fmt.Errorf(errmsg, division)
+		return err
+	}
+	op.lock.Lock()
+	op.division = division
+	op.lock.Unlock()
+	return err
+}
+
+// op.SetTempo() sets the tempo, in BPM, used when saving.
+//
+func (op *Recorder) SetTempo(tempo float64) error {
+	var err error
+	if tempo <= 0 || smf.MAX_TEMPO < tempo {
+		errmsg := "Recorder tempo out of bounds: %f"
+		err = fmt.Errorf(errmsg, tempo)
+		return err
+	}
+	op.lock.Lock()
+	op.tempo = tempo
+	op.lock.Unlock()
+	return err
+}
+
+// op.SMF() converts the take to a format 0 SMF.
+//
+func (op *Recorder) SMF() (*smf.SMF, error) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.takeSMF()
+}
+
+// op.takeSMF() converts the take to a format 0 SMF.
+// The lock must be held by the caller.
+//
+func (op *Recorder) takeSMF() (*smf.SMF, error) {
+	mf := smf.NewSMF()
+	err := mf.SetDivision(op.division)
+	if err != nil {
+		return mf, err
+	}
+	track := smf.NewTrack()
+	tempo, err := smf.MakeTempoMessage(op.tempo)
+	if err != nil {
+		return mf, err
+	}
+	track.Append(0, tempo)
+	name, _ := smf.MakeTextMessage(byte(midi.META_TRACK_NAME), op.Name())
+	track.Append(0, name)
+	tick := smf.TickDuration(op.division, op.tempo)
+	var previous uint64 = 0
+	for _, ev := range op.take {
+		t := uint64(ev.time.Seconds()/tick + 0.5)
+		if t < previous {
+			t = previous
+		}
+		track.Append(t - previous, ev.message)
+		previous = t
+	}
+	mf.AddTrack(track)
+	return mf, err
+}
+
+// op.Save() writes the take to a Standard MIDI File.
+//
+func (op *Recorder) Save(filename string) error {
+	mf, err := op.SMF()
+	if err != nil {
+		return err
+	}
+	op.saveLock.Lock()
+	err = smf.WriteSMF(mf, filename, true)
+	op.saveLock.Unlock()
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	op.filename = filename
+	op.lock.Unlock()
+	return err
+}
+
+
+func (op *Recorder) initLocalHandlers() {
+
+	// op name, arm
+	// Recording starts on the next received message.
+	//
+	remoteArm := func(msg *goosc.Message)([]string, error) {
+		var err error
+		op.Arm()
+		return empty, err
+	}
+
+	// op name, record
+	// Starts recording a new take.
+	//
+	remoteRecord := func(msg *goosc.Message)([]string, error) {
+		err := op.Play()
+		return empty, err
+	}
+
+	// op name, save, filename
+	// Returns filename.
+	//
+	remoteSave := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		filename := args[2].S
+		err = op.Save(filename)
+		return []string{filename}, err
+	}
+
+	// op name, set-division, n
+	//
+	remoteSetDivision := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetDivision(int(args[2].I))
+		return empty, err
+	}
+
+	// op name, q-division
+	//
+	remoteQueryDivision := func(msg *goosc.Message)([]string, error) {
+		var err error
+		op.lock.Lock()
+		defer op.lock.Unlock()
+		return []string{fmt.Sprintf("%d", op.division)}, err
+	}
+
+	// op name, set-tempo, bpm
+	//
+	remoteSetTempo := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osf", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetTempo(args[2].F)
+		return empty, err
+	}
+
+	// op name, q-tempo
+	//
+	remoteQueryTempo := func(msg *goosc.Message)([]string, error) {
+		var err error
+		op.lock.Lock()
+		defer op.lock.Unlock()
+		return []string{fmt.Sprintf("%f", op.tempo)}, err
+	}
+
+	// op name, q-state
+	// Returns READY, ARMED or RECORDING
+	//
+	remoteQueryState := func(msg *goosc.Message)([]string, error) {
+		var err error
+		op.lock.Lock()
+		defer op.lock.Unlock()
+		return []string{op.state.String()}, err
+	}
+
+	op.addCommandHandler("arm", remoteArm)
+	op.addCommandHandler("record", remoteRecord)
+	op.addCommandHandler("save", remoteSave)
+	op.addCommandHandler("set-division", remoteSetDivision)
+	op.addCommandHandler("q-division", remoteQueryDivision)
+	op.addCommandHandler("set-tempo", remoteSetTempo)
+	op.addCommandHandler("q-tempo", remoteQueryTempo)
+	op.addCommandHandler("q-state", remoteQueryState)
+}
+
+
+type recorderSession struct {
+	Filename string       `json:"filename,omitempty"`
+	Division int          `json:"division"`
+	Tempo float64         `json:"tempo"`
+	MIDITransport bool    `json:"midi-transport"`
+}
+
+func (op *Recorder) sessionState() interface{} {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return &recorderSession{op.filename, op.division, op.tempo, op.enableMIDITransport}
+}
+
+func (op *Recorder) restoreSessionState(data json.RawMessage) error {
+	state := op.sessionState().(*recorderSession)
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+	if err = op.SetDivision(state.Division); err != nil {
+		return err
+	}
+	if err = op.SetTempo(state.Tempo); err != nil {
+		return err
+	}
+	op.EnableMIDITransport(state.MIDITransport)
+	return op.LoadMedia(state.Filename)
+}
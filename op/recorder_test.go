@@ -0,0 +1,102 @@
+package op
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	"github.com/plewto/pigiron/smf"
+)
+
+// readTake returns absolute tick and data of the channel events in filename.
+//
+func readTake(t *testing.T, filename string) ([]uint64, [][]byte) {
+	t.Helper()
+	mf, err := smf.ReadSMF(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, _ := mf.Track(0)
+	var ticks []uint64
+	var data [][]byte
+	var now uint64
+	for _, ev := range track.Events() {
+		now += ev.DeltaTime()
+		if d := ev.Message().Data; len(d) > 0 && d[0] < 0xF0 {
+			ticks = append(ticks, now)
+			data = append(data, d)
+		}
+	}
+	return ticks, data
+}
+
+func TestRecorderTake(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "take.mid")
+	recorder := newRecorder("recorder")
+	recorder.LoadMedia(filename)
+	send := func(data ...byte) {
+		recorder.Send(gomidi.NewMessage(data))
+	}
+
+	// Stop without recording does not write the file.
+	recorder.Arm()
+	recorder.Stop()
+	if _, err := os.Stat(filename); err == nil {
+		t.Fatal("Expected no file written by arm and stop")
+	}
+
+	// At 120 BPM and division 480 there are 960 ticks per second.
+	recorder.Play()
+	send(0x90, 60, 100)
+	time.Sleep(100 * time.Millisecond)
+	send(0x90, 64, 100)
+	time.Sleep(100 * time.Millisecond)
+	send(0x80, 60, 0)
+	time.Sleep(50 * time.Millisecond)
+	recorder.Stop()
+	ticks, data := readTake(t, filename)
+	expectTicks := []uint64{0, 96, 192, 240}
+	expectData := [][]byte{{0x90, 60, 100}, {0x90, 64, 100}, {0x80, 60, 0}, {0x80, 64, 0}}
+	if len(data) != len(expectData) {
+		t.Fatalf("Expected %v, got %v", expectData, data)
+	}
+	for i := range data {
+		if string(data[i]) != string(expectData[i]) {
+			t.Fatalf("Expected %v, got %v", expectData, data)
+		}
+		if ticks[i] + 20 < expectTicks[i] || expectTicks[i] + 20 < ticks[i] {
+			t.Fatalf("Expected ticks near %v, got %v", expectTicks, ticks)
+		}
+	}
+
+	// A second stop, or arm and stop, keeps the take.
+	recorder.Stop()
+	recorder.Arm()
+	recorder.Stop()
+	if _, data = readTake(t, filename); len(data) != 4 {
+		t.Fatalf("Take overwritten, got %v", data)
+	}
+
+	// MIDI STOP writes the take.
+	os.Remove(filename)
+	recorder.EnableMIDITransport(true)
+	send(0xFA)
+	send(0x91, 48, 90)
+	send(0xFC)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(filename); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected file written on MIDI STOP")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	recorder.saveLock.Lock()
+	recorder.saveLock.Unlock()
+	if _, data = readTake(t, filename); len(data) != 2 || data[1][0] != 0x81 {
+		t.Fatalf("Unexpected MIDI STOP take %v", data)
+	}
+}
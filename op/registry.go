@@ -4,27 +4,47 @@ import (
 	"time"
 	"fmt"
 	"errors"
+	"sort"
+	"sync"
 )
 
 var OperatorTypes = []string{
+	"Arpeggiator",
+	"BankTransformer",
 	"ChannelFilter",
+	"ChannelMapper",
+	"ChordGenerator",
+	"ControllerMapper",
+	"Delay",
 	"SingleChannelFilter",
 	"Disrtributor",
+	"Humanizer",
+	"KeySplit",
 	"MIDIInput",
 	"MIDIOutput",
 	"MIDIPlayer",
 	"Monitor",
-	"Transformer"}
+	"Recorder",
+	"ScaleQuantizer",
+	"StatusFilter",
+	"Transformer",
+	"VelocityCurve",
+	"VoiceLimiter"}
 
 // The registry is a global map holding all current operators. 
 // MIDIInput and MIDIOutput operators are stored separately.
 //
+// registryLock must be held for all registry access.
+//
 var registry map[string]Operator = make(map[string]Operator)
+var registryLock sync.RWMutex
 
 
 // OperatorExists(name) returns true if the registry contains the named operator.
 //
 func OperatorExists(name string) bool {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
 	_, flag := registry[name]
 	return flag
 }
@@ -34,16 +54,27 @@ func OperatorExists(name string) bool {
 // Returns operator's name
 //
 func register(op Operator) string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
 	registry[op.Name()] = op
 	return op.Name()
 }
 
 
+// unregister() removes named operator from the registry.
+//
+func unregister(name string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registry, name)
+}
+
+
 // DumpRegistry() prints the contents of the operator registry.
 //
 func DumpRegistry() {
 	fmt.Println("Operator registry:")
-	for _, op := range registry {
+	for _, op := range sortedOperators() {
 		fmt.Printf("\t%s", op)
 	}
 }
@@ -62,45 +93,94 @@ func DumpRegistry() {
 // If Operator name exist with the same type as opType, the existing
 // operator is reused.
 //
+// The operator is constructed without holding the registry lock.  If a
+// concurrent call registers the same name first, the new operator is
+// closed and the rule above applies to the registered operator.
+//
 func NewOperator(opType string, name string) (Operator, error) {
 	var err error
 	var op Operator
-	if OperatorExists(name) {
-		other, _ := registry[name]
-		if other.OperatorType() != opType {
-			msg := "An operator named %s of type %s already exists\n"
-			msg += "Can not create new %s Operator with same name."
-			err = fmt.Errorf(msg, name, other.OperatorType(), opType)
-			return op, err
-		} else {
-			return GetOperator(name)
-		}
+	registryLock.RLock()
+	other, exists := registry[name]
+	registryLock.RUnlock()
+	if exists {
+		return existingOperator(other, opType)
 	}
 	switch opType {
 	case "Dummy":
 		op = newDummyOperator(name)
+	case "Arpeggiator":
+		op = newArpeggiator(name)
 	case "Monitor":
 		op  = newMonitor(name)
 	case "ChannelFilter":
 		op = newChannelFilter(name)
+	case "ChannelMapper":
+		op = newChannelMapper(name)
+	case "ChordGenerator":
+		op = newChordGenerator(name)
+	case "ControllerMapper":
+		op = newControllerMapper(name)
+	case "Delay":
+		op = newDelay(name)
 	case "SingleChannelFilter":
 	        op = newSingleChannelFilter(name)
+	case "Humanizer":
+		op = newHumanizer(name)
 	case "Distributor":
 		op = newDistributor(name)
+	case "KeySplit":
+		op = newKeySplit(name)
 	case "MIDIPlayer":
 		op = newMIDIPlayer(name)
+	case "Recorder":
+		op = newRecorder(name)
+	case "ScaleQuantizer":
+		op = newScaleQuantizer(name)
+	case "StatusFilter":
+		op = newStatusFilter(name)
 	case "Transformer":
 		op = newTransformer(name)
+	case "BankTransformer":
+		op = newBankTransformer(name)
+	case "VelocityCurve":
+		op = newVelocityCurve(name)
+	case "VoiceLimiter":
+		op = newVoiceLimiter(name)
 	default:
 		sfmt := "Invalid Operator type: '%s'"
 		msg := fmt.Sprintf(sfmt, opType)
 		err = errors.New(msg)
 		return op, err
 	}
-	register(op)
+	registryLock.Lock()
+	other, exists = registry[name]
+	if !exists {
+		registry[name] = op
+	}
+	registryLock.Unlock()
+	if exists {
+		op.Close()
+		return existingOperator(other, opType)
+	}
 	return op, err
 }
 
+// existingOperator() returns other, the registered operator with a
+// requested name, if its type matches opType.  Otherwise returns non-nil
+// error.
+//
+func existingOperator(other Operator, opType string) (Operator, error) {
+	var err error
+	if other.OperatorType() != opType {
+		msg := "An operator named %s of type %s already exists\n"
+		msg += "Can not create new %s Operator with same name."
+		err = fmt.Errorf(msg, other.Name(), other.OperatorType(), opType)
+		return nil, err
+	}
+	return other, err
+}
+
 // DeleteOperator() Deletes named operator.
 // Returns error if operator does not exists or it is a MIDIInput.
 //
@@ -119,8 +199,9 @@ func DeleteOperator(name string) error {
 	op.Panic()
 	time.Sleep(1 * time.Millisecond)
 	op.DisconnectAll()
+	op.SetQueue(0, QUEUE_DROP_OLDEST)
 	op.Close()
-	delete(registry, name)
+	unregister(name)
 	return err
 }
 
@@ -136,7 +217,8 @@ func ClearRegistry() {
 	for _, op := range Operators() {
 		op.DisconnectAll()
 		if op.OperatorType() != "MIDIInput" {
-			delete(registry, op.Name())
+			unregister(op.Name())
+			op.SetQueue(0, QUEUE_DROP_OLDEST)
 			op.Close()
 		}
 	}
@@ -149,11 +231,11 @@ func ClearRegistry() {
 //   2. non-nil error if the operator does not exists.
 //
 func GetOperator(name string) (Operator, error) {
-	var op Operator
 	var err error
-	if OperatorExists(name) {
-		op = registry[name]
-	} else {
+	registryLock.RLock()
+	op, exists := registry[name]
+	registryLock.RUnlock()
+	if !exists {
 		sfmt := "Operator '%s' does not exists"
 		msg := fmt.Sprintf(sfmt, name)
 		err = errors.New(msg)
@@ -165,6 +247,8 @@ func GetOperator(name string) (Operator, error) {
 // Operators() returns unordered slice of all current operators.
 // 
 func Operators() []Operator {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
 	var acc = make([]Operator, 0, len(registry))
 	for _, op := range(registry) {
 		acc = append(acc, op)
@@ -172,10 +256,29 @@ func Operators() []Operator {
 	return acc
 }
 
+// sortedOperators returns all operators ordered by name.
+//
+func sortedOperators() []Operator {
+	ops := Operators()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Name() < ops[j].Name() })
+	return ops
+}
+
+// sortedNames returns the keys of an operator map in order.
+//
+func sortedNames(ops map[string]Operator) []string {
+	acc := make([]string, 0, len(ops))
+	for name, _ := range ops {
+		acc = append(acc, name)
+	}
+	sort.Strings(acc)
+	return acc
+}
+
 // RootOperators() returns slice of all root operators.
 //
 func RootOperators() []Operator {
-	var acc = make([]Operator, 0, len(registry))
+	var acc = make([]Operator, 0)
 	for _, op := range Operators() {
 		if op.IsRoot() {
 			acc = append(acc, op)
@@ -192,7 +295,7 @@ func DestroyForest() {
 }
 
 func Cleanup() {
-	for _, op := range registry {
+	for _, op := range Operators() {
 		op.Close()
 	}
 }
@@ -1,6 +1,7 @@
 package op
 
 import (
+	"encoding/json"
 	"fmt"
 	gomidi "gitlab.com/gomidi/midi/v2"
 	goosc "github.com/hypebeast/go-osc/osc"
@@ -56,7 +57,7 @@ func (op *SingleChannelFilter) Info() string {
 // osc /pig/op name q-system-events-enabled
 // -> bool
 //
-func (op SingleChannelFilter) remoteQuerySystemEventsEnabled(_ *goosc.Message)([]string, error) {
+func (op *SingleChannelFilter) remoteQuerySystemEventsEnabled(_ *goosc.Message)([]string, error) {
 	var err error
 	s := fmt.Sprintf("%v", op.enableSystemEvents)
 	return []string{s}, err
@@ -66,9 +67,23 @@ func (op SingleChannelFilter) remoteQuerySystemEventsEnabled(_ *goosc.Message)([
 // osc /pig/op name enable-system-events flag
 // -> Ack
 //
-func (op SingleChannelFilter) remoteEnableSystemEvents(msg *goosc.Message)([]string, error) {
+func (op *SingleChannelFilter) remoteEnableSystemEvents(msg *goosc.Message)([]string, error) {
 	args, err := ExpectMsg("ssb", msg)
 	op.enableSystemEvents = args[2].B
 	return empty, err
 }
-	
\ No newline at end of file
+
+
+func (op *SingleChannelFilter) sessionState() interface{} {
+	return &filterSession{op.enableSystemEvents}
+}
+
+func (op *SingleChannelFilter) restoreSessionState(data json.RawMessage) error {
+	state := op.sessionState().(*filterSession)
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+	op.enableSystemEvents = state.SystemEvents
+	return err
+}
@@ -0,0 +1,232 @@
+package op
+
+/*
+** scheduler.go defines a timed event scheduler shared by all operators.
+**
+** Operators which generate messages in the future (arpeggios, echoes etc)
+** add events to the scheduler rather than sleeping in their own goroutines.
+** Pending events are held in a heap ordered by time, a single goroutine
+** sleeps until the earliest event is due and then runs it.  Events due at
+** the same time run in the order they were scheduled.
+**
+** Event actions run on the scheduler goroutine and should not block.
+**
+*/
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/plewto/pigiron/smf"
+)
+
+type scheduledEvent struct {
+	when time.Time
+	seq uint64
+	owner interface{}
+	action func()
+}
+
+// eventHeap implements heap.Interface, earliest event first.
+//
+type eventHeap []*scheduledEvent
+
+func (h eventHeap) Len() int {
+	return len(h)
+}
+
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h eventHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *eventHeap) Push(x interface{}) {
+	*h = append(*h, x.(*scheduledEvent))
+}
+
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	event := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return event
+}
+
+type scheduler struct {
+	lock sync.Mutex
+	events eventHeap
+	seq uint64
+	running bool
+	wake chan bool
+}
+
+// sharedScheduler is used by all operators.
+//
+var sharedScheduler = newScheduler()
+
+func newScheduler() *scheduler {
+	s := new(scheduler)
+	s.events = make(eventHeap, 0, 64)
+	s.wake = make(chan bool, 1)
+	return s
+}
+
+// s.schedule() adds an event to run action at time when.
+// Events are identified by owner for cancel() and pending().
+// The scheduler goroutine is started on first use.
+//
+func (s *scheduler) schedule(when time.Time, owner interface{}, action func()) {
+	s.lock.Lock()
+	s.seq++
+	heap.Push(&s.events, &scheduledEvent{when, s.seq, owner, action})
+	earliest := s.events[0].seq == s.seq
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	s.lock.Unlock()
+	if earliest {
+		s.interrupt()
+	}
+}
+
+// s.cancel() removes all pending events for owner.
+// An event which is already running is not affected.
+//
+func (s *scheduler) cancel(owner interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	acc := s.events[:0]
+	for _, event := range s.events {
+		if event.owner != owner {
+			acc = append(acc, event)
+		}
+	}
+	for i := len(acc); i < len(s.events); i++ {
+		s.events[i] = nil
+	}
+	s.events = acc
+	heap.Init(&s.events)
+}
+
+// s.pending() returns number of pending events for owner.
+//
+func (s *scheduler) pending(owner interface{}) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count := 0
+	for _, event := range s.events {
+		if event.owner == owner {
+			count++
+		}
+	}
+	return count
+}
+
+// s.interrupt() wakes the scheduler goroutine to re-examine the heap.
+//
+func (s *scheduler) interrupt() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// s.next() removes and returns the earliest event if it is due.
+// Otherwise returns nil and the time of the earliest event, or the zero
+// time if there are no events.
+//
+func (s *scheduler) next(now time.Time) (*scheduledEvent, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.events) == 0 {
+		return nil, time.Time{}
+	}
+	if event := s.events[0]; !event.when.After(now) {
+		heap.Pop(&s.events)
+		return event, event.when
+	}
+	return nil, s.events[0].when
+}
+
+func (s *scheduler) run() {
+	for {
+		event, when := s.next(time.Now())
+		switch {
+		case event != nil:
+			event.action()
+		case when.IsZero():
+			<-s.wake
+		default:
+			sleepUntil(when, nil, s.wake)
+		}
+	}
+}
+
+
+// parseNoteValue() converts a note value to a number of MIDI clocks.
+// Note values have the form n/d with optional suffix, t for triplet or
+// . for dotted.  For example 1/4 (24 clocks), 1/8t (8 clocks) or
+// 1/16. (9 clocks).  The result must be a whole number of clocks.
+//
+func parseNoteValue(s string) (int, error) {
+	var err error
+	errmsg := "Expected note value such as 1/4, 1/8t or 1/16., got '%s'"
+	value := strings.ToLower(strings.TrimSpace(s))
+	numerator, denominator := 4, 1
+	switch {
+	case strings.HasSuffix(value, "t"):
+		numerator, denominator = 2 * numerator, 3
+		value = value[:len(value)-1]
+	case strings.HasSuffix(value, "."):
+		numerator, denominator = 3 * numerator, 2
+		value = value[:len(value)-1]
+	}
+	fields := strings.Split(value, "/")
+	if len(fields) != 2 {
+		err = fmt.Errorf(errmsg, s)
+		return 0, err
+	}
+	n, nerr := strconv.Atoi(fields[0])
+	d, derr := strconv.Atoi(fields[1])
+	if nerr != nil || derr != nil || n < 1 || d < 1 {
+		err = fmt.Errorf(errmsg, s)
+		return 0, err
+	}
+	numerator *= n * CLOCKS_PER_QUARTER
+	denominator *= d
+	if numerator % denominator != 0 {
+		errmsg := "Note value '%s' is not a whole number of MIDI clocks"
+		err = fmt.Errorf(errmsg, s)
+		return 0, err
+	}
+	return numerator / denominator, err
+}
+
+// clockDuration() returns the duration of count MIDI clocks at tempo BPM.
+//
+func clockDuration(count int, tempo float64) time.Duration {
+	seconds := float64(count) * 60.0 / (tempo * CLOCKS_PER_QUARTER)
+	return time.Duration(seconds * 1e9)
+}
+
+// validateTempo() returns non-nil error if tempo is not a usable BPM.
+//
+func validateTempo(tempo float64) error {
+	var err error
+	if tempo <= 0 || smf.MAX_TEMPO < tempo {
+		errmsg := "Expected tempo between 0 and %.1f BPM, got %f"
+		err = fmt.Errorf(errmsg, smf.MAX_TEMPO, tempo)
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+package op
+
+/*
+** session.go defines saving and restoring the complete operator graph.
+**
+** A session is a JSON document listing every operator and all connections.
+** Common state (type, name, device, MIDI enable and channel selection) is
+** saved for all operators.  Each operator type contributes any additional
+** state via its sessionState and restoreSessionState methods.
+**
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"github.com/plewto/pigiron/midi"
+	"github.com/plewto/pigiron/pigpath"
+)
+
+const SESSION_FORMAT = 1
+
+type sessionOperator struct {
+	Type string               `json:"type"`
+	Name string               `json:"name"`
+	Device string             `json:"device,omitempty"`
+	MIDIEnabled bool          `json:"midi-enabled"`
+	Channels []int            `json:"channels,omitempty"`
+	Queue *sessionQueue       `json:"queue,omitempty"`
+	State json.RawMessage     `json:"state,omitempty"`
+}
+
+type sessionQueue struct {
+	Depth int      `json:"depth"`
+	Policy string  `json:"policy"`
+}
+
+type sessionConnection struct {
+	Parent string `json:"parent"`
+	Child string  `json:"child"`
+}
+
+type session struct {
+	Format int                       `json:"format"`
+	Operators []sessionOperator      `json:"operators"`
+	Connections []sessionConnection  `json:"connections"`
+}
+
+// deviceOperator is implemented by operators wrapping a MIDI device.
+//
+type deviceOperator interface {
+	DeviceName() string
+}
+
+// captureSession returns the current state of all operators.
+//
+func captureSession() (*session, error) {
+	var err error
+	s := &session{Format: SESSION_FORMAT}
+	s.Operators = make([]sessionOperator, 0)
+	s.Connections = make([]sessionConnection, 0)
+	for _, op := range sortedOperators() {
+		sop := sessionOperator{Type: op.OperatorType(), Name: op.Name()}
+		if dev, ok := op.(deviceOperator); ok {
+			sop.Device = dev.DeviceName()
+		}
+		sop.MIDIEnabled = op.MIDIOutputEnabled()
+		if op.ChannelMode() != midi.NoChannel {
+			for _, ci := range op.SelectedChannelIndexes() {
+				sop.Channels = append(sop.Channels, int(ci) + 1)
+			}
+		}
+		if depth, policy, _, _ := op.QueueState(); depth > 0 {
+			sop.Queue = &sessionQueue{depth, policy.String()}
+		}
+		if state := op.sessionState(); state != nil {
+			sop.State, err = json.Marshal(state)
+			if err != nil {
+				errmsg := "Can not save state of operator %s\n%s"
+				err = fmt.Errorf(errmsg, op.Name(), err)
+				return s, err
+			}
+		}
+		s.Operators = append(s.Operators, sop)
+		for _, child := range sortedNames(op.Children()) {
+			s.Connections = append(s.Connections, sessionConnection{op.Name(), child})
+		}
+	}
+	return s, err
+}
+
+// SaveSession writes all operators and connections to a JSON file.
+// The filename may use the special directory prefixes ~/ and !/
+//
+func SaveSession(filename string) error {
+	filename = pigpath.SubSpecialDirectories(filename)
+	s, err := captureSession()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filename, append(data, '\n'), 0644)
+	if err != nil {
+		errmsg := "Can not write session file: '%s'\n%s"
+		err = fmt.Errorf(errmsg, filename, err)
+	}
+	return err
+}
+
+// restoreOperator creates an operator from its saved state.
+//
+func restoreOperator(sop sessionOperator) (Operator, error) {
+	var op Operator
+	var err error
+	switch sop.Type {
+	case "MIDIInput":
+		var in *MIDIInput
+		if in, err = NewMIDIInput(sop.Name, sop.Device); err == nil {
+			op = in
+		}
+	case "MIDIOutput":
+		var out *MIDIOutput
+		if out, err = NewMIDIOutput(sop.Name, sop.Device); err == nil {
+			op = out
+		}
+	default:
+		op, err = NewOperator(sop.Type, sop.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	op.SetMIDIOutputEnabled(sop.MIDIEnabled)
+	if op.ChannelMode() != midi.NoChannel {
+		op.DeselectAllChannels()
+		for _, c := range sop.Channels {
+			err = op.EnableChannel(midi.MIDIChannel(c), true)
+			if err != nil {
+				return op, err
+			}
+		}
+	}
+	if sop.Queue != nil {
+		var policy QueuePolicy
+		if policy, err = ParseQueuePolicy(sop.Queue.Policy); err != nil {
+			return op, err
+		}
+		if err = op.SetQueue(sop.Queue.Depth, policy); err != nil {
+			return op, err
+		}
+	}
+	if len(sop.State) > 0 {
+		err = op.restoreSessionState(sop.State)
+	}
+	return op, err
+}
+
+// LoadSession replaces all operators and connections with those saved in
+// a session file.  MIDIInput operators are reused if their device is
+// already open.
+//
+// Restoration continues after errors, the returned error lists all
+// operators and connections which could not be restored.
+//
+func LoadSession(filename string) error {
+	filename = pigpath.SubSpecialDirectories(filename)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		errmsg := "Can not read session file: '%s'\n%s"
+		err = fmt.Errorf(errmsg, filename, err)
+		return err
+	}
+	var s session
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		errmsg := "Malformed session file: '%s'\n%s"
+		err = fmt.Errorf(errmsg, filename, err)
+		return err
+	}
+	if s.Format != SESSION_FORMAT {
+		errmsg := "Unsupported session format %d in '%s'"
+		err = fmt.Errorf(errmsg, s.Format, filename)
+		return err
+	}
+	ClearRegistry()
+	problems := make([]string, 0)
+	actual := make(map[string]Operator)
+	for _, sop := range s.Operators {
+		op, rerr := restoreOperator(sop)
+		if op != nil {
+			actual[sop.Name] = op
+		}
+		if rerr != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: %s", sop.Type, sop.Name, rerr))
+		}
+	}
+	for _, con := range s.Connections {
+		parent, pflag := actual[con.Parent]
+		child, cflag := actual[con.Child]
+		if !(pflag && cflag) {
+			errmsg := "connection %s -> %s: operator not restored"
+			problems = append(problems, fmt.Sprintf(errmsg, con.Parent, con.Child))
+			continue
+		}
+		if cerr := parent.Connect(child); cerr != nil {
+			problems = append(problems, fmt.Sprintf("connection %s -> %s: %s", con.Parent, con.Child, cerr))
+		}
+	}
+	if len(problems) > 0 {
+		errmsg := "Session '%s' partially restored:\n\t%s"
+		err = fmt.Errorf(errmsg, filename, strings.Join(problems, "\n\t"))
+	}
+	return err
+}
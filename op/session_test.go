@@ -0,0 +1,75 @@
+package op
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionRoundTrip(t *testing.T) {
+	ClearRegistry()
+	defer ClearRegistry()
+	filter, _ := NewOperator("ChannelFilter", "filter")
+	mapper, _ := NewOperator("ChannelMapper", "mapper")
+	limiter, _ := NewOperator("VoiceLimiter", "limiter")
+	filter.DeselectAllChannels()
+	filter.EnableChannel(1, true)
+	filter.EnableChannel(3, true)
+	mapper.SetMIDIOutputEnabled(false)
+	mapper.(*ChannelMapper).MapChannel(1, 5)
+	limiter.(*VoiceLimiter).SetLimit(4)
+	limiter.(*VoiceLimiter).SetPolicy("lowest")
+	limiter.SetQueue(16, QUEUE_BLOCK)
+	filter.Connect(mapper)
+	filter.Connect(limiter)
+	mapper.Connect(limiter)
+	saved, _ := captureSession()
+	expect, _ := json.Marshal(saved)
+
+	filename := filepath.Join(t.TempDir(), "session.json")
+	if err := SaveSession(filename); err != nil {
+		t.Fatal(err)
+	}
+	ClearRegistry()
+	if n := len(Operators()); n != 0 {
+		t.Fatalf("Expected empty registry, got %d operators", n)
+	}
+	if err := LoadSession(filename); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := captureSession()
+	got, _ := json.Marshal(restored)
+	if string(got) != string(expect) {
+		t.Fatalf("Session not restored\nexpected %s\ngot      %s", expect, got)
+	}
+
+	// The restored operators are new instances with the saved state.
+	op, err := GetOperator("limiter")
+	if err != nil || op == limiter {
+		t.Fatalf("Expected new limiter, got %v %v", op, err)
+	}
+	if op.(*VoiceLimiter).Limit() != 4 || op.(*VoiceLimiter).Policy() != "lowest" {
+		t.Fatalf("Limiter state not restored: %s", op.Info())
+	}
+	if depth, policy, _, _ := op.QueueState(); depth != 16 || policy != QUEUE_BLOCK {
+		t.Fatalf("Limiter queue not restored, depth %d policy %s", depth, policy)
+	}
+	op, _ = GetOperator("mapper")
+	if op.MIDIOutputEnabled() {
+		t.Fatal("Expected mapper MIDI output disabled")
+	}
+	if to, _ := op.(*ChannelMapper).MappedChannel(1); to != 5 {
+		t.Fatalf("Expected channel 1 mapped to 5, got %d", to)
+	}
+	op, _ = GetOperator("filter")
+	if indexes := op.SelectedChannelIndexes(); len(indexes) != 2 || indexes[0] != 0 || indexes[1] != 2 {
+		t.Fatalf("Expected channels 1 and 3 selected, got %v", indexes)
+	}
+	children := op.Children()
+	if len(children) != 2 || children["mapper"] == nil || children["limiter"] == nil {
+		t.Fatalf("Unexpected filter children %v", children)
+	}
+	if err := LoadSession(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("Expected error for missing session file")
+	}
+}
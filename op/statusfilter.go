@@ -0,0 +1,303 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+// statusClasses maps message class names to their status bytes.
+// Channel status values have the channel nibble cleared.
+//
+var statusClasses = map[string][]midi.StatusByte{
+	"note":             {midi.NOTE_OFF, midi.NOTE_ON},
+	"poly-pressure":    {midi.POLY_PRESSURE},
+	"controller":       {midi.CONTROLLER},
+	"program":          {midi.PROGRAM},
+	"channel-pressure": {midi.CHANNEL_PRESSURE},
+	"bend":             {midi.BEND},
+	"sysex":            {midi.SYSEX, midi.END_SYSEX},
+	"mtc":              {0xF1},
+	"song-position":    {midi.SONG_POSITION},
+	"song-select":      {0xF3},
+	"tune-request":     {0xF6},
+	"clock":            {midi.CLOCK},
+	"start":            {midi.START},
+	"continue":         {midi.CONTINUE},
+	"stop":             {midi.STOP},
+	"active-sensing":   {midi.ACTIVE_SNESING},
+	"system-reset":     {0xFF},
+}
+
+// StatusClasses() returns sorted list of StatusFilter message classes.
+//
+func StatusClasses() []string {
+	acc := make([]string, 0, len(statusClasses))
+	for class, _ := range statusClasses {
+		acc = append(acc, class)
+	}
+	sort.Strings(acc)
+	return acc
+}
+
+// StatusFilter is an Operator which passes or blocks messages by class
+// (notes, controllers, clock, active sensing etc).   Controllers may
+// additionally be blocked by controller number.
+//
+type StatusFilter struct {
+	baseOperator
+	lock sync.Mutex
+	blocked map[midi.StatusByte]bool
+	blockedControllers [128]bool
+}
+
+func newStatusFilter(name string) *StatusFilter {
+	op := new(StatusFilter)
+	initOperator(&op.baseOperator, "StatusFilter", name, midi.NoChannel)
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() passes all messages.
+//
+func (op *StatusFilter) Reset() {
+	op.lock.Lock()
+	op.blocked = make(map[midi.StatusByte]bool)
+	op.blockedControllers = [128]bool{}
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+// op.BlockClass() blocks (flag true) or passes a message class.
+// Class "all" applies to all classes.
+// Returns non-nil error if class is unknown.
+//
+func (op *StatusFilter) BlockClass(class string, flag bool) error {
+	var err error
+	class = strings.ToLower(strings.TrimSpace(class))
+	classes := []string{class}
+	if class == "all" {
+		classes = StatusClasses()
+	} else if _, exists := statusClasses[class]; !exists {
+		errmsg := "Unknown message class '%s', expected one of: all, %s"
+		err = fmt.Errorf(errmsg, class, strings.Join(StatusClasses(), ", "))
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	for _, c := range classes {
+		for _, st := range statusClasses[c] {
+			op.blocked[st] = flag
+		}
+	}
+	return err
+}
+
+// op.BlockedClasses() returns sorted list of blocked classes.
+//
+func (op *StatusFilter) BlockedClasses() []string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	acc := make([]string, 0)
+	for _, class := range StatusClasses() {
+		if op.blocked[statusClasses[class][0]] {
+			acc = append(acc, class)
+		}
+	}
+	return acc
+}
+
+// op.BlockController() blocks (flag true) or passes a controller number.
+// Controller numbers only apply while the controller class is passed.
+//
+func (op *StatusFilter) BlockController(ctrl byte, flag bool) error {
+	var err error
+	if ctrl > 127 {
+		errmsg := "Expected controller number between 0 and 127, got %d"
+		err = fmt.Errorf(errmsg, ctrl)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.blockedControllers[ctrl] = flag
+	return err
+}
+
+// op.BlockedControllers() returns sorted list of blocked controller numbers.
+//
+func (op *StatusFilter) BlockedControllers() []int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	acc := make([]int, 0)
+	for ctrl, flag := range op.blockedControllers {
+		if flag {
+			acc = append(acc, ctrl)
+		}
+	}
+	return acc
+}
+
+func (op *StatusFilter) Accept(msg gomidi.Message) bool {
+	st := midi.StatusByte(msg.Data[0])
+	if st < 0xF0 {
+		st &= 0xF0
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if op.blocked[st] {
+		return false
+	}
+	if st == midi.CONTROLLER && len(msg.Data) > 1 {
+		return !op.blockedControllers[msg.Data[1] & 0x7F]
+	}
+	return true
+}
+
+func (op *StatusFilter) Send(msg gomidi.Message) {
+	if op.Accept(msg) {
+		op.distribute(msg)
+	}
+}
+
+func (op *StatusFilter) Info() string {
+	s := op.commonInfo()
+	s += "\tblocked: "
+	if classes := op.BlockedClasses(); len(classes) == 0 {
+		s += "<none>\n"
+	} else {
+		s += strings.Join(classes, ", ") + "\n"
+	}
+	if ctrls := op.BlockedControllers(); len(ctrls) > 0 {
+		s += fmt.Sprintf("\tblocked controllers: %v\n", ctrls)
+	}
+	return s
+}
+
+
+func (op *StatusFilter) initLocalHandlers() {
+
+	// op name, block, class [, class ...]
+	// op name, pass, class [, class ...]
+	//
+	blockClasses := func(msg *goosc.Message, flag bool)([]string, error) {
+		_, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		for _, class := range ToStringSlice(msg.Arguments)[2:] {
+			if err = op.BlockClass(class, flag); err != nil {
+				break
+			}
+		}
+		return empty, err
+	}
+
+	remoteBlock := func(msg *goosc.Message)([]string, error) {
+		return blockClasses(msg, true)
+	}
+
+	remotePass := func(msg *goosc.Message)([]string, error) {
+		return blockClasses(msg, false)
+	}
+
+	// op name, block-controllers, ctrl [, ctrl ...]
+	// op name, pass-controllers, ctrl [, ctrl ...]
+	//
+	blockControllers := func(msg *goosc.Message, flag bool)([]string, error) {
+		template := "osi"
+		for i := 3; i < len(msg.Arguments); i++ {
+			template += "i"
+		}
+		args, err := ExpectMsg(template, msg)
+		if err != nil {
+			return empty, err
+		}
+		for _, arg := range args[2:] {
+			if arg.I < 0 || arg.I > 127 {
+				errmsg := "Expected controller number between 0 and 127, got %d"
+				err = fmt.Errorf(errmsg, arg.I)
+				return empty, err
+			}
+			op.BlockController(byte(arg.I), flag)
+		}
+		return empty, err
+	}
+
+	remoteBlockControllers := func(msg *goosc.Message)([]string, error) {
+		return blockControllers(msg, true)
+	}
+
+	remotePassControllers := func(msg *goosc.Message)([]string, error) {
+		return blockControllers(msg, false)
+	}
+
+	// op name, q-blocked
+	//
+	remoteQueryBlocked := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return op.BlockedClasses(), err
+	}
+
+	// op name, q-blocked-controllers
+	//
+	remoteQueryBlockedControllers := func(msg *goosc.Message)([]string, error) {
+		var err error
+		ctrls := op.BlockedControllers()
+		acc := make([]string, len(ctrls))
+		for i, ctrl := range ctrls {
+			acc[i] = fmt.Sprintf("%d", ctrl)
+		}
+		return acc, err
+	}
+
+	// op name, q-classes
+	//
+	remoteQueryClasses := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return StatusClasses(), err
+	}
+
+	op.addCommandHandler("block", remoteBlock)
+	op.addCommandHandler("pass", remotePass)
+	op.addCommandHandler("block-controllers", remoteBlockControllers)
+	op.addCommandHandler("pass-controllers", remotePassControllers)
+	op.addCommandHandler("q-blocked", remoteQueryBlocked)
+	op.addCommandHandler("q-blocked-controllers", remoteQueryBlockedControllers)
+	op.addCommandHandler("q-classes", remoteQueryClasses)
+}
+
+
+type statusFilterSession struct {
+	Blocked []string        `json:"blocked"`
+	Controllers []int       `json:"blocked-controllers"`
+}
+
+func (op *StatusFilter) sessionState() interface{} {
+	return &statusFilterSession{op.BlockedClasses(), op.BlockedControllers()}
+}
+
+func (op *StatusFilter) restoreSessionState(data json.RawMessage) error {
+	var state statusFilterSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	for _, class := range state.Blocked {
+		if err = op.BlockClass(class, true); err != nil {
+			return err
+		}
+	}
+	for _, ctrl := range state.Controllers {
+		if err = op.BlockController(byte(ctrl), true); err != nil {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package op
+
+import (
+	"testing"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+func TestStatusFilter(t *testing.T) {
+	filter := newStatusFilter("filter")
+	out := newCollectingOperator("out")
+	filter.Connect(out)
+	messages := [][]byte{
+		{0x93, 60, 100},
+		{0x83, 60, 0},
+		{0xB0, 1, 64},
+		{0xB0, 7, 100},
+		{0xE5, 0, 64},
+		{0xF8},
+		{0xFE},
+		{0xF0, 0x7E, 0xF7},
+	}
+	send := func() {
+		for _, data := range messages {
+			filter.Send(gomidi.NewMessage(data))
+		}
+	}
+	send()
+	expectMessages(t, out, messages...)
+
+	if err := filter.BlockClass("bogus", true); err == nil {
+		t.Fatal("Expected error for unknown class")
+	}
+	filter.BlockClass("clock", true)
+	filter.BlockClass("active-sensing", true)
+	filter.BlockController(1, true)
+	send()
+	expectMessages(t, out, messages[0], messages[1], messages[3], messages[4], messages[7])
+
+	filter.BlockClass("all", true)
+	filter.BlockClass("note", false)
+	send()
+	expectMessages(t, out, messages[0], messages[1])
+	blocked := filter.BlockedClasses()
+	if len(blocked) != len(StatusClasses()) - 1 {
+		t.Fatalf("Unexpected blocked classes %v", blocked)
+	}
+
+	filter.Reset()
+	send()
+	expectMessages(t, out, messages...)
+}
@@ -1,7 +1,9 @@
 package op
 
 import (
+	"encoding/json"
 	"fmt"
+	"sync"
 	gomidi "gitlab.com/gomidi/midi/v2"
 	goosc "github.com/hypebeast/go-osc/osc"
 	"github.com/plewto/pigiron/midi"
@@ -13,6 +15,7 @@ import (
 //
 type Transformer struct {
 	baseXformOperator
+	lock sync.Mutex
 	status midi.StatusByte
 	dataNumber midi.DataNumber
 }
@@ -23,7 +26,7 @@ func newTransformer (name string) *Transformer {
 	op.dataNumber = midi.DATA_1
 	initOperator(&op.baseOperator, "Transformer", name, midi.NoChannel)
 	initXformOperator(&op.baseXformOperator)
-	op.initLocalHandlers()
+	initStatusHandlers(&op.baseOperator, op)
 	op.Reset()
 	return op
 }
@@ -31,55 +34,162 @@ func newTransformer (name string) *Transformer {
 func (op *Transformer) Reset() {
 	xbase := &op.baseXformOperator
 	xbase.Reset()
+	op.lock.Lock()
 	op.status = midi.KEYED_STATUS
 	op.dataNumber = midi.DATA_1
+	op.lock.Unlock()
 }
 
 func (op *Transformer) Info() string {
+	st := op.Status()
 	s := op.commonInfo()
-	s += fmt.Sprintf("\tStatus    : 0x%02X  %s\n", byte(op.status), op.status)
-	s += fmt.Sprintf("\tData byte : %s\n", op.dataNumber)
+	s += fmt.Sprintf("\tStatus    : 0x%02X  %s\n", byte(st), st)
+	s += fmt.Sprintf("\tData byte : %s\n", op.DataByte())
 	s += fmt.Sprintf("%s\n", op.Dump())
 	return s
 }
 
 func (op *Transformer) Send(msg gomidi.Message) {
-	st := midi.StatusByte(msg.Data[0])
+	op.lock.Lock()
+	status, dataNumber := op.status, op.dataNumber
+	op.lock.Unlock()
+	transformData(msg.Data, status, dataNumber, op)
+	op.distribute(msg)
+}
+
+// op.SetStatus() selects the status of messages to transform.
+// Returns non-nil error if st is not a valid selection, see
+// validateTransformStatus(), or if the selected data byte does not exist
+// for st.
+//
+func (op *Transformer) SetStatus(st midi.StatusByte) error {
+	err := validateTransformStatus(int64(st))
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if err = validateStatusDataByte(st, op.dataNumber); err != nil {
+		return err
+	}
+	op.status = st
+	return err
+}
+
+func (op *Transformer) Status() midi.StatusByte {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.status
+}
+
+// op.SelectDataByte() selects the data byte to transform.
+// Returns non-nil error if n is not DATA_1 or DATA_2, or if data byte n
+// does not exist for the selected status.
+//
+func (op *Transformer) SelectDataByte(n midi.DataNumber) error {
+	err := validateDataNumber(n)
+	if err != nil {
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if err = validateStatusDataByte(op.status, n); err != nil {
+		return err
+	}
+	op.dataNumber = n
+	return err
+}
+
+func (op *Transformer) DataByte() midi.DataNumber {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.dataNumber
+}
+
+// transformData() applies xform to the selected data byte of a MIDI
+// message, if the message matches status.  data is modified in place.
+//
+func transformData(data []byte, status midi.StatusByte, dataNumber midi.DataNumber, xform midi.Transform) {
+	if len(data) < 2 {
+		return
+	}
+	st := midi.StatusByte(data[0])
 	keyed := midi.IsKeyedStatus(st)
-	if st == op.status || ((op.status == midi.KEYED_STATUS) && keyed) {
-		if op.dataNumber == midi.DATA_2 {
-			msg.Data[2], _ = op.Value(msg.Data[2])
+	if st & 0xF0 == status || ((status == midi.KEYED_STATUS) && keyed) {
+		if dataNumber == midi.DATA_2 {
+			if len(data) > 2 {
+				data[2], _ = xform.Value(data[2])
+			}
 		} else {
-			msg.Data[1], _ = op.Value(msg.Data[1])
+			data[1], _ = xform.Value(data[1])
 		}
 	}
-	op.distribute(msg)
 }
 
-		
-func (op *Transformer) initLocalHandlers() {
-
-	channelStats := map[int64]string{0x00 : "DISABLED",
-		0x01 : "KEYED",
-		0x80 : "NOTE_OFF",
-		0x90 : "NOTE_ON",
-		0xA0 : "POLY_PRESSURE",
-		0xB0 : "CONTROLLER",
-		0xC0 : "PROGRAM",
-		0xD0 : "MONO_PRESSURE",
-		0xE0 : "PITCH_BEND"}
-	
-	isChannelStatus := func(n int64) error {
-		var err error
-		_, flag := channelStats[n]
-		if !flag {
-			msg := "Expected valid status value to Transformer, got 0x%02X"
-			err = fmt.Errorf(msg, n)
-		}
-		return err
+// transformStatusNames holds the status values which may be selected for
+// transformation.
+//
+var transformStatusNames = map[int64]string{0x00 : "DISABLED",
+	0x01 : "KEYED",
+	0x80 : "NOTE_OFF",
+	0x90 : "NOTE_ON",
+	0xA0 : "POLY_PRESSURE",
+	0xB0 : "CONTROLLER",
+	0xC0 : "PROGRAM",
+	0xD0 : "MONO_PRESSURE",
+	0xE0 : "PITCH_BEND"}
+
+// validateTransformStatus() returns non-nil error if n is not a status
+// value in transformStatusNames.
+//
+func validateTransformStatus(n int64) error {
+	var err error
+	if _, flag := transformStatusNames[n]; !flag {
+		msg := "Expected valid status value to Transformer, got 0x%02X"
+		err = fmt.Errorf(msg, n)
 	}
+	return err
+}
+
+// validateDataNumber() returns non-nil error if n is not DATA_1 or DATA_2.
+//
+func validateDataNumber(n midi.DataNumber) error {
+	var err error
+	if n != midi.DATA_1 && n != midi.DATA_2 {
+		msg := "Expected data byte DATA_1 or DATA_2, got %d"
+		err = fmt.Errorf(msg, int(n))
+	}
+	return err
+}
+
+// validateStatusDataByte() returns non-nil error if data byte n does not
+// exist for status st.  PROGRAM and MONO_PRESSURE messages have a single
+// data byte.
+//
+func validateStatusDataByte(st midi.StatusByte, n midi.DataNumber) error {
+	var err error
+	if n == midi.DATA_2 && midi.ChannelMessageDataCount(st) < 2 {
+		msg := "Status 0x%02X %s has no second data byte"
+		err = fmt.Errorf(msg, byte(st), st)
+	}
+	return err
+}
+
+// statusSelector is implemented by operators which transform a selected
+// data byte of messages with a selected status.
+//
+type statusSelector interface {
+	SetStatus(st midi.StatusByte) error
+	Status() midi.StatusByte
+	SelectDataByte(n midi.DataNumber) error
+	DataByte() midi.DataNumber
+}
+
+// initStatusHandlers() adds commands for selecting the status and data
+// byte modified by a transforming operator.
+//
+func initStatusHandlers(op *baseOperator, selector statusSelector) {
 
-	
 	// cmd op name, select-status, status
 	// osc pig/op name, set-status, status
 	//
@@ -99,11 +209,11 @@ func (op *Transformer) initLocalHandlers() {
 			return empty, err
 		}
 		st := args[2].I
-		err = isChannelStatus(st)
+		err = validateTransformStatus(st)
 		if err != nil {
 			return empty, err
 		}
-		op.status = midi.StatusByte(st)
+		err = selector.SetStatus(midi.StatusByte(st))
 		return empty, err
 	}
 
@@ -117,7 +227,7 @@ func (op *Transformer) initLocalHandlers() {
 		if err != nil {
 			return empty, err
 		}
-		st := fmt.Sprintf("0x%02X", byte(op.status))
+		st := fmt.Sprintf("0x%02X", byte(selector.Status()))
 		return []string{st}, err
 	}
 
@@ -132,9 +242,9 @@ func (op *Transformer) initLocalHandlers() {
 		n := args[2].I
 		switch n {
 		case 1:
-			op.dataNumber = midi.DATA_1
+			err = selector.SelectDataByte(midi.DATA_1)
 		case 2:
-			op.dataNumber = midi.DATA_2
+			err = selector.SelectDataByte(midi.DATA_2)
 		default:
 			msg := "Expected data byte 1 or 2, got %d"
 			err = fmt.Errorf(msg, n)
@@ -146,7 +256,7 @@ func (op *Transformer) initLocalHandlers() {
 	remoteQuerySelectedDataByte := func(msg *goosc.Message)([]string, error) {
 		var err error
 		var s string
-		switch op.dataNumber {
+		switch selector.DataByte() {
 		case midi.DATA_1: s = "1"
 		case midi.DATA_2: s = "2"
 		default: s = "?"
@@ -159,5 +269,49 @@ func (op *Transformer) initLocalHandlers() {
 	op.addCommandHandler("select-data-byte", remoteSelectDataByte)
 	op.addCommandHandler("q-data-byte", remoteQuerySelectedDataByte)
 }
-		
-		
+
+
+type transformerSession struct {
+	Status int     `json:"status"`
+	DataByte int   `json:"data-byte"`
+	Table []int    `json:"table"`
+}
+
+func (op *Transformer) sessionState() interface{} {
+	f, c := op.TransformRange()
+	table := make([]int, 0, int(c - f))
+	for i := f; i < c; i++ {
+		v, _ := op.Value(i)
+		table = append(table, int(v))
+	}
+	return &transformerSession{int(op.Status()), int(op.DataByte()), table}
+}
+
+func (op *Transformer) restoreSessionState(data json.RawMessage) error {
+	state := op.sessionState().(*transformerSession)
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+	f, _ := op.TransformRange()
+	for i, v := range state.Table {
+		err = op.SetValue(f + byte(i), byte(v))
+		if err != nil {
+			return err
+		}
+	}
+	st, n := midi.StatusByte(state.Status), midi.DataNumber(state.DataByte)
+	if err = validateTransformStatus(int64(state.Status)); err != nil {
+		return err
+	}
+	if err = validateDataNumber(n); err != nil {
+		return err
+	}
+	if err = validateStatusDataByte(st, n); err != nil {
+		return err
+	}
+	op.lock.Lock()
+	op.status, op.dataNumber = st, n
+	op.lock.Unlock()
+	return err
+}
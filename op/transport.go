@@ -40,11 +40,11 @@ import (
 //
 //  t.Duration() returns approximate media length in seconds.
 //       osc command /pig/op <name>, q-duration
-//       osc returns int time in milliseconds.
+//       osc returns float time in seconds.
 //
 //  t.Position() returns current playback position in seconds.
 //       osc command /pig/op <name>, q-position
-//       osc returns int time in milliseconds.
+//       osc returns float time in seconds.
 //
 //  t.EnableMIDITransport() enable/disable MIDI transport control.
 //       If enabled the player will stop/start/continue on reception
@@ -169,7 +169,7 @@ func initTransportHandlers(transport Transport) {
 	//
 	remoteQueryDuration := func(msg *goosc.Message) ([]string, error) {
 		var err error
-		dur := fmt.Sprintf("%d", transport.Duration())
+		dur := fmt.Sprintf("%.3f", transport.Duration())
 		return formatResponse("q-duration", dur), err
 	}
 
@@ -177,7 +177,7 @@ func initTransportHandlers(transport Transport) {
 	//
 	remoteQueryPosition := func(msg *goosc.Message) ([]string, error) {
 		var err error
-		pos := fmt.Sprintf("%d", transport.Position())
+		pos := fmt.Sprintf("%.3f", transport.Position())
 		return formatResponse("q-position", pos), err
 	}
 
@@ -0,0 +1,228 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+// VelocityCurve is an Operator which reshapes NOTE_ON velocities.
+// Each MIDI channel has its own curve (see midi.Curve) which is computed
+// into a lookup table.  All other messages are passed unchanged.
+//
+type VelocityCurve struct {
+	baseOperator
+	lock sync.Mutex
+	curves [16]*midi.Curve
+	tables [16]midi.DataTable
+}
+
+func newVelocityCurve(name string) *VelocityCurve {
+	op := new(VelocityCurve)
+	initOperator(&op.baseOperator, "VelocityCurve", name, midi.NoChannel)
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+func (op *VelocityCurve) Reset() {
+	op.lock.Lock()
+	for ci := 0; ci < 16; ci++ {
+		op.curves[ci] = midi.IdentityCurve()
+		op.tables[ci].Reset()
+	}
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+// op.SetCurve() sets curve for MIDI channel c, 1 <= c <= 16.
+// If c is 0 the curve is used for all channels.
+//
+func (op *VelocityCurve) SetCurve(c midi.MIDIChannel, curve *midi.Curve) error {
+	var err error
+	if c != 0 {
+		if err = midi.ValidateMIDIChannel(c); err != nil {
+			return err
+		}
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	for ci := 0; ci < 16; ci++ {
+		if c == 0 || int(c) == ci + 1 {
+			op.curves[ci] = curve
+			curve.Fill(&op.tables[ci])
+		}
+	}
+	return err
+}
+
+// op.Curve() returns curve for MIDI channel c.
+//
+func (op *VelocityCurve) Curve(c midi.MIDIChannel) (*midi.Curve, error) {
+	if err := midi.ValidateMIDIChannel(c); err != nil {
+		return nil, err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.curves[c-1], nil
+}
+
+func (op *VelocityCurve) Send(msg gomidi.Message) {
+	if midi.IsNoteOn(msg) {
+		ci := msg.Data[0] & 0x0F
+		op.lock.Lock()
+		velocity, _ := op.tables[ci].Value(msg.Data[2])
+		op.lock.Unlock()
+		msg = gomidi.NewMessage([]byte{msg.Data[0], msg.Data[1], velocity})
+	}
+	op.distribute(msg)
+}
+
+func (op *VelocityCurve) Info() string {
+	s := op.commonInfo()
+	s += "\tcurves:\n"
+	for c := midi.MIDIChannel(1); c <= 16; c++ {
+		curve, _ := op.Curve(c)
+		s += fmt.Sprintf("\t\t[%2d] %s\n", c, curve)
+	}
+	return s
+}
+
+// parseCurveChannel() converts 'all' or a channel number.
+// Returns 0 for all channels.
+//
+func parseCurveChannel(s string) (midi.MIDIChannel, error) {
+	var err error
+	if strings.ToLower(s) == "all" {
+		return 0, err
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || 16 < n {
+		errmsg := "Expected MIDI channel or 'all', got '%s'"
+		err = fmt.Errorf(errmsg, s)
+		return 0, err
+	}
+	return midi.MIDIChannel(n), err
+}
+
+
+func (op *VelocityCurve) initLocalHandlers() {
+
+	// op name, set-curve, channel|all, shape [, param ...]
+	//
+	remoteSetCurve := func(msg *goosc.Message)([]string, error) {
+		template := "osss"
+		for i := 4; i < len(msg.Arguments); i++ {
+			template += "f"
+		}
+		args, err := ExpectMsg(template, msg)
+		if err != nil {
+			return empty, err
+		}
+		c, err := parseCurveChannel(args[2].S)
+		if err != nil {
+			return empty, err
+		}
+		params := make([]float64, 0, len(args) - 4)
+		for _, arg := range args[4:] {
+			params = append(params, arg.F)
+		}
+		curve, err := midi.NewCurve(args[3].S, params...)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetCurve(c, curve)
+		return []string{curve.String()}, err
+	}
+
+	// op name, q-curve, channel
+	// Returns curve shape followed by parameters.
+	//
+	remoteQueryCurve := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		c, _ := parseCurveChannel(args[2].S)
+		curve, err := op.Curve(c)
+		if err != nil {
+			return empty, err
+		}
+		acc := []string{curve.Shape()}
+		for _, p := range curve.Params() {
+			acc = append(acc, fmt.Sprintf("%v", p))
+		}
+		return acc, err
+	}
+
+	// op name, q-curve-shapes
+	//
+	remoteQueryCurveShapes := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return midi.CurveShapes(), err
+	}
+
+	// op name, print-curve, channel
+	// Display plot of channel's velocity table.
+	//
+	remotePrintCurve := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		c, _ := parseCurveChannel(args[2].S)
+		curve, err := op.Curve(c)
+		if err != nil {
+			return empty, err
+		}
+		op.lock.Lock()
+		plot := op.tables[c-1].Plot()
+		op.lock.Unlock()
+		fmt.Printf("%s\n%s", curve, plot)
+		return empty, err
+	}
+
+	op.addCommandHandler("set-curve", remoteSetCurve)
+	op.addCommandHandler("q-curve", remoteQueryCurve)
+	op.addCommandHandler("q-curve-shapes", remoteQueryCurveShapes)
+	op.addCommandHandler("print-curve", remotePrintCurve)
+}
+
+
+type curveSession struct {
+	Shape string        `json:"shape"`
+	Params []float64    `json:"params"`
+}
+
+func (op *VelocityCurve) sessionState() interface{} {
+	acc := make([]curveSession, 16)
+	for c := midi.MIDIChannel(1); c <= 16; c++ {
+		curve, _ := op.Curve(c)
+		acc[c-1] = curveSession{curve.Shape(), curve.Params()}
+	}
+	return acc
+}
+
+func (op *VelocityCurve) restoreSessionState(data json.RawMessage) error {
+	var state []curveSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	for i, cs := range state {
+		var curve *midi.Curve
+		if curve, err = midi.NewCurve(cs.Shape, cs.Params...); err != nil {
+			return err
+		}
+		if err = op.SetCurve(midi.MIDIChannel(i + 1), curve); err != nil {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,418 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	gomidi "gitlab.com/gomidi/midi/v2"
+	goosc "github.com/hypebeast/go-osc/osc"
+	"github.com/plewto/pigiron/midi"
+)
+
+const (
+	VOICE_DEFAULT_LIMIT = 8
+	VOICE_MAX_LIMIT = 128
+	VOICE_SCOPE_CHANNEL = "channel"
+	VOICE_SCOPE_GLOBAL = "global"
+)
+
+// VoicePolicies lists the VoiceLimiter steal policy names.
+//
+var VoicePolicies = []string{"oldest", "lowest", "highest", "quietest", "refuse-new"}
+
+type voice struct {
+	ci byte
+	key byte
+	velocity byte
+}
+
+// VoiceLimiter is an Operator which limits the number of sounding notes,
+// either per MIDI channel or over all channels.
+//
+// When a NOTE_ON would exceed the limit a sounding voice is stolen and
+// turned off, chosen by the steal policy:
+//
+//    oldest     - the longest sounding note.
+//    lowest     - the lowest key.
+//    highest    - the highest key.
+//    quietest   - the lowest velocity, oldest first.
+//    refuse-new - no voice is stolen, the new note is dropped.
+//
+// A NOTE_ON for a key which is already sounding retriggers that voice.
+// Its NOTE_OFF is sent once every NOTE_ON for the key has been released.
+// NOTE_OFF messages for stolen voices and dropped notes are consumed.
+//
+// Lowering the limit does not affect sounding notes.
+// Non-note messages are passed unchanged.
+//
+type VoiceLimiter struct {
+	baseOperator
+	lock sync.Mutex
+	limit int
+	global bool
+	policy string
+	voices []voice             // sounding voices, oldest first
+	sounding midi.NoteQueue    // NOTE_ON count per voice
+	discard map[int]int        // NOTE_OFF to consume indexed by channel * 128 + key
+}
+
+func newVoiceLimiter(name string) *VoiceLimiter {
+	op := new(VoiceLimiter)
+	initOperator(&op.baseOperator, "VoiceLimiter", name, midi.NoChannel)
+	op.sounding = *midi.MakeNoteQueue()
+	op.initLocalHandlers()
+	op.Reset()
+	return op
+}
+
+// op.Reset() turns off sounding voices and restores default settings.
+//
+func (op *VoiceLimiter) Reset() {
+	op.lock.Lock()
+	op.release()
+	op.limit = VOICE_DEFAULT_LIMIT
+	op.global = false
+	op.policy = VoicePolicies[0]
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Reset()
+}
+
+func (op *VoiceLimiter) Panic() {
+	op.lock.Lock()
+	op.release()
+	op.lock.Unlock()
+	base := &op.baseOperator
+	base.Panic()
+}
+
+// op.release() turns off all sounding voices.
+// The lock must be held by the caller.
+//
+func (op *VoiceLimiter) release() {
+	for _, off := range op.sounding.OffEvents() {
+		op.distribute(off)
+	}
+	op.sounding.Reset()
+	op.voices = make([]voice, 0, VOICE_DEFAULT_LIMIT)
+	op.discard = make(map[int]int)
+}
+
+// op.SetLimit() sets maximum number of sounding voices, per channel or
+// global depending on scope.
+//
+func (op *VoiceLimiter) SetLimit(n int) error {
+	var err error
+	if n < 1 || VOICE_MAX_LIMIT < n {
+		errmsg := "Expected voice limit between 1 and %d, got %d"
+		err = fmt.Errorf(errmsg, VOICE_MAX_LIMIT, n)
+		return err
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.limit = n
+	return err
+}
+
+func (op *VoiceLimiter) Limit() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.limit
+}
+
+// op.SetScope() selects whether the limit applies to each channel or to
+// all channels together.
+// scope must be VOICE_SCOPE_CHANNEL or VOICE_SCOPE_GLOBAL.
+//
+func (op *VoiceLimiter) SetScope(scope string) error {
+	var err error
+	switch strings.ToLower(strings.TrimSpace(scope)) {
+	case VOICE_SCOPE_CHANNEL:
+		op.lock.Lock()
+		op.global = false
+		op.lock.Unlock()
+	case VOICE_SCOPE_GLOBAL:
+		op.lock.Lock()
+		op.global = true
+		op.lock.Unlock()
+	default:
+		errmsg := "Expected scope %s or %s, got '%s'"
+		err = fmt.Errorf(errmsg, VOICE_SCOPE_CHANNEL, VOICE_SCOPE_GLOBAL, scope)
+	}
+	return err
+}
+
+func (op *VoiceLimiter) Scope() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	if op.global {
+		return VOICE_SCOPE_GLOBAL
+	}
+	return VOICE_SCOPE_CHANNEL
+}
+
+// op.SetPolicy() selects the steal policy, see VoicePolicies.
+//
+func (op *VoiceLimiter) SetPolicy(policy string) error {
+	var err error
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	for _, p := range VoicePolicies {
+		if p == policy {
+			op.lock.Lock()
+			op.policy = policy
+			op.lock.Unlock()
+			return err
+		}
+	}
+	errmsg := "Invalid steal policy '%s', expected one of %v"
+	err = fmt.Errorf(errmsg, policy, VoicePolicies)
+	return err
+}
+
+func (op *VoiceLimiter) Policy() string {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return op.policy
+}
+
+// op.VoiceCount() returns number of sounding voices.
+//
+func (op *VoiceLimiter) VoiceCount() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return len(op.voices)
+}
+
+// op.find() returns index of the voice for channel and key, or -1.
+// The lock must be held by the caller.
+//
+func (op *VoiceLimiter) find(ci, key byte) int {
+	for i, v := range op.voices {
+		if v.ci == ci && v.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// op.victim() returns index of the voice to steal for a NOTE_ON on channel
+// ci, or -1 if the limit is not reached.
+// The lock must be held by the caller.
+//
+func (op *VoiceLimiter) victim(ci byte) int {
+	candidates := make([]int, 0, len(op.voices))
+	for i, v := range op.voices {
+		if op.global || v.ci == ci {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) < op.limit {
+		return -1
+	}
+	best := candidates[0]
+	for _, i := range candidates[1:] {
+		v, b := op.voices[i], op.voices[best]
+		switch op.policy {
+		case "lowest":
+			if v.key < b.key {
+				best = i
+			}
+		case "highest":
+			if v.key > b.key {
+				best = i
+			}
+		case "quietest":
+			if v.velocity < b.velocity {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// op.steal() turns off voice i.  Remaining NOTE_OFF messages for the
+// voice are consumed.
+// The lock must be held by the caller.
+//
+func (op *VoiceLimiter) steal(i int) {
+	v := op.voices[i]
+	op.voices = append(op.voices[:i], op.voices[i+1:]...)
+	off := gomidi.NewMessage([]byte{byte(midi.NOTE_OFF) | v.ci, v.key, 0})
+	index := int(v.ci) * 128 + int(v.key)
+	for n := op.sounding.OpenCount(v.ci, v.key); n > 0; n-- {
+		op.sounding.Update(off)
+		op.discard[index]++
+	}
+	op.distribute(off)
+}
+
+func (op *VoiceLimiter) noteOn(msg gomidi.Message) {
+	d := msg.Data
+	ci, key := d[0] & 0x0F, d[1]
+	if i := op.find(ci, key); i >= 0 {
+		op.voices = append(op.voices[:i], op.voices[i+1:]...)
+	} else if i = op.victim(ci); i >= 0 {
+		if op.policy == "refuse-new" {
+			op.discard[noteMapIndex(d)]++
+			return
+		}
+		op.steal(i)
+	}
+	op.voices = append(op.voices, voice{ci, key, d[2]})
+	op.sounding.Update(msg)
+	op.distribute(msg)
+}
+
+func (op *VoiceLimiter) noteOff(msg gomidi.Message) {
+	d := msg.Data
+	ci, key := d[0] & 0x0F, d[1]
+	index := noteMapIndex(d)
+	if op.discard[index] > 0 {
+		op.discard[index]--
+		if op.discard[index] == 0 {
+			delete(op.discard, index)
+		}
+		return
+	}
+	if op.sounding.OpenCount(ci, key) > 0 {
+		op.sounding.Update(msg)
+		if op.sounding.OpenCount(ci, key) > 0 {
+			return
+		}
+		if i := op.find(ci, key); i >= 0 {
+			op.voices = append(op.voices[:i], op.voices[i+1:]...)
+		}
+	}
+	op.distribute(msg)
+}
+
+func (op *VoiceLimiter) Send(msg gomidi.Message) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	switch {
+	case midi.IsNoteOn(msg):
+		op.noteOn(msg)
+	case midi.IsNoteOff(msg):
+		op.noteOff(msg)
+	default:
+		op.distribute(msg)
+	}
+}
+
+func (op *VoiceLimiter) Info() string {
+	s := op.commonInfo()
+	s += fmt.Sprintf("\tlimit: %d  scope: %s  policy: %s\n", op.Limit(), op.Scope(), op.Policy())
+	s += fmt.Sprintf("\tsounding voices: %d\n", op.VoiceCount())
+	return s
+}
+
+
+func (op *VoiceLimiter) initLocalHandlers() {
+
+	// op name, set-limit, n
+	//
+	remoteSetLimit := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("osi", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetLimit(int(args[2].I))
+		return empty, err
+	}
+
+	// op name, q-limit
+	//
+	remoteQueryLimit := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.Limit())}, err
+	}
+
+	// op name, set-scope, channel|global
+	//
+	remoteSetScope := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetScope(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-scope
+	//
+	remoteQueryScope := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.Scope()}, err
+	}
+
+	// op name, set-policy, policy
+	//
+	remoteSetPolicy := func(msg *goosc.Message)([]string, error) {
+		args, err := ExpectMsg("oss", msg)
+		if err != nil {
+			return empty, err
+		}
+		err = op.SetPolicy(args[2].S)
+		return empty, err
+	}
+
+	// op name, q-policy
+	//
+	remoteQueryPolicy := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{op.Policy()}, err
+	}
+
+	// op name, q-policies
+	//
+	remoteQueryPolicies := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return VoicePolicies, err
+	}
+
+	// op name, q-voice-count
+	//
+	remoteQueryVoiceCount := func(msg *goosc.Message)([]string, error) {
+		var err error
+		return []string{fmt.Sprintf("%d", op.VoiceCount())}, err
+	}
+
+	op.addCommandHandler("set-limit", remoteSetLimit)
+	op.addCommandHandler("q-limit", remoteQueryLimit)
+	op.addCommandHandler("set-scope", remoteSetScope)
+	op.addCommandHandler("q-scope", remoteQueryScope)
+	op.addCommandHandler("set-policy", remoteSetPolicy)
+	op.addCommandHandler("q-policy", remoteQueryPolicy)
+	op.addCommandHandler("q-policies", remoteQueryPolicies)
+	op.addCommandHandler("q-voice-count", remoteQueryVoiceCount)
+}
+
+
+type voiceLimiterSession struct {
+	Limit int        `json:"limit"`
+	Scope string     `json:"scope"`
+	Policy string    `json:"policy"`
+}
+
+func (op *VoiceLimiter) sessionState() interface{} {
+	return &voiceLimiterSession{op.Limit(), op.Scope(), op.Policy()}
+}
+
+func (op *VoiceLimiter) restoreSessionState(data json.RawMessage) error {
+	var state voiceLimiterSession
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	if err = op.SetLimit(state.Limit); err != nil {
+		return err
+	}
+	if err = op.SetScope(state.Scope); err != nil {
+		return err
+	}
+	if err = op.SetPolicy(state.Policy); err != nil {
+		return err
+	}
+	return err
+}
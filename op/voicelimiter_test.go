@@ -0,0 +1,104 @@
+package op
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVoiceLimiterPolicies(t *testing.T) {
+	limiter := newVoiceLimiter("limiter")
+	out := newCollectingOperator("out")
+	limiter.Connect(out)
+	limiter.SetLimit(3)
+	if err := limiter.SetPolicy("bogus"); err == nil {
+		t.Fatal("Expected error for unknown policy")
+	}
+
+	var tests = []struct{
+		policy string
+		stolen byte
+	}{
+		{"oldest", 64},
+		{"lowest", 60},
+		{"highest", 67},
+		{"quietest", 60},
+	}
+	for _, test := range tests {
+		limiter.Panic()
+		out.take()
+		limiter.SetPolicy(test.policy)
+		sendBytes(limiter, 0x90, 64, 100)
+		sendBytes(limiter, 0x90, 67, 80)
+		sendBytes(limiter, 0x90, 60, 60)
+		out.take()
+		sendBytes(limiter, 0x90, 72, 100)
+		got := out.take()
+		if len(got) != 2 || string(got[0]) != string([]byte{0x80, test.stolen, 0}) {
+			t.Fatalf("%s: expected key %d stolen, got %v", test.policy, test.stolen, got)
+		}
+		if limiter.VoiceCount() != 3 {
+			t.Fatalf("%s: expected 3 voices, got %d", test.policy, limiter.VoiceCount())
+		}
+	}
+
+	// Refused notes are dropped with their note off.
+	limiter.Panic()
+	out.take()
+	limiter.SetPolicy("refuse-new")
+	sendBytes(limiter, 0x90, 60, 100)
+	sendBytes(limiter, 0x90, 62, 100)
+	sendBytes(limiter, 0x90, 64, 100)
+	sendBytes(limiter, 0x90, 65, 100)
+	sendBytes(limiter, 0x80, 65, 0)
+	expectMessages(t, out, []byte{0x90, 60, 100}, []byte{0x90, 62, 100}, []byte{0x90, 64, 100})
+}
+
+func TestVoiceLimiterNoteOff(t *testing.T) {
+	limiter := newVoiceLimiter("limiter")
+	out := newCollectingOperator("out")
+	limiter.Connect(out)
+	limiter.SetLimit(1)
+
+	// Stolen voice note offs are consumed, a replayed key is released by
+	// its own note off.
+	sendBytes(limiter, 0x90, 60, 100)
+	sendBytes(limiter, 0x90, 62, 100)
+	sendBytes(limiter, 0x90, 60, 100)
+	sendBytes(limiter, 0x80, 60, 0)
+	expectMessages(t, out,
+		[]byte{0x90, 60, 100}, []byte{0x80, 60, 0}, []byte{0x90, 62, 100},
+		[]byte{0x80, 62, 0}, []byte{0x90, 60, 100})
+	sendBytes(limiter, 0x80, 62, 0)
+	sendBytes(limiter, 0x80, 60, 0)
+	expectMessages(t, out, []byte{0x80, 60, 0})
+
+	// Retriggered keys use one voice, released by the last note off.
+	sendBytes(limiter, 0x90, 60, 100)
+	sendBytes(limiter, 0x90, 60, 100)
+	sendBytes(limiter, 0x80, 60, 0)
+	expectMessages(t, out, []byte{0x90, 60, 100}, []byte{0x90, 60, 100})
+	sendBytes(limiter, 0x80, 60, 0)
+	expectMessages(t, out, []byte{0x80, 60, 0})
+
+	// Per channel and global scope, changing scope does not turn off
+	// sounding voices.
+	sendBytes(limiter, 0x90, 60, 100)
+	sendBytes(limiter, 0x91, 60, 100)
+	expectMessages(t, out, []byte{0x90, 60, 100}, []byte{0x91, 60, 100})
+	if err := limiter.SetScope("bogus"); err == nil {
+		t.Fatal("Expected error for unknown scope")
+	}
+	limiter.SetScope(VOICE_SCOPE_GLOBAL)
+	sendBytes(limiter, 0x92, 60, 100)
+	expectMessages(t, out, []byte{0x80, 60, 0}, []byte{0x92, 60, 100})
+
+	// Session round trip
+	data, _ := json.Marshal(limiter.sessionState())
+	restored := newVoiceLimiter("restored")
+	if err := restored.restoreSessionState(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Limit() != 1 || restored.Scope() != VOICE_SCOPE_GLOBAL {
+		t.Fatalf("Session not restored: %s", restored.Info())
+	}
+}
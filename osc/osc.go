@@ -16,7 +16,7 @@ var (
 
 
 // Init() initializes the osc package.
-// Init() must not be called prior to initialization of the config package.
+// Init() must not be called prior to config.ParseCommandLine().
 //
 func Init() {
 	// Create global responders
@@ -33,6 +33,7 @@ func Init() {
 	root = config.GlobalParameters.OSCServerRoot
 	GlobalServer = NewServer(host, port, root)
 	AddHandler(GlobalServer, "exec", remoteEval)
+	initREPL()
 }
 
 
@@ -28,7 +28,9 @@ var (
 )
 
 
-func init() {
+// initREPL() creates the REPL's client for the OSC server.
+//
+func initREPL() {
 	host := config.GlobalParameters.OSCServerHost
 	port := int(config.GlobalParameters.OSCServerPort)
 	internalClient = goosc.NewClient(host, port)
@@ -14,7 +14,10 @@ var (
 )
 
 
-func init() {
+// Init() opens the log file if logging is enabled.
+// Init() must not be called prior to config.ParseCommandLine().
+//
+func Init() {
 	if config.GlobalParameters.EnableLogging {
 		logfile = pigpath.SubSpecialDirectories(config.GlobalParameters.Logfile)
 		var err error
@@ -0,0 +1,126 @@
+package smf
+
+/*
+** builder.go defines functions for constructing SMF objects in code.
+**
+*/
+
+import (
+	"fmt"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+// NewEvent creates a new Event.
+// deltaTime is the number of clock ticks since the previous event.
+//
+func NewEvent(deltaTime uint64, msg gomidi.Message) Event {
+	return Event{deltaTime, msg}
+}
+
+// NewTrack returns a new empty Track.
+//
+func NewTrack() *Track {
+	trk := new(Track)
+	trk.events = make([]Event, 0, 128)
+	return trk
+}
+
+// trk.Append() adds a message to the end of the track.
+// deltaTime is relative to the previous event.
+//
+func (trk *Track) Append(deltaTime uint64, msg gomidi.Message) {
+	trk.events = append(trk.events, Event{deltaTime, msg})
+}
+
+// trk.AppendEvent() adds an existing Event to the end of the track.
+//
+func (trk *Track) AppendEvent(event Event) {
+	trk.events = append(trk.events, event)
+}
+
+// trk.EndTime() returns the absolute time, in ticks, of the final event.
+//
+func (trk *Track) EndTime() uint64 {
+	var acc uint64 = 0
+	for _, ev := range trk.events {
+		acc += ev.deltaTime
+	}
+	return acc
+}
+
+// trk.Insert() adds a message at an absolute time, in ticks.
+// The message is placed after any existing events with the same time and
+// the delta time of the following event is adjusted.
+// A trailing end-of-track remains the final event and is moved later if
+// time is beyond it.
+//
+func (trk *Track) Insert(time uint64, msg gomidi.Message) {
+	if trk.HasEndOfTrack() {
+		end := trk.EndTime()
+		eot := trk.events[len(trk.events)-1]
+		trk.events = trk.events[:len(trk.events)-1]
+		trk.Insert(time, msg)
+		if time > end {
+			end = time
+		}
+		trk.Append(end - trk.EndTime(), eot.message)
+		return
+	}
+	var now uint64 = 0
+	for i, ev := range trk.events {
+		if now + ev.deltaTime > time {
+			next := now + ev.deltaTime
+			acc := make([]Event, 0, len(trk.events)+1)
+			acc = append(acc, trk.events[:i]...)
+			acc = append(acc, Event{time - now, msg})
+			acc = append(acc, Event{next - time, ev.message})
+			acc = append(acc, trk.events[i+1:]...)
+			trk.events = acc
+			return
+		}
+		now += ev.deltaTime
+	}
+	trk.Append(time - now, msg)
+}
+
+// trk.HasEndOfTrack() returns true iff the final event is an end-of-track.
+//
+func (trk *Track) HasEndOfTrack() bool {
+	n := len(trk.events)
+	return n > 0 && isEndOfTrack(trk.events[n-1].message)
+}
+
+// smf.SetFormat() sets the MIDI file format.
+// Returns non-nil error if format is not 0 or 1.
+//
+func (smf *SMF) SetFormat(format int) error {
+	var err error
+	if format < 0 || 1 < format {
+		errmsg := "Unsupported SMF format %d, expected 0 or 1"
+		err = fmt.Errorf(errmsg, format)
+		return err
+	}
+	smf.header.format = format
+	return err
+}
+
+// smf.SetDivision() sets the clock division in ticks per quarter note.
+// Returns non-nil error if division is out of bounds.
+//
+func (smf *SMF) SetDivision(division int) error {
+	var err error
+	if division < 24 || 960 < division {
+		errmsg := "SMF division out of bounds, expected between 24 and 960, got %d"
+		err = fmt.Errorf(errmsg, division)
+		return err
+	}
+	smf.header.division = division
+	return err
+}
+
+// smf.AddTrack() appends track to the file.
+//
+func (smf *SMF) AddTrack(track *Track) {
+	smf.tracks = append(smf.tracks, *track)
+	smf.header.trackCount = len(smf.tracks)
+}
@@ -150,7 +150,6 @@ func ExpectSysexMessage(buffer []byte, index int) (mdata []byte, newIndex int, e
 		}
 		index++
 	}
-	return
 }
 	
 		
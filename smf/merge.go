@@ -0,0 +1,91 @@
+package smf
+
+/*
+** merge.go combines the tracks of a multi-track SMF into a single
+** time-ordered event stream.
+**
+*/
+
+import (
+	"github.com/plewto/pigiron/midi"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+// isEndOfTrack returns true iff msg is a meta end-of-track message.
+//
+func isEndOfTrack(msg gomidi.Message) bool {
+	d := msg.Data
+	return len(d) > 1 && d[0] == byte(midi.META) && d[1] == byte(midi.META_END_OF_TRACK)
+}
+
+// MergeTracks combines several tracks into a single time-ordered track.
+//
+// Event delta times are converted to absolute times within each source
+// track and the tracks are merged on absolute time.  Events with identical
+// times retain their original track order, so the tempo map on track 0 of a
+// format-1 file precedes simultaneous events on the remaining tracks.
+//
+// Individual end-of-track messages are removed and a single end-of-track
+// is appended at the time of the latest source track end.
+//
+func MergeTracks(tracks []Track) Track {
+	var count = 0
+	for _, trk := range tracks {
+		count += len(trk.events)
+	}
+	var acc = make([]Event, 0, count+1)
+	var indexes = make([]int, len(tracks))   // next event index for each track
+	var times = make([]uint64, len(tracks))  // absolute time of next event for each track
+	var ends = make([]uint64, len(tracks))   // absolute time of each track's final event
+	for i, trk := range tracks {
+		if len(trk.events) > 0 {
+			times[i] = trk.events[0].deltaTime
+		}
+	}
+	var previousTime uint64 = 0
+	for {
+		var next = -1
+		for i, trk := range tracks {
+			if indexes[i] >= len(trk.events) {
+				continue
+			}
+			if next == -1 || times[i] < times[next] {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+		event := tracks[next].events[indexes[next]]
+		time := times[next]
+		ends[next] = time
+		if !isEndOfTrack(event.message) {
+			acc = append(acc, Event{time - previousTime, event.message})
+			previousTime = time
+		}
+		indexes[next]++
+		if indexes[next] < len(tracks[next].events) {
+			times[next] += tracks[next].events[indexes[next]].deltaTime
+		}
+	}
+	var end = previousTime
+	for _, t := range ends {
+		if t > end {
+			end = t
+		}
+	}
+	eot := gomidi.NewMessage([]byte{byte(midi.META), byte(midi.META_END_OF_TRACK), 0x00})
+	acc = append(acc, Event{end - previousTime, eot})
+	return Track{acc}
+}
+
+// smf.MergedTrack returns all tracks combined into a single time-ordered track.
+// For format 0 files the result is equivalent to track 0.
+// Format 2 files contain independent sequences, only track 0 is returned.
+//
+func (smf *SMF) MergedTrack() Track {
+	if smf.Format() == 2 && len(smf.tracks) > 0 {
+		return MergeTracks(smf.tracks[0:1])
+	}
+	return MergeTracks(smf.tracks)
+}
@@ -0,0 +1,75 @@
+package smf
+
+import (
+	"fmt"
+	"testing"
+)
+
+var (
+	conductorBytes = []byte {
+		0x00, 0xFF, 0x51, 0x03, 0x07, 0xA1, 0x20,      // t   0 tempo 120 BPM
+		0x60, 0xFF, 0x51, 0x03, 0x0F, 0x42, 0x40,      // t  96 tempo 60 BPM
+		0x00, 0xFF, 0x2F, 0x00,			       // t  96 end of track
+	}
+	musicBytes = []byte {
+		0x00, 0x90, 0x3c, 0x40,			       // t   0 note on
+		0x60, 0x80, 0x3c, 0x00,			       // t  96 note off
+		0x30, 0x90, 0x3e, 0x40,			       // t 144 note on
+		0x30, 0x80, 0x3e, 0x00,			       // t 192 note off
+		0x00, 0xFF, 0x2F, 0x00,			       // t 192 end of track
+	}
+)
+
+
+func TestMergeTracks(t *testing.T) {
+	fmt.Println("TestMergeTracks")
+	conductor, music := new(Track), new(Track)
+	if _, err := conductor.convertEvents(conductorBytes); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := music.convertEvents(musicBytes); err != nil {
+		t.Fatalf("%s", err)
+	}
+	merged := MergeTracks([]Track{*conductor, *music})
+	events := merged.Events()
+	if len(events) != 7 {
+		t.Fatalf("Expected 7 merged events, got %d\n%s", len(events), merged.Dump())
+	}
+	expectTimes := []uint64{0, 0, 96, 96, 144, 192, 192}
+	var time uint64
+	for i, ev := range events {
+		time += ev.DeltaTime()
+		if time != expectTimes[i] {
+			errmsg := "Merged event %d expected at time %d, got %d\n%s"
+			t.Fatalf(errmsg, i, expectTimes[i], time, merged.Dump())
+		}
+	}
+	if !IsTempoChange(events[0].Message()) || !IsTempoChange(events[2].Message()) {
+		errmsg := "Expected tempo changes to precede simultaneous track 1 events\n%s"
+		t.Fatalf(errmsg, merged.Dump())
+	}
+	for i, ev := range events[:len(events)-1] {
+		if isEndOfTrack(ev.Message()) {
+			t.Fatalf("Unexpected end-of-track at merged event %d", i)
+		}
+	}
+	if !isEndOfTrack(events[len(events)-1].Message()) {
+		t.Fatalf("Merged track does not end with end-of-track")
+	}
+}
+
+func TestMergedDuration(t *testing.T) {
+	fmt.Println("TestMergedDuration")
+	conductor, music := new(Track), new(Track)
+	conductor.convertEvents(conductorBytes)
+	music.convertEvents(musicBytes)
+	smf := NewSMF()
+	smf.header = &Header{1, 2, 96}
+	smf.tracks = []Track{*conductor, *music}
+	// 96 ticks at 120 BPM + 96 ticks at 60 BPM
+	expect := 0.5 + 1.0
+	dur := smf.Duration()
+	if dur < expect-1e-6 || dur > expect+1e-6 {
+		t.Fatalf("Expected merged duration %f, got %f", expect, dur)
+	}
+}
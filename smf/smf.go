@@ -131,7 +131,8 @@ func TickDuration(division int, tempo float64) float64 {
 	return qdur/float64(division)
 }
 	
-// smf.Duration returns aproximate duration of track 0 in seconds.
+// smf.Duration returns aproximate duration in seconds.
+// The duration is calculated over the merged timeline of all tracks.
 //
 func (smf *SMF) Duration() float64 {
 	if len(smf.tracks) == 0 {
@@ -140,22 +141,14 @@ func (smf *SMF) Duration() float64 {
 	var acc float64 = 0.0
 	var tempo float64 = 120
 	var tick = TickDuration(smf.Division(), tempo)
-	var track = smf.tracks[0]
+	var track = smf.MergedTrack()
 	for _, event := range track.events {
+		acc += float64(event.deltaTime) * tick
 		msg := event.Message()
 		if IsTempoChange(msg) {
-			tempo, _ := MetaTempoBPM(msg)
+			tempo, _ = MetaTempoBPM(msg)
 			tick = TickDuration(smf.Division(), tempo)
 		}
-		acc += float64(event.deltaTime) * tick
 	}
 	return acc
 }
-			
-			
-		
-		
-		
-		
-			
-		
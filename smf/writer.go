@@ -0,0 +1,164 @@
+package smf
+
+/*
+** writer.go defines functions for serializing SMF objects to bytes and files.
+**
+*/
+
+import (
+	"fmt"
+	"os"
+	"github.com/plewto/pigiron/midi"
+	"github.com/plewto/pigiron/pigpath"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+const MAX_VLQ_VALUE = 0x0FFFFFFF
+
+// shortBytes returns 16-bit value as big-endian bytes.
+//
+func shortBytes(n int) []byte {
+	return []byte{msb(n), lsb(n)}
+}
+
+// longBytes returns 32-bit value as big-endian bytes.
+//
+func longBytes(n int) []byte {
+	return []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+// chunkBytes returns complete chunk, id, length and data.
+//
+func chunkBytes(id chunkID, data []byte) []byte {
+	acc := make([]byte, 0, len(data) + 8)
+	acc = append(acc, id[:]...)
+	acc = append(acc, longBytes(len(data))...)
+	acc = append(acc, data...)
+	return acc
+}
+
+// h.Bytes() returns the header as a complete MThd chunk.
+//
+func (h *Header) Bytes() []byte {
+	data := make([]byte, 0, 6)
+	data = append(data, shortBytes(h.format)...)
+	data = append(data, shortBytes(h.trackCount)...)
+	data = append(data, shortBytes(h.division)...)
+	return chunkBytes(headerID, data)
+}
+
+// eventBytes returns the file representation of a single event message.
+// System exclusive messages are written as F0 <length> <data> as required
+// by the SMF specification.  All other messages are written unaltered.
+//
+func eventBytes(msg gomidi.Message) []byte {
+	d := msg.Data
+	if len(d) > 0 && d[0] == byte(midi.SYSEX) {
+		acc := []byte{d[0]}
+		acc = append(acc, NewVLQ(len(d)-1).Bytes()...)
+		return append(acc, d[1:]...)
+	}
+	return d
+}
+
+// trk.Bytes() returns the track as a complete MTrk chunk.
+//
+// If runningStatus is true, status bytes of consecutive channel messages
+// with the same status are omitted.   An end-of-track message is appended
+// if the track does not already end with one.
+//
+// Returns non-nil error if an event is empty or a delta time exceeds the
+// maximum VLQ value.
+//
+func (trk *Track) Bytes(runningStatus bool) ([]byte, error) {
+	var err error
+	var data = make([]byte, 0, trk.Length() + 4 * len(trk.events) + 4)
+	var currentStatus byte = 0
+	for i, ev := range trk.events {
+		if ev.deltaTime > MAX_VLQ_VALUE {
+			errmsg := "Track event %d delta time out of bounds: %d"
+			err = fmt.Errorf(errmsg, i, ev.deltaTime)
+			return data, err
+		}
+		d := ev.message.Data
+		if len(d) == 0 {
+			errmsg := "Track event %d has empty message"
+			err = fmt.Errorf(errmsg, i)
+			return data, err
+		}
+		data = append(data, NewVLQ(int(ev.deltaTime)).Bytes()...)
+		st := d[0]
+		if midi.IsChannelStatus(midi.StatusByte(st)) {
+			if runningStatus && st == currentStatus {
+				data = append(data, d[1:]...)
+			} else {
+				data = append(data, d...)
+			}
+			currentStatus = st
+		} else {
+			data = append(data, eventBytes(ev.message)...)
+			currentStatus = 0
+		}
+	}
+	if !trk.HasEndOfTrack() {
+		data = append(data, 0x00, byte(midi.META), byte(midi.META_END_OF_TRACK), 0x00)
+	}
+	return chunkBytes(trackID, data), err
+}
+
+// smf.Bytes() returns the complete file contents.
+// Returns non-nil error if the format is inconsistent with the track count.
+//
+func (smf *SMF) Bytes(runningStatus bool) ([]byte, error) {
+	var err error
+	var acc []byte
+	if smf.Format() == 0 && smf.TrackCount() != 1 {
+		errmsg := "Format 0 SMF must have exactly 1 track, has %d"
+		err = fmt.Errorf(errmsg, smf.TrackCount())
+		return acc, err
+	}
+	if smf.TrackCount() == 0 {
+		err = fmt.Errorf("SMF has no tracks")
+		return acc, err
+	}
+	header := Header{smf.Format(), smf.TrackCount(), smf.Division()}
+	acc = header.Bytes()
+	for i, trk := range smf.tracks {
+		var b []byte
+		b, err = trk.Bytes(runningStatus)
+		if err != nil {
+			errmsg := "Can not convert track %d to bytes\n%s"
+			err = fmt.Errorf(errmsg, i, err)
+			return acc, err
+		}
+		acc = append(acc, b...)
+	}
+	return acc, err
+}
+
+// WriteSMF saves smf to a file.
+// The filename may use the special directory prefixes ~/ and !/
+// If runningStatus is true channel messages use running status compression.
+//
+func WriteSMF(smf *SMF, filename string, runningStatus bool) error {
+	filename = pigpath.SubSpecialDirectories(filename)
+	data, err := smf.Bytes(runningStatus)
+	if err != nil {
+		return err
+	}
+	file, ferr := os.Create(filename)
+	if ferr != nil {
+		errmsg := "Can not create SMF file: '%s'\n%s"
+		err = fmt.Errorf(errmsg, filename, ferr.Error())
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err != nil {
+		errmsg := "Can not write SMF file: '%s'\n%s"
+		err = fmt.Errorf(errmsg, filename, err.Error())
+		return err
+	}
+	smf.filename = filename
+	return err
+}
@@ -0,0 +1,161 @@
+package smf
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	gomidi "gitlab.com/gomidi/midi/v2"
+)
+
+func makeTestTrack() *Track {
+	trk := NewTrack()
+	tempo, _ := MakeTempoMessage(100)
+	name, _ := MakeTextMessage(0x03, "Test")
+	trk.Append(0, tempo)
+	trk.Append(0, name)
+	trk.Append(0, gomidi.NewMessage([]byte{0x90, 0x3c, 0x40}))
+	trk.Append(48, gomidi.NewMessage([]byte{0x90, 0x3c, 0x00}))
+	trk.Append(0, gomidi.NewMessage([]byte{0x90, 0x3e, 0x40}))
+	trk.Append(200, gomidi.NewMessage([]byte{0x80, 0x3e, 0x00}))
+	trk.Append(0, gomidi.NewMessage([]byte{0xC1, 0x05}))
+	return trk
+}
+
+func compareTracks(t *testing.T, a *Track, b *Track) {
+	if len(a.events) != len(b.events) {
+		t.Fatalf("Expected %d events, got %d\n%s", len(a.events), len(b.events), b.Dump())
+	}
+	for i, ev := range a.events {
+		other := b.events[i]
+		if ev.deltaTime != other.deltaTime || !bytes.Equal(ev.message.Data, other.message.Data) {
+			errmsg := "Event %d mismatch, expected %s, got %s"
+			t.Fatalf(errmsg, i, ev.String(), other.String())
+		}
+	}
+}
+
+func TestTrackBytes(t *testing.T) {
+	fmt.Println("TestTrackBytes")
+	trk := makeTestTrack()
+	full, err := trk.Bytes(false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	compressed, err := trk.Bytes(true)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(compressed) != len(full) - 2 {
+		errmsg := "Expected running status to save 2 bytes, full %d, compressed %d"
+		t.Fatalf(errmsg, len(full), len(compressed))
+	}
+	for _, data := range [][]byte{full, compressed} {
+		length, _, _ := TakeLong(data[4:])
+		if !chunkID([4]byte{data[0], data[1], data[2], data[3]}).eq(trackID) {
+			t.Fatalf("Expected MTrk chunk id, got %v", data[0:4])
+		}
+		other := new(Track)
+		_, err = other.convertEvents(data[8:8+length])
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if !other.HasEndOfTrack() {
+			t.Fatalf("Expected end-of-track to be inserted")
+		}
+		other.events = other.events[:len(other.events)-1]
+		compareTracks(t, trk, other)
+	}
+}
+
+func TestWriteSMF(t *testing.T) {
+	fmt.Println("TestWriteSMF")
+	dir := t.TempDir()
+	for format, count := range []int{1, 3} {
+		smf := NewSMF()
+		if err := smf.SetFormat(format); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if err := smf.SetDivision(96); err != nil {
+			t.Fatalf("%s", err)
+		}
+		for i := 0; i < count; i++ {
+			smf.AddTrack(makeTestTrack())
+		}
+		filename := filepath.Join(dir, fmt.Sprintf("format%d.mid", format))
+		if err := WriteSMF(smf, filename, true); err != nil {
+			t.Fatalf("%s", err)
+		}
+		other, err := ReadSMF(filename)
+		if err != nil {
+			t.Fatalf("Can not read written SMF\n%s", err)
+		}
+		if other.Format() != format || other.Division() != 96 || other.TrackCount() != count {
+			errmsg := "Header mismatch, format %d division %d tracks %d"
+			t.Fatalf(errmsg, other.Format(), other.Division(), other.TrackCount())
+		}
+		for i := 0; i < count; i++ {
+			trk, _ := other.Track(i)
+			trk.events = trk.events[:len(trk.events)-1]
+			compareTracks(t, makeTestTrack(), &trk)
+		}
+	}
+}
+
+func TestWriteSMFErrors(t *testing.T) {
+	smf := NewSMF()
+	if _, err := smf.Bytes(false); err == nil {
+		t.Fatalf("Did not detect SMF without tracks")
+	}
+	smf.AddTrack(makeTestTrack())
+	smf.AddTrack(makeTestTrack())
+	if _, err := smf.Bytes(false); err == nil {
+		t.Fatalf("Did not detect format 0 SMF with 2 tracks")
+	}
+	if err := smf.SetFormat(2); err == nil {
+		t.Fatalf("Did not detect unsupported format 2")
+	}
+	if err := smf.SetDivision(2000); err == nil {
+		t.Fatalf("Did not detect out of bounds division")
+	}
+}
+
+func TestTrackInsert(t *testing.T) {
+	trk := NewTrack()
+	trk.Append(10, gomidi.NewMessage([]byte{0x90, 0x3c, 0x40}))
+	trk.Append(10, gomidi.NewMessage([]byte{0x80, 0x3c, 0x00}))
+	trk.Insert(15, gomidi.NewMessage([]byte{0xC0, 0x01}))
+	trk.Insert(30, gomidi.NewMessage([]byte{0xC0, 0x02}))
+	expect := []uint64{10, 5, 5, 10}
+	for i, ev := range trk.Events() {
+		if ev.DeltaTime() != expect[i] {
+			t.Fatalf("Insert expected delta %d at index %d, got %d\n%s", expect[i], i, ev.DeltaTime(), trk.Dump())
+		}
+	}
+	if trk.EndTime() != 30 {
+		t.Fatalf("Expected end time 30, got %d", trk.EndTime())
+	}
+}
+
+func TestTrackInsertEndOfTrack(t *testing.T) {
+	fmt.Println("TestTrackInsertEndOfTrack")
+	eot := gomidi.NewMessage([]byte{0xFF, 0x2F, 0x00})
+	trk := NewTrack()
+	trk.Append(10, gomidi.NewMessage([]byte{0x90, 0x3c, 0x40}))
+	trk.Append(10, eot)
+	trk.Insert(20, gomidi.NewMessage([]byte{0xC0, 0x01}))
+	trk.Insert(30, gomidi.NewMessage([]byte{0xC0, 0x02}))
+	expect := NewTrack()
+	expect.Append(10, gomidi.NewMessage([]byte{0x90, 0x3c, 0x40}))
+	expect.Append(10, gomidi.NewMessage([]byte{0xC0, 0x01}))
+	expect.Append(10, gomidi.NewMessage([]byte{0xC0, 0x02}))
+	expect.Append(0, eot)
+	compareTracks(t, expect, trk)
+	if !trk.HasEndOfTrack() {
+		t.Fatal("Expected track to end with end-of-track")
+	}
+	data, _ := trk.Bytes(false)
+	if n := bytes.Count(data, []byte{0xFF, 0x2F}); n != 1 {
+		t.Fatalf("Expected a single end-of-track, got %d\n%s", n, trk.Dump())
+	}
+}